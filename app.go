@@ -1,11 +1,10 @@
 package main
 
 import (
-	"bytes"
-	"encoding/json"
-	"fmt"
-	"github.com/pion/webrtc/v3"
-	"io"
+	"context"
+	"crypto/tls"
+	"errors"
+	"log/slog"
 	"net/http"
 	"os"
 	"os/signal"
@@ -13,122 +12,155 @@ import (
 	"codeberg.org/greatape/goldgorilla/models"
 	"codeberg.org/greatape/goldgorilla/repositories"
 	"codeberg.org/greatape/goldgorilla/routers"
+	"codeberg.org/greatape/goldgorilla/signaling"
+	"codeberg.org/greatape/goldgorilla/store"
+	"github.com/pion/turn/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	"sync"
 	"syscall"
-	"time"
 )
 
 type App struct {
-	conf   *models.ConfigModel
-	router *routers.Router
-	src    string
+	conf     *models.ConfigModel
+	router   *routers.Router
+	signaler signaling.Signaler
+	log      *slog.Logger
+	roomRepo *repositories.RoomRepository
+	// turnServer is the embedded turn server, nil when it's disabled
+	turnServer *turn.Server
+	// serverTLS serves the api over https, nil means plain http
+	serverTLS *tls.Config
+	// wsSignaler is the signaler when signaling over websocket, nil otherwise
+	wsSignaler *signaling.WebSocketSignaler
+	// drained is closed once draining is over
+	drained chan struct{}
 }
 
-func (a *App) Init(srcListenAddr string, logjamBaseUrl string, iceTCPMUXListenPort uint, customICEHostCandidateIP string) {
-	println("initializing ..")
-	a.src = srcListenAddr
-	var iceServers []webrtc.ICEServer
-	iceconfjson, err := os.ReadFile("./ice.servers.json")
-	if err != nil {
-		println("[E] error reading ice.servers.json: " + err.Error())
+func (a *App) Init(conf *models.ConfigModel, log *slog.Logger) {
+	a.log = log
+	slog.SetDefault(log)
+	a.log.Info("initializing")
+	a.conf = conf
+	if len(a.conf.SharedSecret) == 0 {
+		a.log.Warn("no shared secret configured, requests between logjam and goldgorilla aren't signed and anyone can use WHIP/WHEP")
+	}
+	if a.conf.EmbeddedTURN.Enabled {
+		turnServer, err := startEmbeddedTURN(a.conf, a.log)
+		panicIfErr(err)
+		a.turnServer = turnServer
+	}
+	serverTLS, logjamTLS, err := newTLSConfigs(a.conf, a.log)
+	panicIfErr(err)
+	a.serverTLS = serverTLS
+	var wsSignaler *signaling.WebSocketSignaler
+	if a.conf.SignalingMode == models.SignalingModeWebSocket {
+		wsSignaler = signaling.NewWebSocketSignaler(a.conf.LogjamBaseUrl, a.conf.SharedSecret, logjamTLS, a.log)
+		a.signaler = wsSignaler
 	} else {
-		err = json.Unmarshal(iceconfjson, &iceServers)
-		if err != nil {
-			panic("[E] can't parse ice.servers.json: " + err.Error())
-		}
+		a.signaler = signaling.NewLogjamSignaler(a.conf.LogjamBaseUrl, a.conf.Timeouts.Signaling, a.conf.SharedSecret, logjamTLS)
 	}
-	startRejoinCH := make(chan models.RejoinMode, 2)
-	a.conf = &models.ConfigModel{
-		LogjamBaseUrl:            logjamBaseUrl,
-		ICEServers:               iceServers,
-		ICETCPMUXListenPort:      iceTCPMUXListenPort,
-		CustomICEHostCandidateIP: customICEHostCandidateIP,
-		StartRejoinCH:            &startRejoinCH,
+	var roomStore store.Store
+	if len(a.conf.StateFile) > 0 {
+		roomStore = store.NewFileStore(a.conf.StateFile)
 	}
-	roomRepo := repositories.NewRoomRepository(a.conf)
-	a.router = &routers.Router{}
+	rejoinRepo := repositories.NewRejoinRepository(a.conf, a.signaler, a.log)
+	roomRepo := repositories.NewRoomRepository(a.conf, a.signaler, rejoinRepo, roomStore, a.log)
+	a.roomRepo = roomRepo
+	panicIfErr(roomRepo.RegisterMetrics(prometheus.DefaultRegisterer))
+	a.router = routers.NewRouter(a.log)
 	respHelper := controllers.NewResponseHelper()
-	roomCtrl := controllers.NewRoomController(respHelper, roomRepo, a.conf)
+	roomCtrl := controllers.NewRoomController(respHelper, roomRepo, a.signaler, a.conf, a.log)
+	if wsSignaler != nil {
+		// the rest routes stay registered, logjam can still fall back to them
+		wsSignaler.SetHandler(roomCtrl)
+		go wsSignaler.Run()
+	}
+	a.wsSignaler = wsSignaler
+	a.drained = make(chan struct{})
 
-	err = a.router.RegisterRoutes(roomCtrl)
+	whipCtrl := controllers.NewWHIPController(respHelper, roomRepo, a.conf)
+	whepCtrl := controllers.NewWHEPController(respHelper, roomRepo, a.conf)
+	adminCtrl := controllers.NewAdminController(respHelper, roomRepo, rejoinRepo, a.conf)
+
+	err = a.router.RegisterRoutes(roomCtrl, whipCtrl, whepCtrl, adminCtrl)
 	panicIfErr(err)
 
 	{
 		sigs := make(chan os.Signal, 1)
-		signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM, syscall.SIGKILL, syscall.SIGILL)
+		signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
 		go func() {
-			a.onDie(<-sigs)
+			go a.onDie(<-sigs)
+			sig := <-sigs
+			a.log.Warn("exiting without finishing draining", "signal", sig.String())
+			os.Exit(1)
 		}()
 	}
 }
 
 func (a *App) Run() {
 	go func() {
-		//*a.conf.StartRejoinCH <- true
-		c := &http.Client{
-			Timeout: 8 * time.Second,
-		}
-		for data := range *a.conf.StartRejoinCH {
-			if data.SimplyJoin {
-				buffer, _ := json.Marshal(map[string]any{"roomId": data.RoomId})
-				body := bytes.NewReader(buffer)
-				res, err := c.Post(a.conf.LogjamBaseUrl+"/join", "application/json", body)
-				if err != nil {
-					println(err.Error())
-					time.Sleep(4 * time.Second)
-					*a.conf.StartRejoinCH <- data
-					continue
-				}
-				if res.StatusCode > 204 {
-					resbody, _ := io.ReadAll(res.Body)
-					println("get /join "+res.Status, string(resbody))
-					time.Sleep(4 * time.Second)
-					*a.conf.StartRejoinCH <- data
-					continue
-				}
-			} else {
-				data.SimplyJoin = true
-				reqModel := struct {
-					RoomId string `json:"roomId"`
-				}{
-					RoomId: data.RoomId,
-				}
-				serializedReqBody, err := json.Marshal(reqModel)
-				if err != nil {
-					println(err.Error())
-					*a.conf.StartRejoinCH <- data
-					continue
-				}
-
-				resp, err := c.Post(a.conf.LogjamBaseUrl+"/rejoin", "application/json", bytes.NewReader(serializedReqBody))
-				if err != nil {
-					println(err.Error())
-					continue
-				}
-				if resp.StatusCode > 204 {
-					println("/rejoin", resp.Status)
-				}
-				/*if err != nil {
-					println(err.Error())
-					*a.conf.StartRejoinCH <- data
-					continue
-				}
-				if resp.StatusCode > 204 {
-					println("/rejoin", resp.Status)
-					*a.conf.StartRejoinCH <- data
-				}*/
-			}
+		if err := a.roomRepo.RestoreRooms(); err != nil {
+			a.log.Error("can't restore rooms", "err", err)
 		}
 	}()
-	err := a.router.Serve(a.src)
+	err := a.router.Serve(a.conf.ListenAddr, a.serverTLS)
+	if errors.Is(err, http.ErrServerClosed) {
+		<-a.drained
+		return
+	}
 	panicIfErr(err)
 }
 
+// onDie drains goldgorilla, a second signal makes it exit right away
 func (a *App) onDie(sig os.Signal) {
-	fmt.Println("<-", sig)
-
+	a.log.Info("draining", "signal", sig.String())
+	ctx, cancel := context.WithTimeout(context.Background(), a.conf.Timeouts.Shutdown)
+	defer cancel()
+	done := make(chan struct{})
+	go func() {
+		a.drain(ctx)
+		close(done)
+	}()
+	select {
+	case <-done:
+		a.log.Info("drained, exiting")
+	case <-ctx.Done():
+		a.log.Warn("draining took too long, exiting anyway", "timeout", a.conf.Timeouts.Shutdown)
+	}
+	close(a.drained)
 	os.Exit(0)
 }
 
+// drain stops taking new rooms (the healthcheck answers 503), tells logjam goldgorilla is leaving its rooms so they can move,
+// closes every peer connection and shuts the http server down.
+func (a *App) drain(ctx context.Context) {
+	roomIds := a.roomRepo.Drain()
+	wg := &sync.WaitGroup{}
+	for _, roomId := range roomIds {
+		wg.Add(1)
+		go func(roomId string) {
+			defer wg.Done()
+			if err := a.signaler.Leave(roomId); err != nil {
+				a.log.Error("can't tell logjam about leaving room", "roomId", roomId, "err", err)
+			}
+		}(roomId)
+	}
+	wg.Wait()
+	a.roomRepo.CloseRooms()
+	a.log.Info("rooms closed", "count", len(roomIds))
+	if err := a.router.Shutdown(ctx); err != nil {
+		a.log.Error("can't shut the http server down", "err", err)
+	}
+	if a.wsSignaler != nil {
+		a.wsSignaler.Close()
+	}
+	if a.turnServer != nil {
+		if err := a.turnServer.Close(); err != nil {
+			a.log.Error("can't close embedded turn server", "err", err)
+		}
+	}
+}
+
 func panicIfErr(err error) {
 	if err != nil {
 		panic(err)
@@ -0,0 +1,52 @@
+package certs
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+)
+
+var ErrNoCertificates = errors.New("no certificates found")
+
+// LoadCAPool reads a pem bundle of ca certificates
+func LoadCAPool(file string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("%w in %s", ErrNoCertificates, file)
+	}
+	return pool, nil
+}
+
+// ServerConfig serves the key pair, when clientCAs isn't nil the certificates clients present are verified against them.
+// presenting one stays optional (WHIP/WHEP clients, health checks and scrapers don't have any), the routes that need one
+// check for a verified chain themselves.
+func ServerConfig(keyPair *KeyPair, clientCAs *x509.CertPool) *tls.Config {
+	config := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: keyPair.GetCertificate,
+	}
+	if clientCAs != nil {
+		config.ClientCAs = clientCAs
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return config
+}
+
+// ClientConfig presents keyPair to servers asking for a client certificate and trusts rootCAs instead of the system roots,
+// both are optional.
+func ClientConfig(keyPair *KeyPair, rootCAs *x509.CertPool) *tls.Config {
+	config := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		RootCAs:    rootCAs,
+	}
+	if keyPair != nil {
+		config.GetClientCertificate = keyPair.GetClientCertificate
+	}
+	return config
+}
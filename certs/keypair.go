@@ -0,0 +1,90 @@
+package certs
+
+import (
+	"crypto/tls"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// KeyPair is a certificate and its key loaded from files, it's reloaded when either file changes
+// so renewed certificates are picked up by new connections without a restart.
+type KeyPair struct {
+	certFile string
+	keyFile  string
+	log      *slog.Logger
+
+	lock     *sync.RWMutex
+	cert     *tls.Certificate
+	modTimes [2]time.Time
+}
+
+func NewKeyPair(certFile string, keyFile string, log *slog.Logger) (*KeyPair, error) {
+	kp := &KeyPair{
+		certFile: certFile,
+		keyFile:  keyFile,
+		log:      log.With("certFile", certFile),
+		lock:     &sync.RWMutex{},
+	}
+	if err := kp.Reload(); err != nil {
+		return nil, err
+	}
+	return kp, nil
+}
+
+// Reload reads the certificate and the key again, the current pair is kept when they can't be loaded
+func (kp *KeyPair) Reload() error {
+	modTimes := kp.readModTimes()
+	cert, err := tls.LoadX509KeyPair(kp.certFile, kp.keyFile)
+	if err != nil {
+		return err
+	}
+	kp.lock.Lock()
+	kp.cert = &cert
+	kp.modTimes = modTimes
+	kp.lock.Unlock()
+	return nil
+}
+
+// Watch checks the files every interval and reloads the pair when they've changed, it never returns
+func (kp *KeyPair) Watch(interval time.Duration) {
+	for range time.Tick(interval) {
+		kp.lock.RLock()
+		modTimes := kp.modTimes
+		kp.lock.RUnlock()
+		if kp.readModTimes() == modTimes {
+			continue
+		}
+		if err := kp.Reload(); err != nil {
+			// the files may be halfway through being replaced, the next tick tries again
+			kp.log.Error("can't reload certificate, keeping the current one", "err", err)
+			continue
+		}
+		kp.log.Info("certificate reloaded")
+	}
+}
+
+func (kp *KeyPair) Certificate() *tls.Certificate {
+	kp.lock.RLock()
+	defer kp.lock.RUnlock()
+	return kp.cert
+}
+
+func (kp *KeyPair) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return kp.Certificate(), nil
+}
+
+func (kp *KeyPair) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	return kp.Certificate(), nil
+}
+
+func (kp *KeyPair) readModTimes() [2]time.Time {
+	var modTimes [2]time.Time
+	for i, file := range []string{kp.certFile, kp.keyFile} {
+		if info, err := os.Stat(file); err == nil {
+			modTimes[i] = info.ModTime()
+		}
+	}
+	return modTimes
+}
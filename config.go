@@ -0,0 +1,333 @@
+package main
+
+import (
+	"bytes"
+	"codeberg.org/greatape/goldgorilla/models"
+	"codeberg.org/greatape/goldgorilla/repositories"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const envPrefix = "GOLDGORILLA_"
+
+// configOption is a setting that can be overridden by an environment variable (envPrefix+env) and, when flag isn't empty, a flag
+type configOption struct {
+	env   string
+	flag  string
+	usage string
+	set   func(conf *models.ConfigModel, value string) error
+}
+
+var configOptions = []configOption{
+	{"LISTEN_ADDR", "src", "listenHost:listenPort", func(conf *models.ConfigModel, value string) error {
+		conf.ListenAddr = value
+		return nil
+	}},
+	{"LOGJAM_BASE_URL", "logjam-base-url", "logjam base url( shouldn't end with / )", func(conf *models.ConfigModel, value string) error {
+		conf.LogjamBaseUrl = value
+		return nil
+	}},
+	{"SIGNALING_MODE", "signaling-mode", "how to talk to logjam: " + models.SignalingModeHTTP + " (a POST per message) or " + models.SignalingModeWebSocket + " (one persistent link)", func(conf *models.ConfigModel, value string) error {
+		conf.SignalingMode = value
+		return nil
+	}},
+	{"ICE_TCP_MUX_LISTEN_PORT", "ice-tcp-mux-listen-port", "listen port to use for tcp ice candidates", func(conf *models.ConfigModel, value string) error {
+		return parseUint(value, &conf.ICETCPMUXListenPort)
+	}},
+	{"CUSTOM_ICE_HOST_CANDIDATE_IP", "custom-ice-host-candidate-ip", "set to override host ice candidates address", func(conf *models.ConfigModel, value string) error {
+		conf.NAT1To1IPs = []string{value}
+		return nil
+	}},
+	{"NAT_1TO1_IPS", "", "", func(conf *models.ConfigModel, value string) error {
+		conf.NAT1To1IPs = parseList(value)
+		return nil
+	}},
+	{"UDP_PORT_MIN", "", "", func(conf *models.ConfigModel, value string) error {
+		return parseUint(value, &conf.UDPPortMin)
+	}},
+	{"UDP_PORT_MAX", "", "", func(conf *models.ConfigModel, value string) error {
+		return parseUint(value, &conf.UDPPortMax)
+	}},
+	{"ICE_SERVERS", "", "", func(conf *models.ConfigModel, value string) error {
+		return json.Unmarshal([]byte(value), &conf.ICEServers)
+	}},
+	{"ICE_SERVERS_FILE", "", "", func(conf *models.ConfigModel, value string) error {
+		conf.ICEServersFile = value
+		return nil
+	}},
+	{"LAST_N", "last-n", "video is only forwarded from the N most recent speakers plus pinned peers, 0 forwards all of it", func(conf *models.ConfigModel, value string) error {
+		return parseUint(value, &conf.LastN)
+	}},
+	{"TOP_K_AUDIO", "", "", func(conf *models.ConfigModel, value string) error {
+		return parseUint(value, &conf.TopKAudio)
+	}},
+	{"STATE_FILE", "state-file", "json file the rooms are kept in across restarts, empty turns it off", func(conf *models.ConfigModel, value string) error {
+		conf.StateFile = value
+		return nil
+	}},
+	{"TLS_CERT_FILE", "tls-cert", "certificate to serve the api over https with", func(conf *models.ConfigModel, value string) error {
+		conf.TLS.CertFile = value
+		return nil
+	}},
+	{"TLS_KEY_FILE", "tls-key", "key of the certificate", func(conf *models.ConfigModel, value string) error {
+		conf.TLS.KeyFile = value
+		return nil
+	}},
+	{"TLS_CLIENT_CA_FILE", "tls-client-ca", "CAs client certificates have to be signed by (mutual tls)", func(conf *models.ConfigModel, value string) error {
+		conf.TLS.ClientCAFile = value
+		return nil
+	}},
+	{"LOGJAM_TLS_CERT_FILE", "", "", func(conf *models.ConfigModel, value string) error {
+		conf.LogjamTLS.CertFile = value
+		return nil
+	}},
+	{"LOGJAM_TLS_KEY_FILE", "", "", func(conf *models.ConfigModel, value string) error {
+		conf.LogjamTLS.KeyFile = value
+		return nil
+	}},
+	{"LOGJAM_TLS_CA_FILE", "", "", func(conf *models.ConfigModel, value string) error {
+		conf.LogjamTLS.CAFile = value
+		return nil
+	}},
+	{"CERT_RELOAD_INTERVAL", "", "", func(conf *models.ConfigModel, value string) error {
+		return parseDuration(value, &conf.CertReloadInterval)
+	}},
+	{"ICE_SERVERS_RELOAD_INTERVAL", "", "", func(conf *models.ConfigModel, value string) error {
+		return parseDuration(value, &conf.ICEServersReloadInterval)
+	}},
+	{"TURN_REST_SECRET", "", "", func(conf *models.ConfigModel, value string) error {
+		conf.TURNREST.Secret = value
+		return nil
+	}},
+	{"TURN_REST_TTL", "", "", func(conf *models.ConfigModel, value string) error {
+		return parseDuration(value, &conf.TURNREST.TTL)
+	}},
+	{"TURN_REST_URIS", "", "", func(conf *models.ConfigModel, value string) error {
+		conf.TURNREST.URIs = parseList(value)
+		return nil
+	}},
+	{"EMBEDDED_TURN_ENABLED", "embedded-turn", "run a turn/stun server inside goldgorilla", func(conf *models.ConfigModel, value string) error {
+		return parseBool(value, &conf.EmbeddedTURN.Enabled)
+	}},
+	{"EMBEDDED_TURN_REALM", "", "", func(conf *models.ConfigModel, value string) error {
+		conf.EmbeddedTURN.Realm = value
+		return nil
+	}},
+	{"EMBEDDED_TURN_PUBLIC_IP", "embedded-turn-public-ip", "address clients reach the embedded turn server at", func(conf *models.ConfigModel, value string) error {
+		conf.EmbeddedTURN.PublicIP = value
+		return nil
+	}},
+	{"EMBEDDED_TURN_UDP_LISTEN_ADDR", "", "", func(conf *models.ConfigModel, value string) error {
+		conf.EmbeddedTURN.UDPListenAddr = value
+		return nil
+	}},
+	{"EMBEDDED_TURN_TCP_LISTEN_ADDR", "", "", func(conf *models.ConfigModel, value string) error {
+		conf.EmbeddedTURN.TCPListenAddr = value
+		return nil
+	}},
+	{"EMBEDDED_TURN_RELAY_BIND_ADDR", "", "", func(conf *models.ConfigModel, value string) error {
+		conf.EmbeddedTURN.RelayBindAddr = value
+		return nil
+	}},
+	{"EMBEDDED_TURN_RELAY_PORT_MIN", "", "", func(conf *models.ConfigModel, value string) error {
+		return parseUint(value, &conf.EmbeddedTURN.RelayPortMin)
+	}},
+	{"EMBEDDED_TURN_RELAY_PORT_MAX", "", "", func(conf *models.ConfigModel, value string) error {
+		return parseUint(value, &conf.EmbeddedTURN.RelayPortMax)
+	}},
+	{"EMBEDDED_TURN_USERNAME", "", "", func(conf *models.ConfigModel, value string) error {
+		conf.EmbeddedTURN.Username = value
+		return nil
+	}},
+	{"EMBEDDED_TURN_PASSWORD", "", "", func(conf *models.ConfigModel, value string) error {
+		conf.EmbeddedTURN.Password = value
+		return nil
+	}},
+	{"CODECS", "", "", func(conf *models.ConfigModel, value string) error {
+		conf.Codecs = parseList(value)
+		return nil
+	}},
+	{"MIN_VIDEO_BITRATE", "min-video-bitrate", "estimated bitrate (bps) below which a subscriber only gets audio", func(conf *models.ConfigModel, value string) error {
+		return parseUint(value, &conf.MinVideoBitrate)
+	}},
+	{"ADMIN_TOKEN", "admin-token", "bearer token for the /admin api, it stays locked when empty", func(conf *models.ConfigModel, value string) error {
+		conf.AdminToken = value
+		return nil
+	}},
+	{"SHARED_SECRET", "", "", func(conf *models.ConfigModel, value string) error {
+		conf.SharedSecret = value
+		return nil
+	}},
+	{"SIGNATURE_MAX_SKEW", "", "", func(conf *models.ConfigModel, value string) error {
+		return parseDuration(value, &conf.SignatureMaxSkew)
+	}},
+	{"LOG_LEVEL", "log-level", "debug, info, warn or error", func(conf *models.ConfigModel, value string) error {
+		conf.LogLevel = value
+		return nil
+	}},
+	{"LOG_FORMAT", "log-format", models.LogFormatText + " or " + models.LogFormatJSON, func(conf *models.ConfigModel, value string) error {
+		conf.LogFormat = value
+		return nil
+	}},
+	{"TIMEOUTS_SIGNALING", "", "", func(conf *models.ConfigModel, value string) error {
+		return parseDuration(value, &conf.Timeouts.Signaling)
+	}},
+	{"TIMEOUTS_ICE_GATHERING", "", "", func(conf *models.ConfigModel, value string) error {
+		return parseDuration(value, &conf.Timeouts.ICEGathering)
+	}},
+	{"TIMEOUTS_ICE_DISCONNECTED", "", "", func(conf *models.ConfigModel, value string) error {
+		return parseDuration(value, &conf.Timeouts.ICEDisconnected)
+	}},
+	{"TIMEOUTS_ICE_FAILED", "", "", func(conf *models.ConfigModel, value string) error {
+		return parseDuration(value, &conf.Timeouts.ICEFailed)
+	}},
+	{"TIMEOUTS_ICE_KEEPALIVE", "", "", func(conf *models.ConfigModel, value string) error {
+		return parseDuration(value, &conf.Timeouts.ICEKeepalive)
+	}},
+	{"TIMEOUTS_ICE_RESTART_GRACE", "", "", func(conf *models.ConfigModel, value string) error {
+		return parseDuration(value, &conf.Timeouts.ICERestartGrace)
+	}},
+	{"TIMEOUTS_NEGOTIATION", "", "", func(conf *models.ConfigModel, value string) error {
+		return parseDuration(value, &conf.Timeouts.Negotiation)
+	}},
+	{"TIMEOUTS_SHUTDOWN", "", "", func(conf *models.ConfigModel, value string) error {
+		return parseDuration(value, &conf.Timeouts.Shutdown)
+	}},
+	{"RETRY_JOIN_DELAY", "", "", func(conf *models.ConfigModel, value string) error {
+		return parseDuration(value, &conf.Retry.JoinDelay)
+	}},
+	{"RETRY_JOIN_MAX_DELAY", "", "", func(conf *models.ConfigModel, value string) error {
+		return parseDuration(value, &conf.Retry.JoinMaxDelay)
+	}},
+	{"RETRY_JOIN_ATTEMPTS", "", "", func(conf *models.ConfigModel, value string) error {
+		return parseUint(value, &conf.Retry.JoinAttempts)
+	}},
+	{"RETRY_ICE_CANDIDATE_ATTEMPTS", "", "", func(conf *models.ConfigModel, value string) error {
+		return parseUint(value, &conf.Retry.ICECandidateAttempts)
+	}},
+	{"RETRY_ICE_CANDIDATE_DELAY", "", "", func(conf *models.ConfigModel, value string) error {
+		return parseDuration(value, &conf.Retry.ICECandidateDelay)
+	}},
+}
+
+type flagOverride struct {
+	option configOption
+	value  string
+}
+
+// registerConfigFlags defines the flags of configOptions, what's set on the command line ends up in overrides once flags are parsed
+func registerConfigFlags(overrides *[]flagOverride) {
+	for _, option := range configOptions {
+		if len(option.flag) == 0 {
+			continue
+		}
+		option := option
+		flag.Func(option.flag, option.usage+" (env "+envPrefix+option.env+")", func(value string) error {
+			*overrides = append(*overrides, flagOverride{option: option, value: value})
+			return nil
+		})
+	}
+}
+
+// loadConfig builds the config from defaults, the config file (yaml or json, optional), GOLDGORILLA_* environment variables
+// and the flags set on the command line, each overriding the previous ones, the result is validated.
+func loadConfig(path string, overrides []flagOverride) (*models.ConfigModel, error) {
+	conf := models.DefaultConfig()
+	defaultICEServersFile := conf.ICEServersFile
+	if len(path) > 0 {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("can't read config file: %w", err)
+		}
+		// json files go through the yaml decoder too, so both formats use the yaml keys (the json tags are the same)
+		decoder := yaml.NewDecoder(bytes.NewReader(data))
+		decoder.KnownFields(true)
+		if err := decoder.Decode(conf); err != nil && !errors.Is(err, io.EOF) {
+			return nil, fmt.Errorf("can't parse config file %s: %w", path, err)
+		}
+	}
+	for _, option := range configOptions {
+		value, exists := os.LookupEnv(envPrefix + option.env)
+		if !exists {
+			continue
+		}
+		if err := option.set(conf, value); err != nil {
+			return nil, fmt.Errorf("%s%s: %w", envPrefix, option.env, err)
+		}
+	}
+	for _, override := range overrides {
+		if err := override.option.set(conf, override.value); err != nil {
+			return nil, fmt.Errorf("-%s: %w", override.option.flag, err)
+		}
+	}
+	if len(conf.ICEServers) == 0 && len(conf.ICEServersFile) > 0 {
+		data, err := os.ReadFile(conf.ICEServersFile)
+		if err == nil {
+			if err = json.Unmarshal(data, &conf.ICEServers); err != nil {
+				return nil, fmt.Errorf("can't parse %s: %w", conf.ICEServersFile, err)
+			}
+		} else if !errors.Is(err, os.ErrNotExist) || conf.ICEServersFile != defaultICEServersFile {
+			// the default file is optional, one that was asked for isn't
+			return nil, fmt.Errorf("can't read ice servers file: %w", err)
+		}
+	}
+	addEmbeddedTURN(conf)
+	err := conf.Validate()
+	for _, codec := range conf.Codecs {
+		if !repositories.IsKnownCodec(codec) {
+			err = errors.Join(err, fmt.Errorf("codecs: unknown codec %q, use mime types like audio/opus or video/VP8", codec))
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid config:\n%w", err)
+	}
+	return conf, nil
+}
+
+func parseUint[T uint | uint16](value string, target *T) error {
+	parsed, err := strconv.ParseUint(strings.TrimSpace(value), 10, 64)
+	if err != nil {
+		return err
+	}
+	if uint64(T(parsed)) != parsed {
+		return fmt.Errorf("%d is out of range", parsed)
+	}
+	*target = T(parsed)
+	return nil
+}
+
+func parseBool(value string, target *bool) error {
+	parsed, err := strconv.ParseBool(strings.TrimSpace(value))
+	if err != nil {
+		return err
+	}
+	*target = parsed
+	return nil
+}
+
+func parseDuration(value string, target *time.Duration) error {
+	parsed, err := time.ParseDuration(strings.TrimSpace(value))
+	if err != nil {
+		return err
+	}
+	*target = parsed
+	return nil
+}
+
+func parseList(value string) []string {
+	var list []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); len(item) > 0 {
+			list = append(list, item)
+		}
+	}
+	return list
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeConfigFile(t *testing.T, name string, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// flagFor makes the override the flag of the env variable would have made
+func flagFor(t *testing.T, env string, value string) flagOverride {
+	t.Helper()
+	for _, option := range configOptions {
+		if option.env == env {
+			return flagOverride{option: option, value: value}
+		}
+	}
+	t.Fatalf("no option for %s", env)
+	return flagOverride{}
+}
+
+func TestLoadConfigDefaults(t *testing.T) {
+	conf, err := loadConfig("", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conf.ListenAddr != ":8080" || conf.Retry.JoinAttempts != 10 {
+		t.Fatalf("got %+v, want the defaults", conf)
+	}
+}
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	path := writeConfigFile(t, "config.yaml", `
+listenAddr: ":9000"
+logjamBaseUrl: "http://logjam:8090"
+retry:
+  joinAttempts: 3
+  joinDelay: 2s
+`)
+	t.Setenv(envPrefix+"LOGJAM_BASE_URL", "https://logjam.example.com")
+	t.Setenv(envPrefix+"RETRY_JOIN_ATTEMPTS", "5")
+	t.Setenv(envPrefix+"NAT_1TO1_IPS", " 203.0.113.1, ,203.0.113.2 ")
+	conf, err := loadConfig(path, []flagOverride{flagFor(t, "RETRY_JOIN_ATTEMPTS", "7")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conf.ListenAddr != ":9000" || conf.Retry.JoinDelay != 2*time.Second {
+		t.Fatalf("got %+v, want the file's listenAddr and joinDelay", conf)
+	}
+	if conf.LogjamBaseUrl != "https://logjam.example.com" {
+		t.Fatalf("logjamBaseUrl is %s, want the env's", conf.LogjamBaseUrl)
+	}
+	if conf.Retry.JoinAttempts != 7 {
+		t.Fatalf("joinAttempts is %d, want the flag's", conf.Retry.JoinAttempts)
+	}
+	if len(conf.NAT1To1IPs) != 2 || conf.NAT1To1IPs[0] != "203.0.113.1" || conf.NAT1To1IPs[1] != "203.0.113.2" {
+		t.Fatalf("nat1To1IPs is %v", conf.NAT1To1IPs)
+	}
+}
+
+func TestLoadConfigJSON(t *testing.T) {
+	path := writeConfigFile(t, "config.json", `{"listenAddr": ":9000", "timeouts": {"shutdown": "1m"}}`)
+	conf, err := loadConfig(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conf.ListenAddr != ":9000" || conf.Timeouts.Shutdown != time.Minute {
+		t.Fatalf("got %+v", conf)
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	cases := []struct {
+		name string
+		file string
+		env  map[string]string
+		want string
+	}{
+		{"unknown field", "listenAdress: \":9000\"\n", nil, "listenAdress"},
+		{"bad duration", "", map[string]string{"RETRY_JOIN_DELAY": "soon"}, envPrefix + "RETRY_JOIN_DELAY"},
+		{"port out of range", "", map[string]string{"UDP_PORT_MIN": "70000"}, "out of range"},
+		{"bad ice servers", "", map[string]string{"ICE_SERVERS": "stun:example.com"}, envPrefix + "ICE_SERVERS"},
+		{"invalid result", "", map[string]string{"SIGNALING_MODE": "carrier-pigeon"}, "signalingMode"},
+		{"unknown codec", "codecs: [\"video/VP7\"]\n", nil, "video/VP7"},
+		{"missing ice servers file", "iceServersFile: /nonexistent/ice.servers.json\n", nil, "ice servers file"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			for env, value := range c.env {
+				t.Setenv(envPrefix+env, value)
+			}
+			path := ""
+			if len(c.file) > 0 {
+				path = writeConfigFile(t, "config.yaml", c.file)
+			}
+			_, err := loadConfig(path, nil)
+			if err == nil || !strings.Contains(err.Error(), c.want) {
+				t.Fatalf("got %v, want an error about %s", err, c.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,86 @@
+package controllers
+
+import (
+	"codeberg.org/greatape/goldgorilla/models"
+	"codeberg.org/greatape/goldgorilla/models/dto"
+	"codeberg.org/greatape/goldgorilla/repositories"
+	"crypto/subtle"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"strings"
+)
+
+// AdminController exposes the live state of the rooms, read-only
+type AdminController struct {
+	helper     *ResponseHelper
+	repo       *repositories.RoomRepository
+	rejoinRepo *repositories.RejoinRepository
+	conf       *models.ConfigModel
+}
+
+func NewAdminController(respHelper *ResponseHelper, repo *repositories.RoomRepository, rejoinRepo *repositories.RejoinRepository, conf *models.ConfigModel) *AdminController {
+	return &AdminController{
+		helper:     respHelper,
+		repo:       repo,
+		rejoinRepo: rejoinRepo,
+		conf:       conf,
+	}
+}
+
+// Authenticate lets through requests bearing the admin token, without a configured token nobody gets in
+func (c *AdminController) Authenticate(ctx *gin.Context) {
+	token, found := strings.CutPrefix(ctx.GetHeader("Authorization"), "Bearer ")
+	if len(c.conf.AdminToken) == 0 || !found || subtle.ConstantTimeCompare([]byte(token), []byte(c.conf.AdminToken)) != 1 {
+		st := http.StatusUnauthorized
+		c.helper.ResponseError(ctx, models.MessageResponse{Message: "unauthorized"}, &st)
+		ctx.Abort()
+		return
+	}
+	ctx.Next()
+}
+
+func (c *AdminController) ListRooms(ctx *gin.Context) {
+	c.helper.Response(ctx, c.repo.ListRooms(), http.StatusOK)
+}
+
+// ListRejoins returns the rooms being joined or rejoined and how it went, rooms that aren't listed are idle
+func (c *AdminController) ListRejoins(ctx *gin.Context) {
+	c.helper.Response(ctx, c.rejoinRepo.List(), http.StatusOK)
+}
+
+func (c *AdminController) GetRejoin(ctx *gin.Context) {
+	c.helper.Response(ctx, c.rejoinRepo.State(ctx.Param("roomId")), http.StatusOK)
+}
+
+// ListICEServers returns the ice servers new peers get, credentials are redacted
+func (c *AdminController) ListICEServers(ctx *gin.Context) {
+	iceServers := c.repo.ICEServers()
+	servers := make([]dto.ICEServerDTO, len(iceServers))
+	for i, server := range iceServers {
+		servers[i] = dto.ICEServerDTO{
+			URLs:           server.URLs,
+			Username:       server.Username,
+			CredentialType: server.CredentialType.String(),
+		}
+		if server.Credential != nil && server.Credential != "" {
+			servers[i].Credential = "REDACTED"
+		}
+	}
+	c.helper.Response(ctx, servers, http.StatusOK)
+}
+
+func (c *AdminController) ListPeers(ctx *gin.Context) {
+	peers, err := c.repo.ListRoomPeers(ctx.Param("roomId"))
+	if c.helper.HandleIfErr(ctx, err, nil) {
+		return
+	}
+	c.helper.Response(ctx, peers, http.StatusOK)
+}
+
+func (c *AdminController) ListTracks(ctx *gin.Context) {
+	tracks, err := c.repo.ListRoomTracks(ctx.Param("roomId"))
+	if c.helper.HandleIfErr(ctx, err, nil) {
+		return
+	}
+	c.helper.Response(ctx, tracks, http.StatusOK)
+}
@@ -0,0 +1,125 @@
+package controllers
+
+import (
+	"codeberg.org/greatape/goldgorilla/models"
+	"codeberg.org/greatape/goldgorilla/signaling"
+	"github.com/gin-gonic/gin"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testSecret = "secret"
+
+func init() {
+	gin.SetMode(gin.TestMode)
+}
+
+func testConfig() *models.ConfigModel {
+	conf := models.DefaultConfig()
+	conf.SharedSecret = testSecret
+	return conf
+}
+
+// authEngine serves 200 on /room/offer and /whip/:roomId behind the controllers' authentication
+func authEngine(conf *models.ConfigModel) *gin.Engine {
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+	room := NewRoomController(NewResponseHelper(), nil, nil, conf, log)
+	whip := NewWHIPController(NewResponseHelper(), nil, conf)
+	ok := func(ctx *gin.Context) {
+		body, _ := io.ReadAll(ctx.Request.Body)
+		ctx.String(http.StatusOK, string(body))
+	}
+	engine := gin.New()
+	engine.POST("/room/offer", room.RequireClientCertificate, room.Authenticate, ok)
+	engine.POST("/whip/:roomId", whip.Authenticate, ok)
+	return engine
+}
+
+func serve(engine *gin.Engine, req *http.Request) *httptest.ResponseRecorder {
+	recorder := httptest.NewRecorder()
+	engine.ServeHTTP(recorder, req)
+	return recorder
+}
+
+func TestRoomAuthenticate(t *testing.T) {
+	engine := authEngine(testConfig())
+	req := httptest.NewRequest(http.MethodPost, "/room/offer", strings.NewReader("{}"))
+	signaling.SignRequest(req, []byte("{}"), testSecret)
+	replay := req.Clone(req.Context())
+	replay.Body = io.NopCloser(strings.NewReader("{}"))
+
+	recorder := serve(engine, req)
+	if recorder.Code != http.StatusOK || recorder.Body.String() != "{}" {
+		t.Fatalf("a signed request should get through with its body, got %d %q", recorder.Code, recorder.Body.String())
+	}
+	if recorder := serve(engine, replay); recorder.Code != http.StatusUnauthorized {
+		t.Fatalf("a replayed request got %d", recorder.Code)
+	}
+}
+
+func TestRoomAuthenticateRejects(t *testing.T) {
+	engine := authEngine(testConfig())
+	unsigned := httptest.NewRequest(http.MethodPost, "/room/offer", strings.NewReader("{}"))
+	tampered := httptest.NewRequest(http.MethodPost, "/room/offer", strings.NewReader(`{"id":2}`))
+	signaling.SignRequest(tampered, []byte("{}"), testSecret)
+	for name, req := range map[string]*http.Request{"unsigned": unsigned, "tampered": tampered} {
+		if recorder := serve(engine, req); recorder.Code != http.StatusUnauthorized {
+			t.Errorf("%s request got %d", name, recorder.Code)
+		}
+	}
+}
+
+func TestRoomRequiresClientCertificate(t *testing.T) {
+	conf := testConfig()
+	conf.TLS.ClientCAFile = "ca.pem"
+	req := httptest.NewRequest(http.MethodPost, "/room/offer", strings.NewReader("{}"))
+	signaling.SignRequest(req, []byte("{}"), testSecret)
+	if recorder := serve(authEngine(conf), req); recorder.Code != http.StatusUnauthorized {
+		t.Fatalf("a request without a client certificate got %d", recorder.Code)
+	}
+}
+
+func TestWithoutSecretEverythingGetsThrough(t *testing.T) {
+	conf := testConfig()
+	conf.SharedSecret = ""
+	engine := authEngine(conf)
+	for _, target := range []string{"/room/offer", "/whip/room"} {
+		if recorder := serve(engine, httptest.NewRequest(http.MethodPost, target, nil)); recorder.Code != http.StatusOK {
+			t.Errorf("%s got %d", target, recorder.Code)
+		}
+	}
+}
+
+func TestStreamAuthenticate(t *testing.T) {
+	engine := authEngine(testConfig())
+	tests := []struct {
+		name  string
+		token string
+		want  int
+	}{
+		{"valid", signaling.StreamToken(testSecret, "whip", "room", time.Now().Add(time.Minute)), http.StatusOK},
+		{"missing", "", http.StatusUnauthorized},
+		{"for whep", signaling.StreamToken(testSecret, "whep", "room", time.Now().Add(time.Minute)), http.StatusUnauthorized},
+		{"for another room", signaling.StreamToken(testSecret, "whip", "other", time.Now().Add(time.Minute)), http.StatusUnauthorized},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/whip/room", nil)
+			if len(test.token) > 0 {
+				req.Header.Set("Authorization", "Bearer "+test.token)
+			}
+			recorder := serve(engine, req)
+			if recorder.Code != test.want {
+				t.Fatalf("got %d, want %d", recorder.Code, test.want)
+			}
+			if test.want == http.StatusUnauthorized && recorder.Header().Get("WWW-Authenticate") != "Bearer" {
+				t.Fatal("a rejected request should be told to use a bearer token")
+			}
+		})
+	}
+}
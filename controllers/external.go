@@ -0,0 +1,105 @@
+package controllers
+
+import (
+	"codeberg.org/greatape/goldgorilla/models"
+	"codeberg.org/greatape/goldgorilla/repositories"
+	"codeberg.org/greatape/goldgorilla/signaling"
+	"github.com/gin-gonic/gin"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	contentTypeSDP         = "application/sdp"
+	contentTypeSDPFragment = "application/trickle-ice-sdpfrag"
+)
+
+// externalPeerController has what WHIP and WHEP resources share: trickle ice / ice restart over PATCH and teardown over DELETE
+type externalPeerController struct {
+	helper *ResponseHelper
+	repo   *repositories.RoomRepository
+	source repositories.PeerSource
+	conf   *models.ConfigModel
+}
+
+// Authenticate checks the bearer token logjam handed out for the room (see signaling.StreamToken), RFC 9725 puts it
+// on every request of the session. without a configured shared secret everything gets through.
+func (c *externalPeerController) Authenticate(ctx *gin.Context) {
+	if len(c.conf.SharedSecret) == 0 {
+		ctx.Next()
+		return
+	}
+	token, _ := strings.CutPrefix(ctx.GetHeader("Authorization"), "Bearer ")
+	if err := signaling.VerifyStreamToken(token, c.conf.SharedSecret, string(c.source), ctx.Param("roomId")); err != nil {
+		ctx.Header("WWW-Authenticate", "Bearer")
+		st := http.StatusUnauthorized
+		c.helper.ResponseError(ctx, err, &st)
+		ctx.Abort()
+		return
+	}
+	ctx.Next()
+}
+
+func (c *externalPeerController) Patch(ctx *gin.Context) {
+	id, ok := c.peerId(ctx)
+	if !ok {
+		return
+	}
+	body, ok := c.readBody(ctx, contentTypeSDPFragment)
+	if !ok {
+		return
+	}
+	frag := parseSDPFragment(body)
+	restartAnswer, err := c.repo.PatchExternalPeerICE(ctx.Param("roomId"), id, c.source, frag.iceUfrag, frag.icePwd, frag.candidates)
+	if c.helper.HandleIfErr(ctx, err, nil) {
+		return
+	}
+	if restartAnswer == nil {
+		ctx.Status(http.StatusNoContent)
+		return
+	}
+	ctx.Data(http.StatusOK, contentTypeSDPFragment, []byte(buildSDPFragment(restartAnswer.SDP)))
+}
+
+func (c *externalPeerController) Delete(ctx *gin.Context) {
+	id, ok := c.peerId(ctx)
+	if !ok {
+		return
+	}
+	err := c.repo.CloseExternalPeer(ctx.Param("roomId"), id, c.source)
+	if c.helper.HandleIfErr(ctx, err, nil) {
+		return
+	}
+	ctx.Status(http.StatusOK)
+}
+
+func (c *externalPeerController) created(ctx *gin.Context, id uint64, answerSDP string) {
+	ctx.Header("Location", strings.TrimSuffix(ctx.Request.URL.Path, "/")+"/"+strconv.FormatUint(id, 10))
+	ctx.Data(http.StatusCreated, contentTypeSDP, []byte(answerSDP))
+}
+
+func (c *externalPeerController) peerId(ctx *gin.Context) (uint64, bool) {
+	id, err := strconv.ParseUint(ctx.Param("peerId"), 10, 64)
+	if err != nil {
+		st := http.StatusNotFound
+		c.helper.ResponseError(ctx, models.MessageResponse{Message: "no such a peer"}, &st)
+		return 0, false
+	}
+	return id, true
+}
+
+func (c *externalPeerController) readBody(ctx *gin.Context, contentType string) (string, bool) {
+	if ctx.ContentType() != contentType {
+		st := http.StatusUnsupportedMediaType
+		c.helper.ResponseError(ctx, models.MessageResponse{Message: "unsupported media type, expected " + contentType}, &st)
+		return "", false
+	}
+	body, err := io.ReadAll(ctx.Request.Body)
+	if err != nil || len(body) == 0 {
+		c.helper.ResponseBadReq(ctx)
+		return "", false
+	}
+	return string(body), true
+}
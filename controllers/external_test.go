@@ -0,0 +1,203 @@
+package controllers
+
+import (
+	"codeberg.org/greatape/goldgorilla/repositories"
+	"codeberg.org/greatape/goldgorilla/signaling"
+	"github.com/gin-gonic/gin"
+	"github.com/pion/webrtc/v3"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testRoomId = "room"
+
+// externalEngine serves the WHIP and WHEP routes of a repository with one room in it
+func externalEngine(t *testing.T) *gin.Engine {
+	t.Helper()
+	conf := testConfig()
+	conf.ICETCPMUXListenPort = 0
+	conf.Timeouts.ICEGathering = 2 * time.Second
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+	signaler := signaling.NewMemorySignaler()
+	repo := repositories.NewRoomRepository(conf, signaler, repositories.NewRejoinRepository(conf, signaler, log), nil, log)
+	t.Cleanup(repo.CloseRooms)
+	if err := repo.CreatePeer(testRoomId, 1, true, true, 7); err != nil {
+		t.Fatal(err)
+	}
+
+	engine := gin.New()
+	whip := NewWHIPController(NewResponseHelper(), repo, conf)
+	whipGroup := engine.Group("/whip", whip.Authenticate)
+	whipGroup.POST("/:roomId", whip.Publish)
+	whipGroup.PATCH("/:roomId/:peerId", whip.Patch)
+	whipGroup.DELETE("/:roomId/:peerId", whip.Delete)
+	whep := NewWHEPController(NewResponseHelper(), repo, conf)
+	whepGroup := engine.Group("/whep", whep.Authenticate)
+	whepGroup.POST("/:roomId", whep.Watch)
+	whepGroup.PATCH("/:roomId/:peerId", whep.Patch)
+	whepGroup.DELETE("/:roomId/:peerId", whep.Delete)
+	return engine
+}
+
+func externalRequest(method string, kind string, target string, contentType string, body string) *http.Request {
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	req.Header.Set("Content-Type", contentType)
+	roomId := strings.Split(strings.TrimPrefix(target, "/"+kind+"/"), "/")[0]
+	req.Header.Set("Authorization", "Bearer "+signaling.StreamToken(testSecret, kind, roomId, time.Now().Add(time.Minute)))
+	return req
+}
+
+// clientOffer creates the offer of a WHIP encoder (sendonly) or WHEP player (recvonly) with an audio and a video m-line
+func clientOffer(t *testing.T, direction webrtc.RTPTransceiverDirection) (*webrtc.PeerConnection, string) {
+	t.Helper()
+	client, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = client.Close()
+	})
+	for _, kind := range []webrtc.RTPCodecType{webrtc.RTPCodecTypeAudio, webrtc.RTPCodecTypeVideo} {
+		if direction == webrtc.RTPTransceiverDirectionSendonly {
+			mimeType := webrtc.MimeTypeOpus
+			if kind == webrtc.RTPCodecTypeVideo {
+				mimeType = webrtc.MimeTypeVP8
+			}
+			track, err := webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{MimeType: mimeType}, kind.String(), "encoder")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := client.AddTransceiverFromTrack(track, webrtc.RTPTransceiverInit{Direction: direction}); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		if _, err := client.AddTransceiverFromKind(kind, webrtc.RTPTransceiverInit{Direction: direction}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	offer, err := client.CreateOffer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.SetLocalDescription(offer); err != nil {
+		t.Fatal(err)
+	}
+	return client, offer.SDP
+}
+
+// create POSTs the client's offer and applies the answer, it returns the resource's location
+func create(t *testing.T, engine *gin.Engine, kind string, direction webrtc.RTPTransceiverDirection) (*webrtc.PeerConnection, string) {
+	t.Helper()
+	client, offer := clientOffer(t, direction)
+	recorder := serve(engine, externalRequest(http.MethodPost, kind, "/"+kind+"/"+testRoomId, contentTypeSDP, offer))
+	if recorder.Code != http.StatusCreated {
+		t.Fatalf("got %d %s, want 201", recorder.Code, recorder.Body.String())
+	}
+	if contentType := recorder.Header().Get("Content-Type"); contentType != contentTypeSDP {
+		t.Fatalf("answered with %s", contentType)
+	}
+	location := recorder.Header().Get("Location")
+	if !strings.HasPrefix(location, "/"+kind+"/"+testRoomId+"/") {
+		t.Fatalf("location is %q", location)
+	}
+	answer := recorder.Body.String()
+	if !strings.Contains(answer, "a=candidate:") {
+		t.Fatal("the answer should have every candidate, nothing is trickled to the client")
+	}
+	if err := client.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer, SDP: answer}); err != nil {
+		t.Fatal(err)
+	}
+	return client, location
+}
+
+func TestWHIPPublish(t *testing.T) {
+	engine := externalEngine(t)
+	client, location := create(t, engine, "whip", webrtc.RTPTransceiverDirectionSendonly)
+	expectDirections(t, client.RemoteDescription().SDP, webrtc.RTPTransceiverDirectionRecvonly)
+
+	frag := "a=ice-ufrag:" + iceUfragOf(client.LocalDescription().SDP) + "\r\nm=audio 9 UDP/TLS/RTP/SAVPF 0\r\na=mid:0\r\na=candidate:1 1 udp 2130706431 192.0.2.1 5000 typ host\r\n"
+	if recorder := serve(engine, externalRequest(http.MethodPatch, "whip", location, contentTypeSDPFragment, frag)); recorder.Code != http.StatusNoContent {
+		t.Fatalf("trickling got %d %s, want 204", recorder.Code, recorder.Body.String())
+	}
+
+	if recorder := serve(engine, externalRequest(http.MethodDelete, "whip", location, "", "")); recorder.Code != http.StatusOK {
+		t.Fatalf("delete got %d, want 200", recorder.Code)
+	}
+}
+
+func TestWHEPWatch(t *testing.T) {
+	engine := externalEngine(t)
+	client, location := create(t, engine, "whep", webrtc.RTPTransceiverDirectionRecvonly)
+	expectDirections(t, client.RemoteDescription().SDP, webrtc.RTPTransceiverDirectionSendonly)
+
+	// a new ufrag and pwd restart ice, the new credentials and candidates come back as a fragment
+	frag := "a=ice-ufrag:restart1\r\na=ice-pwd:restartpasswordrestartpassword\r\n"
+	recorder := serve(engine, externalRequest(http.MethodPatch, "whep", location, contentTypeSDPFragment, frag))
+	if recorder.Code != http.StatusOK || recorder.Header().Get("Content-Type") != contentTypeSDPFragment {
+		t.Fatalf("ice restart got %d %s", recorder.Code, recorder.Header().Get("Content-Type"))
+	}
+	if answer := recorder.Body.String(); !strings.HasPrefix(answer, "a=ice-ufrag:") || !strings.Contains(answer, "a=candidate:") {
+		t.Fatalf("ice restart answered %q", answer)
+	}
+
+	// the viewer isn't a WHIP resource
+	whipLocation := strings.Replace(location, "/whep/", "/whip/", 1)
+	if recorder := serve(engine, externalRequest(http.MethodDelete, "whip", whipLocation, "", "")); recorder.Code != http.StatusNotFound {
+		t.Fatalf("deleting through whip got %d, want 404", recorder.Code)
+	}
+	if recorder := serve(engine, externalRequest(http.MethodDelete, "whep", location, "", "")); recorder.Code != http.StatusOK {
+		t.Fatalf("delete got %d, want 200", recorder.Code)
+	}
+}
+
+func TestExternalPeerRejects(t *testing.T) {
+	engine := externalEngine(t)
+	_, offer := clientOffer(t, webrtc.RTPTransceiverDirectionSendonly)
+	unauthenticated := httptest.NewRequest(http.MethodPost, "/whip/"+testRoomId, strings.NewReader(offer))
+	unauthenticated.Header.Set("Content-Type", contentTypeSDP)
+	tests := []struct {
+		name string
+		req  *http.Request
+		want int
+	}{
+		{"no token", unauthenticated, http.StatusUnauthorized},
+		{"not sdp", externalRequest(http.MethodPost, "whip", "/whip/"+testRoomId, "application/json", offer), http.StatusUnsupportedMediaType},
+		{"empty offer", externalRequest(http.MethodPost, "whip", "/whip/"+testRoomId, contentTypeSDP, ""), http.StatusBadRequest},
+		{"broken offer", externalRequest(http.MethodPost, "whip", "/whip/"+testRoomId, contentTypeSDP, "v=0\r\n"), http.StatusUnprocessableEntity},
+		{"unknown room", externalRequest(http.MethodPost, "whip", "/whip/other", contentTypeSDP, offer), http.StatusNotFound},
+		{"unknown room to watch", externalRequest(http.MethodPost, "whep", "/whep/other", contentTypeSDP, offer), http.StatusNotFound},
+		{"bad peer id", externalRequest(http.MethodDelete, "whip", "/whip/"+testRoomId+"/me", "", ""), http.StatusNotFound},
+		{"unknown peer", externalRequest(http.MethodPatch, "whip", "/whip/"+testRoomId+"/42", contentTypeSDPFragment, "a=end-of-candidates\r\n"), http.StatusNotFound},
+		{"logjam's peer", externalRequest(http.MethodDelete, "whip", "/whip/"+testRoomId+"/1", "", ""), http.StatusNotFound},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if recorder := serve(engine, test.req); recorder.Code != test.want {
+				t.Fatalf("got %d %s, want %d", recorder.Code, recorder.Body.String(), test.want)
+			}
+		})
+	}
+}
+
+// expectDirections checks every m-line of the answer goes the one way
+func expectDirections(t *testing.T, answer string, want webrtc.RTPTransceiverDirection) {
+	t.Helper()
+	if count := strings.Count(answer, "a="+want.String()+"\r\n"); count != 2 {
+		t.Fatalf("%d of the m-lines are %s, want both:\n%s", count, want, answer)
+	}
+}
+
+func iceUfragOf(sdp string) string {
+	for _, line := range strings.Split(sdp, "\n") {
+		if ufrag, found := strings.CutPrefix(strings.TrimSpace(line), "a=ice-ufrag:"); found {
+			return ufrag
+		}
+	}
+	return ""
+}
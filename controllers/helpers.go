@@ -2,7 +2,7 @@ package controllers
 
 import (
 	"github.com/gin-gonic/gin"
-	"codeberg.org/goldgorilla/logjam/models"
+	"codeberg.org/greatape/goldgorilla/models"
 )
 
 type ResponseHelper struct {
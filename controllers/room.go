@@ -2,30 +2,82 @@ package controllers
 
 import (
 	"bytes"
-	"encoding/json"
 	"github.com/gin-gonic/gin"
+	"github.com/pion/webrtc/v3"
 	"io"
+	"log/slog"
 	"net/http"
-	"codeberg.org/goldgorilla/logjam/models"
-	"codeberg.org/goldgorilla/logjam/models/dto"
-	"codeberg.org/goldgorilla/logjam/repositories"
+	"codeberg.org/greatape/goldgorilla/models"
+	"codeberg.org/greatape/goldgorilla/models/dto"
+	"codeberg.org/greatape/goldgorilla/repositories"
+	"codeberg.org/greatape/goldgorilla/signaling"
 	"time"
 )
 
 type RoomController struct {
-	helper *ResponseHelper
-	repo   *repositories.RoomRepository
-	conf   *models.ConfigModel
+	helper   *ResponseHelper
+	repo     *repositories.RoomRepository
+	signaler signaling.Signaler
+	conf     *models.ConfigModel
+	log      *slog.Logger
+	replays  *signaling.ReplayCache
 }
 
-func NewRoomController(respHelper *ResponseHelper, repo *repositories.RoomRepository, conf *models.ConfigModel) *RoomController {
+func NewRoomController(respHelper *ResponseHelper, repo *repositories.RoomRepository, signaler signaling.Signaler, conf *models.ConfigModel, log *slog.Logger) *RoomController {
 	return &RoomController{
-		helper: respHelper,
-		repo:   repo,
-		conf:   conf,
+		helper:   respHelper,
+		repo:     repo,
+		signaler: signaler,
+		conf:     conf,
+		log:      log,
+		replays:  signaling.NewReplayCache(),
 	}
 }
 
+// RequireClientCertificate lets only clients with a verified certificate through when mutual tls is on,
+// the listener asks for one but doesn't require it since it serves WHIP/WHEP, the health check and the metrics too.
+func (c *RoomController) RequireClientCertificate(ctx *gin.Context) {
+	if len(c.conf.TLS.ClientCAFile) == 0 {
+		ctx.Next()
+		return
+	}
+	if ctx.Request.TLS == nil || len(ctx.Request.TLS.VerifiedChains) == 0 {
+		c.log.Warn("rejected request without client certificate", "path", ctx.Request.URL.Path)
+		st := http.StatusUnauthorized
+		c.helper.ResponseError(ctx, models.NewError("a client certificate is required", 401, nil), &st)
+		ctx.Abort()
+		return
+	}
+	ctx.Next()
+}
+
+// Authenticate checks the signature logjam puts on its requests, without a configured shared secret everything gets through
+func (c *RoomController) Authenticate(ctx *gin.Context) {
+	if len(c.conf.SharedSecret) == 0 {
+		ctx.Next()
+		return
+	}
+	body, err := io.ReadAll(ctx.Request.Body)
+	if err != nil {
+		c.helper.ResponseBadReq(ctx)
+		ctx.Abort()
+		return
+	}
+	ctx.Request.Body = io.NopCloser(bytes.NewReader(body))
+	err = signaling.VerifyRequest(ctx.Request, body, c.conf.SharedSecret, c.conf.SignatureMaxSkew)
+	if err == nil {
+		err = c.replays.Check(ctx.Request, c.conf.SignatureMaxSkew)
+	}
+	if err != nil {
+		c.log.Warn("rejected request", "path", ctx.Request.URL.Path, "err", err)
+		st := http.StatusUnauthorized
+		c.helper.ResponseError(ctx, err, &st)
+		ctx.Abort()
+		return
+	}
+	ctx.Next()
+}
+
 func (c *RoomController) CreatePeer(ctx *gin.Context) {
 	var reqModel dto.CreatePeerReqModel
 	badReqSt := 400
@@ -53,23 +105,30 @@ func (c *RoomController) AddICECandidate(ctx *gin.Context) {
 		c.helper.ResponseUnprocessableEntity(ctx)
 		return
 	}
+	err := c.addICECandidate(reqModel)
+	if c.helper.HandleIfErr(ctx, err, nil) {
+		return
+	}
+	c.helper.Response(ctx, struct{}{}, http.StatusNoContent)
+}
+
+// addICECandidate retries for a while, candidates may arrive before the peer they belong to is created
+func (c *RoomController) addICECandidate(reqModel dto.AddPeerICECandidateReqModel) error {
 	tryCounter := 0
 start:
 	err := c.repo.AddPeerIceCandidate(reqModel.RoomId, reqModel.ID, reqModel.ICECandidate)
 	if err != nil {
-		if tryCounter < 4 {
-			time.Sleep(1 * time.Second)
+		if tryCounter < int(c.conf.Retry.ICECandidateAttempts) {
+			time.Sleep(c.conf.Retry.ICECandidateDelay)
 			tryCounter++
 			goto start
 		}
 	}
-
-	if c.helper.HandleIfErr(ctx, err, nil) {
-		return
-	}
-	c.helper.Response(ctx, struct{}{}, http.StatusNoContent)
+	return err
 }
 
+// Offer answers logjam's offer for a peer. goldgorilla never rolls its own offers back, while one of them waits for its
+// answer the peer's offer is refused with 409 and logjam has to roll its offer back, answer ours and offer again after.
 func (c *RoomController) Offer(ctx *gin.Context) {
 	var reqModel dto.SetSDPReqModel
 	badReqSt := 400
@@ -80,40 +139,33 @@ func (c *RoomController) Offer(ctx *gin.Context) {
 		c.helper.ResponseUnprocessableEntity(ctx)
 		return
 	}
-	println("offer from", reqModel.ID)
+	c.log.Debug("got offer", "roomId", reqModel.RoomId, "peerId", reqModel.ID)
 	answer, err := c.repo.SetPeerOffer(reqModel.RoomId, reqModel.ID, reqModel.SDP)
 	if c.helper.HandleIfErr(ctx, err, nil) {
-		println(err.Error())
+		c.log.Error("can't set offer", "roomId", reqModel.RoomId, "peerId", reqModel.ID, "err", err)
 		return
 	}
 	c.helper.Response(ctx, struct{}{}, http.StatusNoContent)
-	{
-		ggid := c.repo.GetRoomGGID(reqModel.RoomId)
-		if ggid == nil {
-			println("ggid is nil, not answering for offer")
-			return
-		}
-		buffer, err := json.Marshal(dto.SetSDPReqModel{
-			PeerDTO: dto.PeerDTO{
-				RoomId: reqModel.RoomId,
-				ID:     reqModel.ID,
-			},
-			GGID: *ggid,
-			SDP:  *answer,
-		})
-		if err != nil {
-			println(err.Error())
-			return
-		}
-		reader := bytes.NewReader(buffer)
-		resp, err := http.Post(c.conf.LogjamBaseUrl+"/answer", "application/json", reader)
-		if err != nil {
-			println(err.Error())
-			return
-		}
-		if resp.StatusCode > 204 {
-			println(resp.Status)
-		}
+	c.sendAnswer(reqModel.PeerDTO, answer)
+}
+
+func (c *RoomController) sendAnswer(peer dto.PeerDTO, answer *webrtc.SessionDescription) {
+	ggid := c.repo.GetRoomGGID(peer.RoomId)
+	if ggid == nil {
+		c.log.Warn("room is gone, not answering offer", "roomId", peer.RoomId, "peerId", peer.ID)
+		return
+	}
+	err := c.signaler.SendAnswer(dto.SetSDPReqModel{
+		PeerDTO: dto.PeerDTO{
+			RoomId: peer.RoomId,
+			ID:     peer.ID,
+		},
+		GGID: *ggid,
+		SDP:  *answer,
+	})
+	if err != nil {
+		c.log.Error("can't send answer", "roomId", peer.RoomId, "peerId", peer.ID, "ggId", *ggid, "err", err)
+		return
 	}
 }
 
@@ -127,10 +179,10 @@ func (c *RoomController) Answer(ctx *gin.Context) {
 		c.helper.ResponseUnprocessableEntity(ctx)
 		return
 	}
-	println("answer from", reqModel.ID)
+	c.log.Debug("got answer", "roomId", reqModel.RoomId, "peerId", reqModel.ID)
 	err := c.repo.SetPeerAnswer(reqModel.RoomId, reqModel.ID, reqModel.SDP)
 	if c.helper.HandleIfErr(ctx, err, nil) {
-		println(err.Error())
+		c.log.Error("can't set answer", "roomId", reqModel.RoomId, "peerId", reqModel.ID, "err", err)
 		return
 	}
 	c.helper.Response(ctx, struct{}{}, http.StatusNoContent)
@@ -153,6 +205,74 @@ func (c *RoomController) ClosePeer(ctx *gin.Context) {
 	c.helper.Response(ctx, struct{}{}, http.StatusNoContent)
 }
 
+func (c *RoomController) AllowPublish(ctx *gin.Context) {
+	var reqModel dto.PeerDTO
+	badReqSt := 400
+	if err := ctx.ShouldBindJSON(&reqModel); c.helper.HandleIfErr(ctx, err, &badReqSt) {
+		return
+	}
+	if !reqModel.Validate() {
+		c.helper.ResponseUnprocessableEntity(ctx)
+		return
+	}
+	err := c.repo.AllowPublish(reqModel.RoomId, reqModel.ID)
+	if c.helper.HandleIfErr(ctx, err, nil) {
+		return
+	}
+	c.helper.Response(ctx, nil, http.StatusNoContent)
+}
+
+func (c *RoomController) DisallowPublish(ctx *gin.Context) {
+	var reqModel dto.PeerDTO
+	badReqSt := 400
+	if err := ctx.ShouldBindJSON(&reqModel); c.helper.HandleIfErr(ctx, err, &badReqSt) {
+		return
+	}
+	if !reqModel.Validate() {
+		c.helper.ResponseUnprocessableEntity(ctx)
+		return
+	}
+	err := c.repo.DisallowPublish(reqModel.RoomId, reqModel.ID)
+	if c.helper.HandleIfErr(ctx, err, nil) {
+		return
+	}
+	c.helper.Response(ctx, nil, http.StatusNoContent)
+}
+
+func (c *RoomController) SetLayer(ctx *gin.Context) {
+	var reqModel dto.SetLayerReqModel
+	badReqSt := 400
+	if err := ctx.ShouldBindJSON(&reqModel); c.helper.HandleIfErr(ctx, err, &badReqSt) {
+		return
+	}
+	if !reqModel.Validate() {
+		c.helper.ResponseUnprocessableEntity(ctx)
+		return
+	}
+	err := c.repo.SetPeerLayer(reqModel.RoomId, reqModel.ID, reqModel.TrackId, reqModel.RID)
+	if c.helper.HandleIfErr(ctx, err, nil) {
+		return
+	}
+	c.helper.Response(ctx, nil, http.StatusNoContent)
+}
+
+func (c *RoomController) SetPins(ctx *gin.Context) {
+	var reqModel dto.SetPinsReqModel
+	badReqSt := 400
+	if err := ctx.ShouldBindJSON(&reqModel); c.helper.HandleIfErr(ctx, err, &badReqSt) {
+		return
+	}
+	if !reqModel.Validate() {
+		c.helper.ResponseUnprocessableEntity(ctx)
+		return
+	}
+	err := c.repo.SetPeerPins(reqModel.RoomId, reqModel.ID, reqModel.Pinned)
+	if c.helper.HandleIfErr(ctx, err, nil) {
+		return
+	}
+	c.helper.Response(ctx, nil, http.StatusNoContent)
+}
+
 func (c *RoomController) ResetRoom(ctx *gin.Context) {
 	var reqModel map[string]any
 	badReqSt := 400
@@ -191,35 +311,19 @@ func (c *RoomController) Start(ctx *gin.Context) {
 		c.helper.ResponseBadReq(ctx)
 		return
 	}
-	buffer, _ := json.Marshal(map[string]any{"roomId": reqModel.RoomId})
-	body := bytes.NewReader(buffer)
-	res, err := http.Post(c.conf.LogjamBaseUrl+"/join", "application/json", body)
-	if err != nil {
-		println(err.Error())
-		time.Sleep(4 * time.Second)
-	}
-	if res != nil {
-		if res.StatusCode > 204 {
-			resbody, _ := io.ReadAll(res.Body)
-			println("get /join "+res.Status, string(resbody))
-		} else {
-			resbody, _ := io.ReadAll(res.Body)
-			println(string(resbody))
-			respData := make(map[string]any)
-			if len(resbody) > 2 {
-				err := json.Unmarshal(resbody, &respData)
-				if err != nil {
-					println(err.Error())
-					c.helper.Response(ctx, nil, http.StatusBadRequest)
-					return
-				}
-			}
-		}
+	err := c.repo.StartRoom(reqModel.RoomId)
+	if c.helper.HandleIfErr(ctx, err, nil) {
+		return
 	}
 	c.helper.Response(ctx, nil, http.StatusNoContent)
 }
 
+// HealthCheck answers 503 while draining so no new rooms are sent here
 func (c *RoomController) HealthCheck(ctx *gin.Context) {
+	if c.repo.IsDraining() {
+		ctx.Status(http.StatusServiceUnavailable)
+		return
+	}
 	if len(ctx.Query("roomId")) > 0 {
 		if !c.repo.DoesRoomExists(ctx.Query("roomId")) {
 			ctx.Status(http.StatusNotFound)
@@ -0,0 +1,75 @@
+package controllers
+
+import (
+	"github.com/pion/webrtc/v3"
+	"strings"
+)
+
+// sdpFragment is what WHIP/WHEP clients PATCH for trickle ice and ice restarts (application/trickle-ice-sdpfrag, RFC 8840)
+type sdpFragment struct {
+	iceUfrag   string
+	icePwd     string
+	candidates []webrtc.ICECandidateInit
+}
+
+func parseSDPFragment(frag string) sdpFragment {
+	var parsed sdpFragment
+	var mid *string
+	var mLineIndex *uint16
+	for _, line := range strings.Split(frag, "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(line, "m="):
+			index := uint16(0)
+			if mLineIndex != nil {
+				index = *mLineIndex + 1
+			}
+			mLineIndex = &index
+			mid = nil
+		case strings.HasPrefix(line, "a=mid:"):
+			value := strings.TrimPrefix(line, "a=mid:")
+			mid = &value
+		case strings.HasPrefix(line, "a=ice-ufrag:"):
+			if len(parsed.iceUfrag) == 0 {
+				parsed.iceUfrag = strings.TrimPrefix(line, "a=ice-ufrag:")
+			}
+		case strings.HasPrefix(line, "a=ice-pwd:"):
+			if len(parsed.icePwd) == 0 {
+				parsed.icePwd = strings.TrimPrefix(line, "a=ice-pwd:")
+			}
+		case strings.HasPrefix(line, "a=candidate:"):
+			parsed.candidates = append(parsed.candidates, webrtc.ICECandidateInit{
+				Candidate:     strings.TrimPrefix(line, "a="),
+				SDPMid:        mid,
+				SDPMLineIndex: mLineIndex,
+			})
+		}
+	}
+	return parsed
+}
+
+// buildSDPFragment takes the ice credentials and candidates of an sdp, it's the answer to an ice restart PATCH
+func buildSDPFragment(sdp string) string {
+	var builder strings.Builder
+	var iceUfrag, icePwd string
+	var media strings.Builder
+	for _, line := range strings.Split(sdp, "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(line, "a=ice-ufrag:"):
+			if len(iceUfrag) == 0 {
+				iceUfrag = line
+			}
+		case strings.HasPrefix(line, "a=ice-pwd:"):
+			if len(icePwd) == 0 {
+				icePwd = line
+			}
+		case strings.HasPrefix(line, "m="), strings.HasPrefix(line, "a=mid:"), strings.HasPrefix(line, "a=candidate:"), strings.HasPrefix(line, "a=end-of-candidates"):
+			media.WriteString(line + "\r\n")
+		}
+	}
+	builder.WriteString(iceUfrag + "\r\n")
+	builder.WriteString(icePwd + "\r\n")
+	builder.WriteString(media.String())
+	return builder.String()
+}
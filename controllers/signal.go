@@ -0,0 +1,107 @@
+package controllers
+
+import (
+	"codeberg.org/greatape/goldgorilla/models"
+	"codeberg.org/greatape/goldgorilla/models/dto"
+	"codeberg.org/greatape/goldgorilla/signaling"
+	"encoding/json"
+)
+
+// HandleSignal is the persistent-link counterpart of the /room routes, it is used by signaling.WebSocketSignaler.
+func (c *RoomController) HandleSignal(msgType string, payload json.RawMessage) (any, error) {
+	switch msgType {
+	case signaling.MessageTypeCreatePeer:
+		var reqModel dto.CreatePeerReqModel
+		if err := decodeSignal(payload, &reqModel, reqModel.Validate); err != nil {
+			return nil, err
+		}
+		return nil, c.repo.CreatePeer(reqModel.RoomId, reqModel.ID, reqModel.CanPublish, reqModel.IsCaller, reqModel.GGID)
+	case signaling.MessageTypeClosePeer:
+		var reqModel dto.PeerDTO
+		if err := decodeSignal(payload, &reqModel, reqModel.Validate); err != nil {
+			return nil, err
+		}
+		return nil, c.repo.ClosePeer(reqModel.RoomId, reqModel.ID)
+	case signaling.MessageTypeAllowPublish:
+		var reqModel dto.PeerDTO
+		if err := decodeSignal(payload, &reqModel, reqModel.Validate); err != nil {
+			return nil, err
+		}
+		return nil, c.repo.AllowPublish(reqModel.RoomId, reqModel.ID)
+	case signaling.MessageTypeDisallowPublish:
+		var reqModel dto.PeerDTO
+		if err := decodeSignal(payload, &reqModel, reqModel.Validate); err != nil {
+			return nil, err
+		}
+		return nil, c.repo.DisallowPublish(reqModel.RoomId, reqModel.ID)
+	case signaling.MessageTypeSetLayer:
+		var reqModel dto.SetLayerReqModel
+		if err := decodeSignal(payload, &reqModel, reqModel.Validate); err != nil {
+			return nil, err
+		}
+		return nil, c.repo.SetPeerLayer(reqModel.RoomId, reqModel.ID, reqModel.TrackId, reqModel.RID)
+	case signaling.MessageTypeSetPins:
+		var reqModel dto.SetPinsReqModel
+		if err := decodeSignal(payload, &reqModel, reqModel.Validate); err != nil {
+			return nil, err
+		}
+		return nil, c.repo.SetPeerPins(reqModel.RoomId, reqModel.ID, reqModel.Pinned)
+	case signaling.MessageTypeICE:
+		var reqModel dto.AddPeerICECandidateReqModel
+		if err := decodeSignal(payload, &reqModel, reqModel.Validate); err != nil {
+			return nil, err
+		}
+		return nil, c.addICECandidate(reqModel)
+	case signaling.MessageTypeOffer:
+		var reqModel dto.SetSDPReqModel
+		if err := decodeSignal(payload, &reqModel, reqModel.Validate); err != nil {
+			return nil, err
+		}
+		c.log.Debug("got offer", "roomId", reqModel.RoomId, "peerId", reqModel.ID)
+		// refused with 409 while our own offer waits for its answer, see RoomController.Offer
+		answer, err := c.repo.SetPeerOffer(reqModel.RoomId, reqModel.ID, reqModel.SDP)
+		if err != nil {
+			return nil, err
+		}
+		c.sendAnswer(reqModel.PeerDTO, answer)
+		return nil, nil
+	case signaling.MessageTypeAnswer:
+		var reqModel dto.SetSDPReqModel
+		if err := decodeSignal(payload, &reqModel, reqModel.Validate); err != nil {
+			return nil, err
+		}
+		c.log.Debug("got answer", "roomId", reqModel.RoomId, "peerId", reqModel.ID)
+		return nil, c.repo.SetPeerAnswer(reqModel.RoomId, reqModel.ID, reqModel.SDP)
+	case signaling.MessageTypeStartRoom:
+		var reqModel dto.RoomDTO
+		if err := decodeSignal(payload, &reqModel, reqModel.Validate); err != nil {
+			return nil, err
+		}
+		return nil, c.repo.StartRoom(reqModel.RoomId)
+	case signaling.MessageTypeResetRoom:
+		var reqModel dto.RoomDTO
+		if err := decodeSignal(payload, &reqModel, reqModel.Validate); err != nil {
+			return nil, err
+		}
+		ggid, err := c.repo.ResetRoom(reqModel.RoomId)
+		if err != nil {
+			return nil, err
+		}
+		return struct {
+			GGID uint64 `json:"ggid"`
+		}{
+			GGID: ggid,
+		}, nil
+	}
+	return nil, models.NewError("unknown message type "+msgType, 400, nil)
+}
+
+func decodeSignal(payload json.RawMessage, reqModel any, validate func() bool) error {
+	if err := json.Unmarshal(payload, reqModel); err != nil {
+		return models.NewError("bad request, invalid input", 400, models.MessageResponse{Message: err.Error()})
+	}
+	if !validate() {
+		return models.NewError("unprocessable entity, invalid input", 422, nil)
+	}
+	return nil
+}
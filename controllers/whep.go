@@ -0,0 +1,39 @@
+package controllers
+
+import (
+	"codeberg.org/greatape/goldgorilla/models"
+	"codeberg.org/greatape/goldgorilla/repositories"
+	"github.com/gin-gonic/gin"
+	"github.com/pion/webrtc/v3"
+)
+
+// WHEPController lets lightweight players watch a room without going through logjam
+type WHEPController struct {
+	externalPeerController
+}
+
+func NewWHEPController(respHelper *ResponseHelper, repo *repositories.RoomRepository, conf *models.ConfigModel) *WHEPController {
+	return &WHEPController{
+		externalPeerController: externalPeerController{
+			helper: respHelper,
+			repo:   repo,
+			source: repositories.PeerSourceWHEP,
+			conf:   conf,
+		},
+	}
+}
+
+func (c *WHEPController) Watch(ctx *gin.Context) {
+	offer, ok := c.readBody(ctx, contentTypeSDP)
+	if !ok {
+		return
+	}
+	id, answer, err := c.repo.CreateWHEPPeer(ctx.Param("roomId"), webrtc.SessionDescription{
+		Type: webrtc.SDPTypeOffer,
+		SDP:  offer,
+	})
+	if c.helper.HandleIfErr(ctx, err, nil) {
+		return
+	}
+	c.created(ctx, id, answer.SDP)
+}
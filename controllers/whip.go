@@ -0,0 +1,39 @@
+package controllers
+
+import (
+	"codeberg.org/greatape/goldgorilla/models"
+	"codeberg.org/greatape/goldgorilla/repositories"
+	"github.com/gin-gonic/gin"
+	"github.com/pion/webrtc/v3"
+)
+
+// WHIPController lets encoders (OBS, GStreamer, ffmpeg, ...) publish into a room without logjam, see RFC 9725
+type WHIPController struct {
+	externalPeerController
+}
+
+func NewWHIPController(respHelper *ResponseHelper, repo *repositories.RoomRepository, conf *models.ConfigModel) *WHIPController {
+	return &WHIPController{
+		externalPeerController: externalPeerController{
+			helper: respHelper,
+			repo:   repo,
+			source: repositories.PeerSourceWHIP,
+			conf:   conf,
+		},
+	}
+}
+
+func (c *WHIPController) Publish(ctx *gin.Context) {
+	offer, ok := c.readBody(ctx, contentTypeSDP)
+	if !ok {
+		return
+	}
+	id, answer, err := c.repo.CreateWHIPPeer(ctx.Param("roomId"), webrtc.SessionDescription{
+		Type: webrtc.SDPTypeOffer,
+		SDP:  offer,
+	})
+	if c.helper.HandleIfErr(ctx, err, nil) {
+		return
+	}
+	c.created(ctx, id, answer.SDP)
+}
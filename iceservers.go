@@ -0,0 +1,57 @@
+package main
+
+import (
+	"codeberg.org/greatape/goldgorilla/models"
+	"maps"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// watchICEServers reloads the ice servers on SIGHUP and whenever the config file or the ice servers file changes,
+// the new list is swapped in at once and only peer connections created afterwards get it.
+func (a *App) watchICEServers(configPath string, reloadConfig func() (*models.ConfigModel, error)) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	var ticks <-chan time.Time
+	if a.conf.ICEServersReloadInterval > 0 {
+		ticks = time.NewTicker(a.conf.ICEServersReloadInterval).C
+	}
+	files := []string{configPath, a.conf.ICEServersFile}
+	modTimes := readModTimes(files)
+	for {
+		select {
+		case <-hup:
+			a.log.Info("got SIGHUP, reloading ice servers")
+		case <-ticks:
+			current := readModTimes(files)
+			if maps.Equal(current, modTimes) {
+				continue
+			}
+			modTimes = current
+			a.log.Info("ice servers source changed, reloading ice servers")
+		}
+		conf, err := reloadConfig()
+		if err != nil {
+			a.log.Error("can't reload ice servers, keeping the current ones", "err", err)
+			continue
+		}
+		a.roomRepo.SetICEServers(conf.ICEServers)
+		a.log.Info("ice servers reloaded", "count", len(conf.ICEServers))
+	}
+}
+
+// readModTimes returns when each of the files was last modified, files that don't exist are left out
+func readModTimes(files []string) map[string]time.Time {
+	modTimes := make(map[string]time.Time, len(files))
+	for _, file := range files {
+		if len(file) == 0 {
+			continue
+		}
+		if info, err := os.Stat(file); err == nil {
+			modTimes[file] = info.ModTime()
+		}
+	}
+	return modTimes
+}
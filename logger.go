@@ -0,0 +1,26 @@
+package main
+
+import (
+	"codeberg.org/greatape/goldgorilla/models"
+	"errors"
+	"log/slog"
+	"os"
+)
+
+// newLogger builds the logger every part of goldgorilla logs through, level is one of debug, info, warn or error
+func newLogger(level string, format string) (*slog.Logger, error) {
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		return nil, err
+	}
+	opts := &slog.HandlerOptions{
+		Level: lvl,
+	}
+	switch format {
+	case models.LogFormatText:
+		return slog.New(slog.NewTextHandler(os.Stderr, opts)), nil
+	case models.LogFormatJSON:
+		return slog.New(slog.NewJSONHandler(os.Stderr, opts)), nil
+	}
+	return nil, errors.New("log format should be either " + models.LogFormatText + " or " + models.LogFormatJSON)
+}
@@ -1,22 +1,30 @@
 package main
 
 import (
+	"codeberg.org/greatape/goldgorilla/models"
 	"flag"
-	"strings"
+	"os"
 )
 
 func main() {
-	src := flag.String("src", ":8080", "listenHost:listenPort")
-	logjamBaseUrl := flag.String("logjam-base-url", "http://localhost:8090", "logjam base url( shouldn't end with / )")
-	icetcpmuxListenPort := flag.Uint("ice-tcp-mux-listen-port", 4444, "listen port to use for tcp ice candidates")
-	customICEHostCandidateIP := flag.String("custom-ice-host-candidate-ip", "", "set to override host ice candidates address")
+	configPath := flag.String("config", os.Getenv(envPrefix+"CONFIG"), "config file, yaml or json (env "+envPrefix+"CONFIG)")
+	var overrides []flagOverride
+	registerConfigFlags(&overrides)
 	flag.Parse()
 
-	if strings.HasSuffix(*logjamBaseUrl, "/") {
-		panic("logjam-base-url shouldn't end with /")
+	conf, err := loadConfig(*configPath, overrides)
+	if err != nil {
+		panic(err)
+	}
+	logger, err := newLogger(conf.LogLevel, conf.LogFormat)
+	if err != nil {
+		panic(err)
 	}
 	app := App{}
-	*logjamBaseUrl += "/goldgorilla"
-	app.Init(*src, *logjamBaseUrl, *icetcpmuxListenPort, *customICEHostCandidateIP)
+	conf.LogjamBaseUrl += "/goldgorilla"
+	app.Init(conf, logger)
+	go app.watchICEServers(*configPath, func() (*models.ConfigModel, error) {
+		return loadConfig(*configPath, overrides)
+	})
 	app.Run()
 }
@@ -1,15 +1,331 @@
 package models
 
-import "github.com/pion/webrtc/v3"
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/pion/webrtc/v3"
+	"gopkg.in/yaml.v3"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+)
 
 type RejoinMode struct {
 	SimplyJoin bool
 	RoomId     string
 }
+
+const (
+	SignalingModeHTTP      = "http"
+	SignalingModeWebSocket = "websocket"
+
+	LogFormatText = "text"
+	LogFormatJSON = "json"
+)
+
+// ConfigModel is goldgorilla's configuration, it's built from defaults, the config file, GOLDGORILLA_* environment variables
+// and command line flags, each overriding the previous ones.
 type ConfigModel struct {
-	LogjamBaseUrl            string             `json:"logjamBaseUrl"`
-	ICETCPMUXListenPort      uint               `json:"ice_tcpmux_listenPort"`
-	CustomICEHostCandidateIP string             `json:"customICEHostCandidateIP"`
-	ICEServers               []webrtc.ICEServer `json:"iceServers"`
-	StartRejoinCH            *chan RejoinMode
+	ListenAddr    string `yaml:"listenAddr" json:"listenAddr"`
+	LogjamBaseUrl string `yaml:"logjamBaseUrl" json:"logjamBaseUrl"`
+	SignalingMode string `yaml:"signalingMode" json:"signalingMode"`
+	// TLS serves the api over https when a certificate is set
+	TLS TLSModel `yaml:"tls" json:"tls"`
+	// LogjamTLS is the client certificate presented to logjam and the CAs trusted for it over https/wss
+	LogjamTLS LogjamTLSModel `yaml:"logjamTls" json:"logjamTls"`
+	// StateFile keeps the rooms across restarts, they are rejoined on startup, empty turns it off
+	StateFile string `yaml:"stateFile" json:"stateFile"`
+	// CertReloadInterval is how often the certificate files are checked for changes, 0 never reloads them
+	CertReloadInterval  time.Duration `yaml:"certReloadInterval" json:"certReloadInterval"`
+	ICETCPMUXListenPort uint          `yaml:"iceTCPMUXListenPort" json:"iceTCPMUXListenPort"`
+	NAT1To1IPs          []string      `yaml:"nat1To1IPs" json:"nat1To1IPs"`
+	UDPPortMin          uint16        `yaml:"udpPortMin" json:"udpPortMin"`
+	UDPPortMax          uint16        `yaml:"udpPortMax" json:"udpPortMax"`
+	ICEServers          ICEServerList `yaml:"iceServers" json:"iceServers"`
+	// ICEServersFile is read when no iceServers are configured, it's a json array of ice servers
+	ICEServersFile string `yaml:"iceServersFile" json:"iceServersFile"`
+	// ICEServersReloadInterval is how often the config file and the ice servers file are checked for changes, 0 only reloads on SIGHUP
+	ICEServersReloadInterval time.Duration `yaml:"iceServersReloadInterval" json:"iceServersReloadInterval"`
+	// TURNREST hands every peer its own short-lived turn credentials, it's on when a secret is set
+	TURNREST     TURNRESTModel     `yaml:"turnRest" json:"turnRest"`
+	EmbeddedTURN EmbeddedTURNModel `yaml:"embeddedTurn" json:"embeddedTurn"`
+	// Codecs are the mime types goldgorilla negotiates, e.g. audio/opus or video/VP8, empty means pion's defaults
+	Codecs          []string `yaml:"codecs" json:"codecs"`
+	MinVideoBitrate uint     `yaml:"minVideoBitrate" json:"minVideoBitrate"`
+	// LastN limits the video a subscriber gets to the N most recent dominant speakers of the room plus the peers it pinned, 0 forwards all video
+	LastN uint `yaml:"lastN" json:"lastN"`
+	// TopKAudio limits the audio a subscriber gets to the K loudest speakers of the room (not counting itself),
+	// audio of publishers that don't send audio levels is always forwarded, 0 forwards all audio
+	TopKAudio  uint   `yaml:"topKAudio" json:"topKAudio"`
+	AdminToken string `yaml:"adminToken" json:"-"`
+	// SharedSecret signs the requests between logjam and goldgorilla in both directions, empty turns signing off
+	SharedSecret string `yaml:"sharedSecret" json:"-"`
+	// SignatureMaxSkew is how far a signed request's timestamp may be from now, a signature can't be used twice within it
+	SignatureMaxSkew time.Duration `yaml:"signatureMaxSkew" json:"signatureMaxSkew"`
+	LogLevel         string        `yaml:"logLevel" json:"logLevel"`
+	LogFormat        string        `yaml:"logFormat" json:"logFormat"`
+	Timeouts         TimeoutsModel `yaml:"timeouts" json:"timeouts"`
+	Retry            RetryModel    `yaml:"retry" json:"retry"`
+}
+
+// ICEServerList reads ice servers from yaml with the keys pion uses in json (urls, username, credential, credentialType),
+// webrtc.ICEServer has no yaml tags.
+type ICEServerList []webrtc.ICEServer
+
+func (l *ICEServerList) UnmarshalYAML(value *yaml.Node) error {
+	var raw any
+	if err := value.Decode(&raw); err != nil {
+		return err
+	}
+	data, err := json.Marshal(raw)
+	if err != nil {
+		return err
+	}
+	var servers []webrtc.ICEServer
+	if err := json.Unmarshal(data, &servers); err != nil {
+		return fmt.Errorf("line %d: iceServers: %w", value.Line, err)
+	}
+	*l = servers
+	return nil
+}
+
+type TLSModel struct {
+	CertFile string `yaml:"certFile" json:"certFile"`
+	KeyFile  string `yaml:"keyFile" json:"keyFile"`
+	// ClientCAFile turns on mutual tls for /room, only clients with a certificate signed by one of its CAs get in
+	ClientCAFile string `yaml:"clientCAFile" json:"clientCAFile"`
+}
+
+type LogjamTLSModel struct {
+	CertFile string `yaml:"certFile" json:"certFile"`
+	KeyFile  string `yaml:"keyFile" json:"keyFile"`
+	// CAFile is trusted instead of the system roots when it's set
+	CAFile string `yaml:"caFile" json:"caFile"`
+}
+
+// TURNRESTModel configures credentials following the TURN REST api scheme (what coturn's use-auth-secret expects):
+// username is expiry:peerId and credential is base64(hmac-sha1(secret, username))
+type TURNRESTModel struct {
+	Secret string        `yaml:"secret" json:"-"`
+	TTL    time.Duration `yaml:"ttl" json:"ttl"`
+	URIs   []string      `yaml:"uris" json:"uris"`
+}
+
+// EmbeddedTURNModel runs a turn/stun server inside goldgorilla, its urls are added to the ice servers of every peer.
+// it accepts the TURN REST credentials when turnRest has a secret, Username/Password otherwise.
+type EmbeddedTURNModel struct {
+	Enabled bool   `yaml:"enabled" json:"enabled"`
+	Realm   string `yaml:"realm" json:"realm"`
+	// PublicIP is the address clients reach the server and its relays at
+	PublicIP      string `yaml:"publicIP" json:"publicIP"`
+	UDPListenAddr string `yaml:"udpListenAddr" json:"udpListenAddr"`
+	// TCPListenAddr can be left empty to only serve udp
+	TCPListenAddr string `yaml:"tcpListenAddr" json:"tcpListenAddr"`
+	RelayBindAddr string `yaml:"relayBindAddr" json:"relayBindAddr"`
+	RelayPortMin  uint16 `yaml:"relayPortMin" json:"relayPortMin"`
+	RelayPortMax  uint16 `yaml:"relayPortMax" json:"relayPortMax"`
+	Username      string `yaml:"username" json:"username"`
+	Password      string `yaml:"password" json:"-"`
+}
+
+type TimeoutsModel struct {
+	// Signaling is how long a request to logjam may take
+	Signaling       time.Duration `yaml:"signaling" json:"signaling"`
+	ICEGathering    time.Duration `yaml:"iceGathering" json:"iceGathering"`
+	ICEDisconnected time.Duration `yaml:"iceDisconnected" json:"iceDisconnected"`
+	ICEFailed       time.Duration `yaml:"iceFailed" json:"iceFailed"`
+	ICEKeepalive    time.Duration `yaml:"iceKeepalive" json:"iceKeepalive"`
+	// ICERestartGrace is how long a disconnected peer gets to reconnect (through an ice restart for logjam peers)
+	// before it's closed and its tracks are released, 0 closes it right away
+	ICERestartGrace time.Duration `yaml:"iceRestartGrace" json:"iceRestartGrace"`
+	// Negotiation is how long an offer may wait for its answer before it's sent again, after 3 tries the peer connection is closed
+	Negotiation time.Duration `yaml:"negotiation" json:"negotiation"`
+	// Shutdown is how long draining may take before goldgorilla exits anyway
+	Shutdown time.Duration `yaml:"shutdown" json:"shutdown"`
+}
+
+type RetryModel struct {
+	// JoinDelay is how long to wait before trying to join a room again, it doubles with every failed attempt up to JoinMaxDelay
+	JoinDelay    time.Duration `yaml:"joinDelay" json:"joinDelay"`
+	JoinMaxDelay time.Duration `yaml:"joinMaxDelay" json:"joinMaxDelay"`
+	// JoinAttempts is how many times joining a room is tried before giving up
+	JoinAttempts uint `yaml:"joinAttempts" json:"joinAttempts"`
+	// ICECandidateAttempts is how many times a candidate for a peer that doesn't exist (yet) is retried
+	ICECandidateAttempts uint          `yaml:"iceCandidateAttempts" json:"iceCandidateAttempts"`
+	ICECandidateDelay    time.Duration `yaml:"iceCandidateDelay" json:"iceCandidateDelay"`
+}
+
+func DefaultConfig() *ConfigModel {
+	return &ConfigModel{
+		ListenAddr:               ":8080",
+		LogjamBaseUrl:            "http://localhost:8090",
+		SignalingMode:            SignalingModeHTTP,
+		ICETCPMUXListenPort:      4444,
+		ICEServersFile:           "./ice.servers.json",
+		ICEServersReloadInterval: 10 * time.Second,
+		CertReloadInterval:       time.Minute,
+		TURNREST: TURNRESTModel{
+			TTL: 24 * time.Hour,
+		},
+		EmbeddedTURN: EmbeddedTURNModel{
+			Realm:         "goldgorilla",
+			UDPListenAddr: "0.0.0.0:3478",
+			TCPListenAddr: "0.0.0.0:3478",
+			RelayBindAddr: "0.0.0.0",
+			RelayPortMin:  49152,
+			RelayPortMax:  65535,
+		},
+		MinVideoBitrate:  150_000,
+		SignatureMaxSkew: 30 * time.Second,
+		LogLevel:         "info",
+		LogFormat:        LogFormatText,
+		Timeouts: TimeoutsModel{
+			Signaling:       8 * time.Second,
+			ICEGathering:    10 * time.Second,
+			ICEDisconnected: 5 * time.Second,
+			ICEFailed:       25 * time.Second,
+			ICEKeepalive:    2 * time.Second,
+			ICERestartGrace: 15 * time.Second,
+			Negotiation:     10 * time.Second,
+			Shutdown:        30 * time.Second,
+		},
+		Retry: RetryModel{
+			JoinDelay:            4 * time.Second,
+			JoinMaxDelay:         2 * time.Minute,
+			JoinAttempts:         10,
+			ICECandidateAttempts: 4,
+			ICECandidateDelay:    1 * time.Second,
+		},
+	}
+}
+
+// Validate returns every problem of the config at once
+func (c *ConfigModel) Validate() error {
+	var errs []error
+	invalid := func(field string, format string, args ...any) {
+		errs = append(errs, fmt.Errorf("%s: "+format, append([]any{field}, args...)...))
+	}
+
+	if _, _, err := net.SplitHostPort(c.ListenAddr); err != nil {
+		invalid("listenAddr", "should be host:port, %s", err.Error())
+	}
+	if u, err := url.Parse(c.LogjamBaseUrl); err != nil || (u.Scheme != "http" && u.Scheme != "https") || len(u.Host) == 0 {
+		invalid("logjamBaseUrl", "should be an http(s) url, got %q", c.LogjamBaseUrl)
+	} else if strings.HasSuffix(c.LogjamBaseUrl, "/") {
+		invalid("logjamBaseUrl", "shouldn't end with /")
+	}
+	if c.SignalingMode != SignalingModeHTTP && c.SignalingMode != SignalingModeWebSocket {
+		invalid("signalingMode", "should be either %s or %s, got %q", SignalingModeHTTP, SignalingModeWebSocket, c.SignalingMode)
+	}
+	if (len(c.TLS.CertFile) == 0) != (len(c.TLS.KeyFile) == 0) {
+		invalid("tls.certFile/tls.keyFile", "both or neither should be set")
+	}
+	if len(c.TLS.ClientCAFile) > 0 && len(c.TLS.CertFile) == 0 {
+		invalid("tls.clientCAFile", "needs tls.certFile and tls.keyFile")
+	}
+	if (len(c.LogjamTLS.CertFile) == 0) != (len(c.LogjamTLS.KeyFile) == 0) {
+		invalid("logjamTls.certFile/logjamTls.keyFile", "both or neither should be set")
+	}
+	if c.Timeouts.ICERestartGrace < 0 {
+		invalid("timeouts.iceRestartGrace", "shouldn't be negative, got %s", c.Timeouts.ICERestartGrace)
+	}
+	if c.CertReloadInterval < 0 {
+		invalid("certReloadInterval", "shouldn't be negative, got %s", c.CertReloadInterval)
+	}
+	if c.ICETCPMUXListenPort > 65535 {
+		invalid("iceTCPMUXListenPort", "%d isn't a port", c.ICETCPMUXListenPort)
+	}
+	for _, ip := range c.NAT1To1IPs {
+		if net.ParseIP(ip) == nil {
+			invalid("nat1To1IPs", "%q isn't an ip", ip)
+		}
+	}
+	if (c.UDPPortMin == 0) != (c.UDPPortMax == 0) {
+		invalid("udpPortMin/udpPortMax", "both or neither should be set")
+	} else if c.UDPPortMin > c.UDPPortMax {
+		invalid("udpPortMin/udpPortMax", "%d-%d isn't a range", c.UDPPortMin, c.UDPPortMax)
+	}
+	for i, server := range c.ICEServers {
+		if len(server.URLs) == 0 {
+			invalid(fmt.Sprintf("iceServers[%d]", i), "has no urls")
+		}
+		for _, u := range server.URLs {
+			if !strings.HasPrefix(u, "stun:") && !strings.HasPrefix(u, "stuns:") && !strings.HasPrefix(u, "turn:") && !strings.HasPrefix(u, "turns:") {
+				invalid(fmt.Sprintf("iceServers[%d]", i), "%q isn't a stun/turn url", u)
+			}
+		}
+	}
+	if len(c.TURNREST.Secret) > 0 {
+		if len(c.TURNREST.URIs) == 0 {
+			invalid("turnRest.uris", "at least one turn uri is needed when a secret is set")
+		}
+		for _, u := range c.TURNREST.URIs {
+			if !strings.HasPrefix(u, "turn:") && !strings.HasPrefix(u, "turns:") {
+				invalid("turnRest.uris", "%q isn't a turn url", u)
+			}
+		}
+		if c.TURNREST.TTL <= 0 {
+			invalid("turnRest.ttl", "should be positive, got %s", c.TURNREST.TTL)
+		}
+	}
+	if c.EmbeddedTURN.Enabled {
+		if net.ParseIP(c.EmbeddedTURN.PublicIP) == nil {
+			invalid("embeddedTurn.publicIP", "%q isn't an ip", c.EmbeddedTURN.PublicIP)
+		}
+		if _, _, err := net.SplitHostPort(c.EmbeddedTURN.UDPListenAddr); err != nil {
+			invalid("embeddedTurn.udpListenAddr", "should be host:port, %s", err.Error())
+		}
+		if _, _, err := net.SplitHostPort(c.EmbeddedTURN.TCPListenAddr); err != nil && len(c.EmbeddedTURN.TCPListenAddr) > 0 {
+			invalid("embeddedTurn.tcpListenAddr", "should be host:port, %s", err.Error())
+		}
+		if net.ParseIP(c.EmbeddedTURN.RelayBindAddr) == nil {
+			invalid("embeddedTurn.relayBindAddr", "%q isn't an ip", c.EmbeddedTURN.RelayBindAddr)
+		}
+		if c.EmbeddedTURN.RelayPortMin == 0 || c.EmbeddedTURN.RelayPortMin > c.EmbeddedTURN.RelayPortMax {
+			invalid("embeddedTurn.relayPortMin/relayPortMax", "%d-%d isn't a range", c.EmbeddedTURN.RelayPortMin, c.EmbeddedTURN.RelayPortMax)
+		}
+		if len(c.TURNREST.Secret) == 0 && (len(c.EmbeddedTURN.Username) == 0 || len(c.EmbeddedTURN.Password) == 0) {
+			invalid("embeddedTurn", "needs either turnRest.secret or a username and password")
+		}
+	}
+	if c.ICEServersReloadInterval < 0 {
+		invalid("iceServersReloadInterval", "shouldn't be negative, got %s", c.ICEServersReloadInterval)
+	}
+	switch strings.ToLower(c.LogLevel) {
+	case "debug", "info", "warn", "error":
+	default:
+		invalid("logLevel", "should be debug, info, warn or error, got %q", c.LogLevel)
+	}
+	if c.LogFormat != LogFormatText && c.LogFormat != LogFormatJSON {
+		invalid("logFormat", "should be either %s or %s, got %q", LogFormatText, LogFormatJSON, c.LogFormat)
+	}
+	for _, timeout := range []struct {
+		field string
+		value time.Duration
+	}{
+		{"timeouts.signaling", c.Timeouts.Signaling},
+		{"timeouts.iceGathering", c.Timeouts.ICEGathering},
+		{"timeouts.iceDisconnected", c.Timeouts.ICEDisconnected},
+		{"timeouts.iceFailed", c.Timeouts.ICEFailed},
+		{"timeouts.iceKeepalive", c.Timeouts.ICEKeepalive},
+		{"timeouts.negotiation", c.Timeouts.Negotiation},
+		{"timeouts.shutdown", c.Timeouts.Shutdown},
+		{"signatureMaxSkew", c.SignatureMaxSkew},
+		{"retry.joinDelay", c.Retry.JoinDelay},
+		{"retry.joinMaxDelay", c.Retry.JoinMaxDelay},
+		{"retry.iceCandidateDelay", c.Retry.ICECandidateDelay},
+	} {
+		if timeout.value <= 0 {
+			invalid(timeout.field, "should be positive, got %s", timeout.value)
+		}
+	}
+	if c.Retry.JoinMaxDelay < c.Retry.JoinDelay {
+		invalid("retry.joinMaxDelay", "shouldn't be less than retry.joinDelay (%s), got %s", c.Retry.JoinDelay, c.Retry.JoinMaxDelay)
+	}
+	if c.Retry.JoinAttempts == 0 {
+		invalid("retry.joinAttempts", "should be at least 1")
+	}
+	return errors.Join(errs...)
 }
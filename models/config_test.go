@@ -0,0 +1,77 @@
+package models
+
+import (
+	"github.com/pion/webrtc/v3"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDefaultConfigIsValid(t *testing.T) {
+	if err := DefaultConfig().Validate(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	cases := []struct {
+		name   string
+		change func(c *ConfigModel)
+		field  string
+	}{
+		{"listen addr without port", func(c *ConfigModel) { c.ListenAddr = "localhost" }, "listenAddr"},
+		{"logjam url without scheme", func(c *ConfigModel) { c.LogjamBaseUrl = "localhost:8090" }, "logjamBaseUrl"},
+		{"logjam url ending with /", func(c *ConfigModel) { c.LogjamBaseUrl = "http://localhost:8090/" }, "logjamBaseUrl"},
+		{"unknown signaling mode", func(c *ConfigModel) { c.SignalingMode = "carrier-pigeon" }, "signalingMode"},
+		{"certificate without key", func(c *ConfigModel) { c.TLS.CertFile = "cert.pem" }, "tls.certFile/tls.keyFile"},
+		{"client ca without certificate", func(c *ConfigModel) { c.TLS.ClientCAFile = "ca.pem" }, "tls.clientCAFile"},
+		{"logjam key without certificate", func(c *ConfigModel) { c.LogjamTLS.KeyFile = "key.pem" }, "logjamTls.certFile/logjamTls.keyFile"},
+		{"tcp mux port out of range", func(c *ConfigModel) { c.ICETCPMUXListenPort = 70000 }, "iceTCPMUXListenPort"},
+		{"nat ip that isn't one", func(c *ConfigModel) { c.NAT1To1IPs = []string{"example.com"} }, "nat1To1IPs"},
+		{"udp port min only", func(c *ConfigModel) { c.UDPPortMin = 10000 }, "udpPortMin/udpPortMax"},
+		{"udp port range upside down", func(c *ConfigModel) { c.UDPPortMin, c.UDPPortMax = 20000, 10000 }, "udpPortMin/udpPortMax"},
+		{"ice server without urls", func(c *ConfigModel) { c.ICEServers = ICEServerList{{}} }, "iceServers[0]"},
+		{"ice server that isn't stun or turn", func(c *ConfigModel) {
+			c.ICEServers = ICEServerList{webrtc.ICEServer{URLs: []string{"http://example.com"}}}
+		}, "iceServers[0]"},
+		{"turn rest secret without uris", func(c *ConfigModel) { c.TURNREST.Secret = "secret" }, "turnRest.uris"},
+		{"embedded turn without public ip", func(c *ConfigModel) {
+			c.EmbeddedTURN.Enabled = true
+			c.EmbeddedTURN.Username, c.EmbeddedTURN.Password = "user", "password"
+		}, "embeddedTurn.publicIP"},
+		{"embedded turn without credentials", func(c *ConfigModel) {
+			c.EmbeddedTURN.Enabled = true
+			c.EmbeddedTURN.PublicIP = "203.0.113.1"
+		}, "embeddedTurn:"},
+		{"unknown log level", func(c *ConfigModel) { c.LogLevel = "loud" }, "logLevel"},
+		{"unknown log format", func(c *ConfigModel) { c.LogFormat = "xml" }, "logFormat"},
+		{"zero timeout", func(c *ConfigModel) { c.Timeouts.Negotiation = 0 }, "timeouts.negotiation"},
+		{"negative grace", func(c *ConfigModel) { c.Timeouts.ICERestartGrace = -time.Second }, "timeouts.iceRestartGrace"},
+		{"max join delay below the delay", func(c *ConfigModel) { c.Retry.JoinMaxDelay = time.Second }, "retry.joinMaxDelay"},
+		{"no join attempts", func(c *ConfigModel) { c.Retry.JoinAttempts = 0 }, "retry.joinAttempts"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			conf := DefaultConfig()
+			c.change(conf)
+			err := conf.Validate()
+			if err == nil || !strings.Contains(err.Error(), c.field) {
+				t.Fatalf("got %v, want a problem with %s", err, c.field)
+			}
+		})
+	}
+}
+
+func TestValidateReportsEveryProblem(t *testing.T) {
+	conf := DefaultConfig()
+	conf.ListenAddr = "nowhere"
+	conf.LogLevel = "loud"
+	conf.Retry.JoinAttempts = 0
+	err := conf.Validate()
+	if err == nil {
+		t.Fatal("the config is invalid")
+	}
+	if problems := strings.Split(err.Error(), "\n"); len(problems) != 3 {
+		t.Fatalf("got %d problems, want 3: %v", len(problems), problems)
+	}
+}
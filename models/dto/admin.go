@@ -0,0 +1,50 @@
+package dto
+
+import "time"
+
+type RoomSummaryDTO struct {
+	RoomId     string `json:"roomId"`
+	GGID       uint64 `json:"ggid"`
+	PeerCount  int    `json:"peerCount"`
+	TrackCount int    `json:"trackCount"`
+}
+
+type ICECandidatePairDTO struct {
+	Local  string `json:"local"`
+	Remote string `json:"remote"`
+}
+
+type PeerSummaryDTO struct {
+	ID               uint64               `json:"id"`
+	CanPublish       bool                 `json:"canPublish"`
+	IsCaller         bool                 `json:"isCaller"`
+	Source           string               `json:"source"`
+	ConnectionState  string               `json:"connectionState"`
+	ICECandidatePair *ICECandidatePairDTO `json:"iceCandidatePair"`
+}
+
+type TrackSummaryDTO struct {
+	ID          string   `json:"id"`
+	StreamID    string   `json:"streamId"`
+	OwnerId     uint64   `json:"ownerId"`
+	Kind        string   `json:"kind"`
+	Codec       string   `json:"codec"`
+	Layers      []string `json:"layers"`
+	Subscribers []uint64 `json:"subscribers"`
+}
+
+// ICEServerDTO is an ice server with its credential redacted
+type ICEServerDTO struct {
+	URLs           []string `json:"urls"`
+	Username       string   `json:"username,omitempty"`
+	Credential     string   `json:"credential,omitempty"`
+	CredentialType string   `json:"credentialType"`
+}
+
+type RejoinStateDTO struct {
+	RoomId        string     `json:"roomId"`
+	State         string     `json:"state"`
+	Attempts      uint       `json:"attempts"`
+	LastError     string     `json:"lastError,omitempty"`
+	NextAttemptAt *time.Time `json:"nextAttemptAt,omitempty"`
+}
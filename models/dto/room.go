@@ -37,3 +37,39 @@ type SetSDPReqModel struct {
 func (model *SetSDPReqModel) Validate() bool {
 	return model.PeerDTO.Validate() && len(model.SDP.SDP) > 0
 }
+
+type RoomDTO struct {
+	RoomId string `json:"roomId"`
+}
+
+func (model *RoomDTO) Validate() bool {
+	return len(model.RoomId) > 0
+}
+
+type SetLayerReqModel struct {
+	PeerDTO
+	TrackId string `json:"trackId"`
+	RID     string `json:"rid"`
+}
+
+func (model *SetLayerReqModel) Validate() bool {
+	return model.PeerDTO.Validate()
+}
+
+// SetPinsReqModel sets the peers whose video the peer always gets, whatever the room's lastN says
+type SetPinsReqModel struct {
+	PeerDTO
+	Pinned []uint64 `json:"pinned"`
+}
+
+func (model *SetPinsReqModel) Validate() bool {
+	return model.PeerDTO.Validate()
+}
+
+// SpeakerChangedReqModel tells who the dominant speaker of a room is, ID is the speaker's peer id
+type SpeakerChangedReqModel struct {
+	PeerDTO
+	GGID uint64 `json:"ggid"`
+	// Level is the speaker's smoothed audio level in -dBov, 0 is the loudest and 127 silence
+	Level uint8 `json:"level"`
+}
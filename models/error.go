@@ -1,9 +1,9 @@
 package models
 
 type BigError struct {
-	message  string `json:"message"`
-	errCode  int    `json:"-"`
-	metaData any    `json:"meta"`
+	message  string
+	errCode  int
+	metaData any
 }
 
 func (err BigError) Error() string {
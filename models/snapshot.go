@@ -0,0 +1,21 @@
+package models
+
+import "time"
+
+// RoomsSnapshot is what goldgorilla keeps about its rooms across restarts, only peers negotiated through logjam are in it
+type RoomsSnapshot struct {
+	SavedAt time.Time      `json:"savedAt"`
+	Rooms   []RoomSnapshot `json:"rooms"`
+}
+
+type RoomSnapshot struct {
+	RoomId string         `json:"roomId"`
+	GGID   uint64         `json:"ggid"`
+	Peers  []PeerSnapshot `json:"peers"`
+}
+
+type PeerSnapshot struct {
+	ID         uint64 `json:"id"`
+	CanPublish bool   `json:"canPublish"`
+	IsCaller   bool   `json:"isCaller"`
+}
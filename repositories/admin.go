@@ -0,0 +1,96 @@
+package repositories
+
+import (
+	"codeberg.org/greatape/goldgorilla/models"
+	"codeberg.org/greatape/goldgorilla/models/dto"
+	"sort"
+)
+
+func (r *RoomRepository) ListRooms() []dto.RoomSummaryDTO {
+	r.Lock()
+	defer r.Unlock()
+	rooms := make([]dto.RoomSummaryDTO, 0, len(r.Rooms))
+	for roomId, room := range r.Rooms {
+		room.Lock()
+		room.trackLock.Lock()
+		rooms = append(rooms, dto.RoomSummaryDTO{
+			RoomId:     roomId,
+			GGID:       room.ggId,
+			PeerCount:  len(room.Peers),
+			TrackCount: len(room.Tracks),
+		})
+		room.trackLock.Unlock()
+		room.Unlock()
+	}
+	sort.Slice(rooms, func(i, j int) bool {
+		return rooms[i].RoomId < rooms[j].RoomId
+	})
+	return rooms
+}
+
+func (r *RoomRepository) ListRoomPeers(roomId string) ([]dto.PeerSummaryDTO, error) {
+	room, err := r.getRoom(roomId)
+	if err != nil {
+		return nil, err
+	}
+	room.Lock()
+	defer room.Unlock()
+	peers := make([]dto.PeerSummaryDTO, 0, len(room.Peers))
+	for _, peer := range room.Peers {
+		summary := dto.PeerSummaryDTO{
+			ID:              peer.ID,
+			CanPublish:      peer.CanPublish,
+			IsCaller:        peer.IsCaller,
+			Source:          string(peer.Source),
+			ConnectionState: peer.Conn.ConnectionState().String(),
+		}
+		// every media section is bundled on the one transport the sctp transport also runs on
+		if dtls := peer.Conn.SCTP().Transport(); dtls != nil {
+			if pair, err := dtls.ICETransport().GetSelectedCandidatePair(); err == nil && pair != nil {
+				summary.ICECandidatePair = &dto.ICECandidatePairDTO{
+					Local:  pair.Local.String(),
+					Remote: pair.Remote.String(),
+				}
+			}
+		}
+		peers = append(peers, summary)
+	}
+	sort.Slice(peers, func(i, j int) bool {
+		return peers[i].ID < peers[j].ID
+	})
+	return peers, nil
+}
+
+func (r *RoomRepository) ListRoomTracks(roomId string) ([]dto.TrackSummaryDTO, error) {
+	room, err := r.getRoom(roomId)
+	if err != nil {
+		return nil, err
+	}
+	room.trackLock.Lock()
+	defer room.trackLock.Unlock()
+	tracks := make([]dto.TrackSummaryDTO, 0, len(room.Tracks))
+	for _, track := range room.Tracks {
+		tracks = append(tracks, dto.TrackSummaryDTO{
+			ID:          track.ID,
+			StreamID:    track.StreamID,
+			OwnerId:     track.OwnerId,
+			Kind:        track.Kind.String(),
+			Codec:       track.Codec.MimeType,
+			Layers:      track.Layers(),
+			Subscribers: track.Subscribers(),
+		})
+	}
+	sort.Slice(tracks, func(i, j int) bool {
+		return tracks[i].ID < tracks[j].ID
+	})
+	return tracks, nil
+}
+
+func (r *RoomRepository) getRoom(roomId string) (*Room, error) {
+	r.Lock()
+	defer r.Unlock()
+	if !r.doesRoomExists(roomId) {
+		return nil, models.NewError("room doesn't exists", 404, map[string]any{"roomId": roomId})
+	}
+	return r.Rooms[roomId], nil
+}
@@ -0,0 +1,129 @@
+package repositories
+
+import (
+	"github.com/pion/interceptor"
+	"github.com/pion/interceptor/pkg/cc"
+	"github.com/pion/interceptor/pkg/gcc"
+	"github.com/pion/webrtc/v3"
+	"sort"
+	"time"
+)
+
+const (
+	layerPolicyInterval = 1 * time.Second
+	initialBitrate      = 1_000_000
+	// audioBitrateReserve is kept out of the estimate for every audio track a subscriber gets
+	audioBitrateReserve = 64_000
+)
+
+// registerBandwidthEstimator adds a send-side (TWCC/GCC) bandwidth estimator to every peer connection,
+// each estimator is handed over through estimatorCH as soon as its peer connection is built.
+func registerBandwidthEstimator(m *webrtc.MediaEngine, i *interceptor.Registry, estimatorCH chan cc.BandwidthEstimator) error {
+	congestionController, err := cc.NewInterceptor(func() (cc.BandwidthEstimator, error) {
+		return gcc.NewSendSideBWE(gcc.SendSideBWEInitialBitrate(initialBitrate))
+	})
+	if err != nil {
+		return err
+	}
+	congestionController.OnNewPeerConnection(func(id string, estimator cc.BandwidthEstimator) {
+		estimatorCH <- estimator
+	})
+	i.Add(congestionController)
+	return webrtc.ConfigureTWCCHeaderExtensionSender(m, i)
+}
+
+func (r *RoomRepository) runLayerPolicy(room *Room) {
+	for {
+		select {
+		case <-room.done:
+			return
+		case <-room.layerTimer.C:
+		}
+		room.Lock()
+		room.trackLock.Lock()
+		for _, peer := range room.Peers {
+			if peer.estimator == nil {
+				continue
+			}
+			r.applyLayerPolicy(room, peer)
+		}
+		room.trackLock.Unlock()
+		room.Unlock()
+	}
+}
+
+type layerAllocation struct {
+	track  *Track
+	layers []layerBitrate
+	index  int
+}
+
+// applyLayerPolicy fits the video a subscriber gets into its bandwidth estimate, every video track starts on its lowest layer
+// and gets upgraded one layer at a time while the estimate allows, below the floor video is paused and only audio flows.
+// must be called with room and room.trackLock locked
+func (r *RoomRepository) applyLayerPolicy(room *Room, peer *Peer) {
+	estimate := peer.estimator.GetTargetBitrate()
+	var videoTracks []*Track
+	audioTracks := 0
+	for _, track := range room.Tracks {
+		if track.OwnerId == peer.ID || !track.hasSubscriber(peer.ID) {
+			continue
+		}
+		if track.Kind == webrtc.RTPCodecTypeAudio {
+			audioTracks++
+		} else {
+			videoTracks = append(videoTracks, track)
+		}
+	}
+	if len(videoTracks) == 0 {
+		return
+	}
+	sort.Slice(videoTracks, func(i, j int) bool {
+		return videoTracks[i].ID < videoTracks[j].ID
+	})
+
+	budget := estimate - audioTracks*audioBitrateReserve
+	if budget < int(r.conf.MinVideoBitrate) {
+		for _, track := range videoTracks {
+			if track.setSubscriberPaused(peer.ID, true) {
+				peer.log.Info("bandwidth estimate too low, pausing video", "estimate", estimate, "trackId", track.ID)
+			}
+		}
+		return
+	}
+
+	allocations := make([]*layerAllocation, 0, len(videoTracks))
+	used := 0
+	for _, track := range videoTracks {
+		layers := track.layerBitrates()
+		if len(layers) == 0 {
+			continue
+		}
+		allocations = append(allocations, &layerAllocation{
+			track:  track,
+			layers: layers,
+		})
+		used += int(layers[0].bitrate)
+	}
+	for upgraded := true; upgraded; {
+		upgraded = false
+		for _, allocation := range allocations {
+			if allocation.index+1 >= len(allocation.layers) {
+				continue
+			}
+			extra := int(allocation.layers[allocation.index+1].bitrate) - int(allocation.layers[allocation.index].bitrate)
+			if used+extra > budget {
+				continue
+			}
+			used += extra
+			allocation.index++
+			upgraded = true
+		}
+	}
+	for _, allocation := range allocations {
+		if allocation.track.setSubscriberPaused(peer.ID, false) {
+			peer.log.Info("bandwidth estimate recovered, resuming video", "estimate", estimate, "trackId", allocation.track.ID)
+		}
+		allocation.track.setAutoLayer(peer.ID, allocation.layers[allocation.index].rid)
+	}
+}
@@ -0,0 +1,81 @@
+package repositories
+
+import (
+	"fmt"
+	"github.com/pion/webrtc/v3"
+	"strings"
+)
+
+var videoRTCPFeedback = []webrtc.RTCPFeedback{{Type: "goog-remb"}, {Type: "ccm", Parameter: "fir"}, {Type: "nack"}, {Type: "nack", Parameter: "pli"}}
+
+// knownCodecs are the codecs that can be picked in the config, with the same payload types as pion's defaults,
+// every video codec comes with its rtx codec.
+var knownCodecs = map[string][]webrtc.RTPCodecParameters{
+	strings.ToLower(webrtc.MimeTypeOpus): {
+		{RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus, ClockRate: 48000, Channels: 2, SDPFmtpLine: "minptime=10;useinbandfec=1"}, PayloadType: 111},
+	},
+	strings.ToLower(webrtc.MimeTypeG722): {
+		{RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeG722, ClockRate: 8000}, PayloadType: 9},
+	},
+	strings.ToLower(webrtc.MimeTypePCMU): {
+		{RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypePCMU, ClockRate: 8000}, PayloadType: 0},
+	},
+	strings.ToLower(webrtc.MimeTypePCMA): {
+		{RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypePCMA, ClockRate: 8000}, PayloadType: 8},
+	},
+	strings.ToLower(webrtc.MimeTypeVP8): withRTX(
+		webrtc.RTPCodecParameters{RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8, ClockRate: 90000, RTCPFeedback: videoRTCPFeedback}, PayloadType: 96}, 97,
+	),
+	strings.ToLower(webrtc.MimeTypeVP9): append(
+		withRTX(webrtc.RTPCodecParameters{RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP9, ClockRate: 90000, SDPFmtpLine: "profile-id=0", RTCPFeedback: videoRTCPFeedback}, PayloadType: 98}, 99),
+		withRTX(webrtc.RTPCodecParameters{RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP9, ClockRate: 90000, SDPFmtpLine: "profile-id=1", RTCPFeedback: videoRTCPFeedback}, PayloadType: 100}, 101)...,
+	),
+	strings.ToLower(webrtc.MimeTypeH264): append(append(append(append(
+		withRTX(webrtc.RTPCodecParameters{RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264, ClockRate: 90000, SDPFmtpLine: "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=42001f", RTCPFeedback: videoRTCPFeedback}, PayloadType: 102}, 121),
+		withRTX(webrtc.RTPCodecParameters{RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264, ClockRate: 90000, SDPFmtpLine: "level-asymmetry-allowed=1;packetization-mode=0;profile-level-id=42001f", RTCPFeedback: videoRTCPFeedback}, PayloadType: 127}, 120)...),
+		withRTX(webrtc.RTPCodecParameters{RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264, ClockRate: 90000, SDPFmtpLine: "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=42e01f", RTCPFeedback: videoRTCPFeedback}, PayloadType: 125}, 107)...),
+		withRTX(webrtc.RTPCodecParameters{RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264, ClockRate: 90000, SDPFmtpLine: "level-asymmetry-allowed=1;packetization-mode=0;profile-level-id=42e01f", RTCPFeedback: videoRTCPFeedback}, PayloadType: 108}, 109)...),
+		withRTX(webrtc.RTPCodecParameters{RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264, ClockRate: 90000, SDPFmtpLine: "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=640032", RTCPFeedback: videoRTCPFeedback}, PayloadType: 123}, 118)...,
+	),
+	strings.ToLower(webrtc.MimeTypeAV1): withRTX(
+		webrtc.RTPCodecParameters{RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeAV1, ClockRate: 90000, RTCPFeedback: videoRTCPFeedback}, PayloadType: 45}, 46,
+	),
+}
+
+func withRTX(codec webrtc.RTPCodecParameters, rtxPayloadType webrtc.PayloadType) []webrtc.RTPCodecParameters {
+	return []webrtc.RTPCodecParameters{
+		codec,
+		{
+			RTPCodecCapability: webrtc.RTPCodecCapability{MimeType: "video/rtx", ClockRate: 90000, SDPFmtpLine: fmt.Sprintf("apt=%d", codec.PayloadType)},
+			PayloadType:        rtxPayloadType,
+		},
+	}
+}
+
+func IsKnownCodec(mimeType string) bool {
+	_, known := knownCodecs[strings.ToLower(mimeType)]
+	return known
+}
+
+// registerCodecs registers the codecs named by their mime type, pion's defaults when none are named
+func registerCodecs(m *webrtc.MediaEngine, mimeTypes []string) error {
+	if len(mimeTypes) == 0 {
+		return m.RegisterDefaultCodecs()
+	}
+	for _, mimeType := range mimeTypes {
+		codecs, known := knownCodecs[strings.ToLower(mimeType)]
+		if !known {
+			return fmt.Errorf("unknown codec %s", mimeType)
+		}
+		kind := webrtc.RTPCodecTypeAudio
+		if strings.HasPrefix(strings.ToLower(mimeType), "video/") {
+			kind = webrtc.RTPCodecTypeVideo
+		}
+		for _, codec := range codecs {
+			if err := m.RegisterCodec(codec, kind); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
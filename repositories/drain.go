@@ -0,0 +1,53 @@
+package repositories
+
+import (
+	"sort"
+	"sync"
+)
+
+// Drain stops the repository from taking new rooms and returns the rooms it has, they are still served until CloseRooms
+func (r *RoomRepository) Drain() []string {
+	r.draining.Store(true)
+	r.Lock()
+	defer r.Unlock()
+	roomIds := make([]string, 0, len(r.Rooms))
+	for roomId := range r.Rooms {
+		roomIds = append(roomIds, roomId)
+	}
+	sort.Strings(roomIds)
+	return roomIds
+}
+
+func (r *RoomRepository) IsDraining() bool {
+	return r.draining.Load()
+}
+
+// CloseRooms removes every room, stops their timers and closes their peer connections, it returns once they're all closed.
+// the snapshot is emptied too, the rooms were handed back to logjam and shouldn't be rejoined after a restart.
+func (r *RoomRepository) CloseRooms() {
+	r.rejoins.CancelAll()
+	r.Lock()
+	rooms := r.Rooms
+	r.Rooms = make(map[string]*Room)
+	r.Unlock()
+
+	wg := &sync.WaitGroup{}
+	for _, room := range rooms {
+		room.Lock()
+		room.stop()
+		for _, peer := range room.Peers {
+			wg.Add(1)
+			go func(peer *Peer) {
+				defer wg.Done()
+				if err := peer.Conn.Close(); err != nil {
+					peer.log.Error("can't close peer connection", "err", err)
+				}
+			}(peer)
+		}
+		room.Unlock()
+	}
+	wg.Wait()
+	if r.store != nil {
+		r.saveSnapshot()
+	}
+}
@@ -0,0 +1,160 @@
+package repositories
+
+import (
+	"codeberg.org/greatape/goldgorilla/models"
+	"crypto/rand"
+	"encoding/binary"
+	"github.com/pion/webrtc/v3"
+	"log/slog"
+	"strings"
+	"time"
+)
+
+// external peers are the ones logjam doesn't know about (WHIP publishers, WHEP viewers), they are negotiated over plain http
+
+// PatchExternalPeerICE trickles candidates of a WHIP/WHEP peer, a new iceUfrag/icePwd pair restarts ice and the new answer is returned.
+func (r *RoomRepository) PatchExternalPeerICE(roomId string, id uint64, source PeerSource, iceUfrag string, icePwd string, candidates []webrtc.ICECandidateInit) (*webrtc.SessionDescription, error) {
+	peer, err := r.getExternalPeer(roomId, id, source)
+	if err != nil {
+		return nil, err
+	}
+	var restartAnswer *webrtc.SessionDescription
+	if len(iceUfrag) > 0 && iceUfrag != remoteICEUfrag(peer.Conn) {
+		if len(icePwd) == 0 {
+			return nil, models.NewError("ice restart needs both ice-ufrag and ice-pwd", 400, nil)
+		}
+		peer.log.Info("ice restart requested")
+		restartAnswer, err = r.answerExternalOffer(peer.log, peer.Conn, webrtc.SessionDescription{
+			Type: webrtc.SDPTypeOffer,
+			SDP:  replaceICECredentials(peer.Conn.RemoteDescription().SDP, iceUfrag, icePwd),
+		}, nil)
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, candidate := range candidates {
+		if err := peer.Conn.AddICECandidate(candidate); err != nil {
+			return nil, models.NewError(err.Error(), 422, models.MessageResponse{Message: err.Error()})
+		}
+	}
+	return restartAnswer, nil
+}
+
+func (r *RoomRepository) CloseExternalPeer(roomId string, id uint64, source PeerSource) error {
+	peer, err := r.getExternalPeer(roomId, id, source)
+	if err != nil {
+		return err
+	}
+	return peer.Conn.Close()
+}
+
+func (r *RoomRepository) getExternalPeer(roomId string, id uint64, source PeerSource) (*Peer, error) {
+	r.Lock()
+	if !r.doesRoomExists(roomId) {
+		r.Unlock()
+		return nil, models.NewError("room doesn't exists", 404, map[string]any{"roomId": roomId})
+	}
+	room := r.Rooms[roomId]
+	r.Unlock()
+	room.Lock()
+	defer room.Unlock()
+	peer, exists := room.Peers[id]
+	if !exists || peer.Source != source {
+		return nil, models.NewError("no such a peer with this id in this room", 404, map[string]any{"roomId": roomId, "peerId": id})
+	}
+	return peer, nil
+}
+
+// reserveExternalPeerId picks an id for a peer logjam doesn't know about, it has the high bit set so it won't collide with logjam's ids
+func (r *RoomRepository) reserveExternalPeerId(roomId string) (*Room, uint64, error) {
+	r.Lock()
+	if !r.doesRoomExists(roomId) {
+		r.Unlock()
+		return nil, 0, models.NewError("room doesn't exists", 404, map[string]any{"roomId": roomId})
+	}
+	room := r.Rooms[roomId]
+	r.Unlock()
+
+	room.Lock()
+	defer room.Unlock()
+	buffer := make([]byte, 8)
+	for {
+		if _, err := rand.Read(buffer); err != nil {
+			return nil, 0, models.NewError("can't generate peer id", 500, models.MessageResponse{Message: err.Error()})
+		}
+		id := binary.BigEndian.Uint64(buffer) | 1<<63
+		if _, exists := room.Peers[id]; !exists {
+			return room, id, nil
+		}
+	}
+}
+
+func (r *RoomRepository) dropExternalPeer(room *Room, id uint64) {
+	room.Lock()
+	peer, exists := room.Peers[id]
+	delete(room.Peers, id)
+	room.Unlock()
+	if exists {
+		_ = peer.Conn.Close()
+	}
+}
+
+// answerExternalOffer answers with every local candidate in the sdp, WHIP/WHEP clients don't get trickled candidates from the server
+// beforeAnswer, when not nil, runs between setting the offer and creating the answer, e.g. to attach tracks to the offered transceivers
+func (r *RoomRepository) answerExternalOffer(log *slog.Logger, peerConn *webrtc.PeerConnection, offer webrtc.SessionDescription, beforeAnswer func() error) (*webrtc.SessionDescription, error) {
+	if err := peerConn.SetRemoteDescription(offer); err != nil {
+		return nil, models.NewError(err.Error(), 422, models.MessageResponse{Message: err.Error()})
+	}
+	if beforeAnswer != nil {
+		if err := beforeAnswer(); err != nil {
+			return nil, err
+		}
+	}
+	answer, err := peerConn.CreateAnswer(nil)
+	if err != nil {
+		return nil, models.NewError(err.Error(), 500, models.MessageResponse{Message: err.Error()})
+	}
+	gatheringComplete := webrtc.GatheringCompletePromise(peerConn)
+	if err = peerConn.SetLocalDescription(answer); err != nil {
+		return nil, models.NewError(err.Error(), 500, models.MessageResponse{Message: err.Error()})
+	}
+	select {
+	case <-gatheringComplete:
+	case <-time.After(r.conf.Timeouts.ICEGathering):
+		log.Warn("ice gathering didn't complete in time, answering with what we have")
+	}
+	return peerConn.LocalDescription(), nil
+}
+
+func remoteICEUfrag(peerConn *webrtc.PeerConnection) string {
+	remote := peerConn.RemoteDescription()
+	if remote == nil {
+		return ""
+	}
+	for _, line := range strings.Split(remote.SDP, "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "a=ice-ufrag:") {
+			return strings.TrimPrefix(line, "a=ice-ufrag:")
+		}
+	}
+	return ""
+}
+
+// replaceICECredentials swaps ice credentials of an sdp and drops its candidates, it's used to turn a PATCHed ice restart into an offer
+func replaceICECredentials(sdp string, iceUfrag string, icePwd string) string {
+	lines := strings.Split(sdp, "\n")
+	result := make([]string, 0, len(lines))
+	for _, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(trimmed, "a=ice-ufrag:"):
+			result = append(result, "a=ice-ufrag:"+iceUfrag+"\r")
+		case strings.HasPrefix(trimmed, "a=ice-pwd:"):
+			result = append(result, "a=ice-pwd:"+icePwd+"\r")
+		case strings.HasPrefix(trimmed, "a=candidate:"), strings.HasPrefix(trimmed, "a=end-of-candidates"):
+		default:
+			result = append(result, line)
+		}
+	}
+	return strings.Join(result, "\n")
+}
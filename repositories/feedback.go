@@ -0,0 +1,203 @@
+package repositories
+
+import (
+	"github.com/pion/interceptor"
+	"github.com/pion/interceptor/pkg/nack"
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+	"time"
+)
+
+const (
+	// retransmitBufferSize is how many of the last packets sent to a subscriber are kept around to answer its NACKs
+	retransmitBufferSize      = 512
+	publisherFeedbackInterval = 1 * time.Second
+	// subscriberFeedbackTimeout is how long a subscriber's REMB/receiver report is taken into account
+	subscriberFeedbackTimeout = 5 * time.Second
+)
+
+// registerInterceptors is webrtc.RegisterDefaultInterceptors without the NACK responder,
+// NACKs from subscribers are answered by the tracks from their own retransmission buffers.
+func registerInterceptors(m *webrtc.MediaEngine, i *interceptor.Registry) error {
+	generator, err := nack.NewGeneratorInterceptor()
+	if err != nil {
+		return err
+	}
+	m.RegisterFeedback(webrtc.RTCPFeedback{Type: "nack"}, webrtc.RTPCodecTypeVideo)
+	m.RegisterFeedback(webrtc.RTCPFeedback{Type: "nack", Parameter: "pli"}, webrtc.RTPCodecTypeVideo)
+	i.Add(generator)
+	if err := webrtc.ConfigureRTCPReports(i); err != nil {
+		return err
+	}
+	return webrtc.ConfigureTWCCSender(m, i)
+}
+
+// retransmit resends the packets a subscriber has NACKed, the ones that aren't buffered anymore are NACKed to the publisher
+func (t *Track) retransmit(subscriberId uint64, nacks []rtcp.NackPair) {
+	t.lock.Lock()
+	dt, exists := t.downTracks[subscriberId]
+	if !exists || dt.sent == nil {
+		t.lock.Unlock()
+		return
+	}
+	resend, missing, misses := dt.lookupNACKed(nacks)
+	t.retransmitted += uint64(len(resend))
+	t.retransmitMisses += uint64(misses)
+	var ssrc uint32
+	if layer, exists := t.layers[dt.currentLayer]; exists && dt.started {
+		ssrc = uint32(layer.remote.SSRC())
+	}
+	t.lock.Unlock()
+
+	for _, packet := range resend {
+		if err := dt.local.WriteRTP(packet); err != nil {
+			t.writeFailures.Inc()
+			t.log.Error("can't retransmit to subscriber", "subscriberId", subscriberId, "err", err)
+			return
+		}
+	}
+	if len(missing) == 0 || ssrc == 0 {
+		return
+	}
+	err := t.publisher.WriteRTCP([]rtcp.Packet{
+		&rtcp.TransportLayerNack{
+			MediaSSRC: ssrc,
+			Nacks:     rtcp.NackPairsFromSequenceNumbers(missing),
+		},
+	})
+	if err != nil {
+		t.log.Error("can't send nack to publisher", "err", err)
+	}
+}
+
+// lookupNACKed returns the buffered packets among the NACKed ones and the publisher's sequence numbers of the current layer
+// for the others, along with how many weren't buffered. the ones sent before the last layer switch came from another layer
+// and are dropped, their sequence numbers don't map back to the current one.
+func (dt *downTrack) lookupNACKed(nacks []rtcp.NackPair) ([]*rtp.Packet, []uint16, int) {
+	var resend []*rtp.Packet
+	var missing []uint16
+	misses := 0
+	for _, pair := range nacks {
+		for _, seq := range pair.PacketList() {
+			if packet := dt.sent[seq%retransmitBufferSize]; packet != nil && packet.SequenceNumber == seq {
+				resend = append(resend, packet)
+				continue
+			}
+			misses++
+			if int16(seq-dt.layerStartSeq) >= 0 {
+				missing = append(missing, seq-dt.seqOffset)
+			}
+		}
+	}
+	return resend, missing, misses
+}
+
+// Retransmissions returns how many NACKed packets were resent to subscribers and how many weren't in the buffer anymore
+func (t *Track) Retransmissions() (uint64, uint64) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.retransmitted, t.retransmitMisses
+}
+
+func (t *Track) recordREMB(subscriberId uint64, bitrate uint64) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if dt, exists := t.downTracks[subscriberId]; exists {
+		dt.remb = bitrate
+		dt.feedbackAt = time.Now()
+	}
+}
+
+func (t *Track) recordFractionLost(subscriberId uint64, fractionLost uint8) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if dt, exists := t.downTracks[subscriberId]; exists {
+		dt.fractionLost = fractionLost
+		dt.feedbackAt = time.Now()
+	}
+}
+
+// sendPublisherFeedback sends the publisher a REMB that fits the subscriber with the lowest REMB or the most loss,
+// simulcast tracks are left alone since there every subscriber gets the layer that suits it.
+func (t *Track) sendPublisherFeedback() {
+	if t.Kind != webrtc.RTPCodecTypeVideo {
+		return
+	}
+	t.lock.Lock()
+	if len(t.layers) != 1 {
+		t.lock.Unlock()
+		return
+	}
+	var layer *trackLayer
+	for _, l := range t.layers {
+		layer = l
+	}
+	now := time.Now()
+	var remb uint64
+	var fractionLost uint8
+	reporting := 0
+	for _, dt := range t.downTracks {
+		if dt.paused || now.Sub(dt.feedbackAt) > subscriberFeedbackTimeout {
+			continue
+		}
+		reporting++
+		if dt.remb > 0 && (remb == 0 || dt.remb < remb) {
+			remb = dt.remb
+		}
+		if dt.fractionLost > fractionLost {
+			fractionLost = dt.fractionLost
+		}
+	}
+	bitrate := layer.bitrate
+	ssrc := uint32(layer.remote.SSRC())
+	t.lock.Unlock()
+	if reporting == 0 {
+		return
+	}
+
+	// the loss based part works like GCC: over 10% loss backs off, under 2% leaves room to grow (fractionLost is out of 256)
+	estimate := remb
+	if bitrate > 0 {
+		lossBased := bitrate
+		if fractionLost > 25 {
+			lossBased = bitrate * (512 - uint64(fractionLost)) / 512
+		} else if fractionLost < 5 {
+			lossBased = bitrate * 108 / 100
+		}
+		if estimate == 0 || lossBased < estimate {
+			estimate = lossBased
+		}
+	}
+	if estimate == 0 {
+		return
+	}
+	err := t.publisher.WriteRTCP([]rtcp.Packet{
+		&rtcp.ReceiverEstimatedMaximumBitrate{
+			Bitrate: float32(estimate),
+			SSRCs:   []uint32{ssrc},
+		},
+	})
+	if err != nil {
+		t.log.Error("can't send remb to publisher", "err", err)
+	}
+}
+
+func (r *RoomRepository) runPublisherFeedback(room *Room) {
+	for {
+		select {
+		case <-room.done:
+			return
+		case <-room.feedbackTimer.C:
+		}
+		room.trackLock.Lock()
+		tracks := make([]*Track, 0, len(room.Tracks))
+		for _, track := range room.Tracks {
+			tracks = append(tracks, track)
+		}
+		room.trackLock.Unlock()
+		for _, track := range tracks {
+			track.sendPublisherFeedback()
+		}
+	}
+}
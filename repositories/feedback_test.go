@@ -0,0 +1,72 @@
+package repositories
+
+import (
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+	"testing"
+	"time"
+)
+
+func newTestDownTrack(t *testing.T) *downTrack {
+	t.Helper()
+	local, err := webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8, ClockRate: 90000}, "video", "stream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &downTrack{
+		local: local,
+		sent:  &[retransmitBufferSize]*rtp.Packet{},
+	}
+}
+
+// sendFrom switches the down track to the layer and writes the packets of the sequence numbers, skipping the lost ones
+func sendFrom(t *testing.T, dt *downTrack, rid string, first uint16, count int, lost map[uint16]bool) {
+	t.Helper()
+	now := time.Now()
+	for i := 0; i < count; i++ {
+		packet := &rtp.Packet{Header: rtp.Header{SequenceNumber: first + uint16(i), Timestamp: 1000 + uint32(i)*3000}}
+		if i == 0 {
+			dt.switchTo(rid, packet, 90000, now)
+		}
+		if lost[packet.SequenceNumber] {
+			continue
+		}
+		if err := dt.write(packet, now); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestLookupNACKedAcrossLayerSwitch(t *testing.T) {
+	dt := newTestDownTrack(t)
+	sendFrom(t, dt, "l", 100, 10, map[uint16]bool{105: true})
+	sendFrom(t, dt, "h", 5000, 5, map[uint16]bool{5002: true})
+	if dt.layerStartSeq != 110 {
+		t.Fatalf("layer h starts at %d, want 110", dt.layerStartSeq)
+	}
+
+	resend, missing, misses := dt.lookupNACKed(rtcp.NackPairsFromSequenceNumbers([]uint16{103, 105, 112}))
+	if len(resend) != 1 || resend[0].SequenceNumber != 103 {
+		t.Fatalf("resent %v, want the buffered 103", resend)
+	}
+	if misses != 2 {
+		t.Fatalf("%d misses, want 2", misses)
+	}
+	// 105 was lost on layer l, it can't be asked for on layer h
+	if len(missing) != 1 || missing[0] != 5002 {
+		t.Fatalf("NACKed %v to the publisher, want [5002]", missing)
+	}
+}
+
+func TestLookupNACKedOverwrittenPackets(t *testing.T) {
+	dt := newTestDownTrack(t)
+	sendFrom(t, dt, "", 0, retransmitBufferSize+10, nil)
+	resend, missing, misses := dt.lookupNACKed(rtcp.NackPairsFromSequenceNumbers([]uint16{5, retransmitBufferSize + 5}))
+	if len(resend) != 1 || resend[0].SequenceNumber != retransmitBufferSize+5 {
+		t.Fatalf("resent %v, want only the newest packet", resend)
+	}
+	if misses != 1 || len(missing) != 1 || missing[0] != 5 {
+		t.Fatalf("got %d misses and NACKed %v, want 5 NACKed to the publisher", misses, missing)
+	}
+}
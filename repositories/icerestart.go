@@ -0,0 +1,38 @@
+package repositories
+
+import (
+	"github.com/pion/webrtc/v3"
+	"time"
+)
+
+// recoverICE gives a peer that lost its connection the grace period to get it back, logjam peers get an ice restart offer
+// for it while WHIP clients can restart through PATCH, the peer connection is closed (releasing its tracks) if it doesn't make it.
+// the room has to be locked.
+func (r *RoomRepository) recoverICE(peer *Peer) {
+	if peer.iceGraceTimer != nil {
+		return
+	}
+	conn := peer.Conn
+	if r.conf.Timeouts.ICERestartGrace == 0 {
+		go r.closeUnrecovered(peer, conn)
+		return
+	}
+	peer.log.Info("peer lost its connection, waiting for it to reconnect", "grace", r.conf.Timeouts.ICERestartGrace)
+	peer.iceGraceTimer = time.AfterFunc(r.conf.Timeouts.ICERestartGrace, func() {
+		if conn.ConnectionState() == webrtc.PeerConnectionStateConnected {
+			return
+		}
+		peer.log.Warn("peer didn't reconnect in time")
+		r.closeUnrecovered(peer, conn)
+	})
+	if peer.negotiator != nil {
+		go peer.negotiator.RestartICE()
+	}
+}
+
+func (r *RoomRepository) closeUnrecovered(peer *Peer, conn *webrtc.PeerConnection) {
+	iceRecoveries.WithLabelValues("closed").Inc()
+	if err := conn.Close(); err != nil {
+		peer.log.Error("can't close peer connection", "err", err)
+	}
+}
@@ -0,0 +1,192 @@
+package repositories
+
+import (
+	"github.com/pion/rtcp"
+	"github.com/pion/webrtc/v3"
+	"strings"
+	"time"
+)
+
+const (
+	// keyframeRequestInterval is the least time between two keyframe requests for the same layer of a track
+	keyframeRequestInterval = 500 * time.Millisecond
+	// keyframeLossThreshold is how many packets in a row may go missing before a keyframe is requested instead of waiting for NACKs
+	keyframeLossThreshold = 16
+)
+
+type KeyframeReason string
+
+const (
+	KeyframeReasonNewSubscriber KeyframeReason = "new_subscriber"
+	KeyframeReasonLayerSwitch   KeyframeReason = "layer_switch"
+	KeyframeReasonResume        KeyframeReason = "resume"
+	KeyframeReasonSubscriberPLI KeyframeReason = "subscriber_pli"
+	KeyframeReasonSubscriberFIR KeyframeReason = "subscriber_fir"
+	KeyframeReasonPacketLoss    KeyframeReason = "packet_loss"
+)
+
+// requestKeyframe asks the publisher for a keyframe on a layer, requests coming faster than keyframeRequestInterval are dropped
+func (t *Track) requestKeyframe(rid string, reason KeyframeReason) {
+	if t.Kind != webrtc.RTPCodecTypeVideo {
+		return
+	}
+	t.lock.Lock()
+	layer, exists := t.layers[rid]
+	if !exists {
+		t.lock.Unlock()
+		return
+	}
+	if time.Since(layer.lastKeyframeAt) < keyframeRequestInterval {
+		t.keyframeRequestsThrottled++
+		t.lock.Unlock()
+		return
+	}
+	layer.lastKeyframeAt = time.Now()
+	t.keyframeRequests[reason]++
+	ssrc := uint32(layer.remote.SSRC())
+	t.lock.Unlock()
+
+	err := t.publisher.WriteRTCP([]rtcp.Packet{
+		&rtcp.PictureLossIndication{
+			MediaSSRC: ssrc,
+		},
+	})
+	if err != nil {
+		t.log.Error("can't send pli to publisher", "rid", rid, "reason", reason, "err", err)
+		return
+	}
+	plisSent.WithLabelValues(string(reason)).Inc()
+}
+
+// requestSubscriberKeyframe requests a keyframe of the layer a subscriber is on (or waiting for)
+func (t *Track) requestSubscriberKeyframe(subscriberId uint64, reason KeyframeReason) {
+	t.lock.Lock()
+	dt, exists := t.downTracks[subscriberId]
+	if !exists {
+		t.lock.Unlock()
+		return
+	}
+	rid := dt.currentLayer
+	if !dt.started || dt.resync {
+		rid = t.resolveTarget(dt)
+	}
+	t.lock.Unlock()
+	t.requestKeyframe(rid, reason)
+}
+
+// KeyframeRequests returns how many keyframe requests were sent per reason and how many got dropped by the rate limit
+func (t *Track) KeyframeRequests() (map[KeyframeReason]uint64, uint64) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	sent := make(map[KeyframeReason]uint64, len(t.keyframeRequests))
+	for reason, count := range t.keyframeRequests {
+		sent[reason] = count
+	}
+	return sent, t.keyframeRequestsThrottled
+}
+
+// isKeyframePacket tells if an rtp payload starts a keyframe, codecs it doesn't know are treated as keyframes
+func isKeyframePacket(mimeType string, payload []byte) bool {
+	switch strings.ToLower(mimeType) {
+	case strings.ToLower(webrtc.MimeTypeVP8):
+		return isVP8Keyframe(payload)
+	case strings.ToLower(webrtc.MimeTypeVP9):
+		return isVP9Keyframe(payload)
+	case strings.ToLower(webrtc.MimeTypeH264):
+		return isH264Keyframe(payload)
+	case strings.ToLower(webrtc.MimeTypeAV1):
+		return isAV1Keyframe(payload)
+	}
+	return true
+}
+
+// see RFC 7741 section 4.2 and 4.3
+func isVP8Keyframe(payload []byte) bool {
+	if len(payload) < 1 {
+		return false
+	}
+	extended := payload[0]&0x80 != 0
+	startOfPartition := payload[0]&0x10 != 0
+	partitionId := payload[0] & 0x07
+	if !startOfPartition || partitionId != 0 {
+		return false
+	}
+	offset := 1
+	if extended {
+		if len(payload) < 2 {
+			return false
+		}
+		flags := payload[1]
+		offset++
+		if flags&0x80 != 0 {
+			if len(payload) <= offset {
+				return false
+			}
+			if payload[offset]&0x80 != 0 {
+				offset += 2
+			} else {
+				offset++
+			}
+		}
+		if flags&0x40 != 0 {
+			offset++
+		}
+		if flags&0x30 != 0 {
+			offset++
+		}
+	}
+	if len(payload) <= offset {
+		return false
+	}
+	return payload[offset]&0x01 == 0
+}
+
+// see draft-ietf-payload-vp9 section 4.2, a keyframe is not inter-picture predicted and starts a frame
+func isVP9Keyframe(payload []byte) bool {
+	if len(payload) < 1 {
+		return false
+	}
+	interPredicted := payload[0]&0x40 != 0
+	startOfFrame := payload[0]&0x08 != 0
+	return !interPredicted && startOfFrame
+}
+
+// see RFC 6184, IDR slices and SPS count as keyframes, also inside STAP-A and FU-A
+func isH264Keyframe(payload []byte) bool {
+	if len(payload) < 1 {
+		return false
+	}
+	naluType := payload[0] & 0x1F
+	switch naluType {
+	case 5, 7:
+		return true
+	case 24:
+		offset := 1
+		for offset+2 < len(payload) {
+			size := int(payload[offset])<<8 | int(payload[offset+1])
+			offset += 2
+			if offset >= len(payload) {
+				return false
+			}
+			if t := payload[offset] & 0x1F; t == 5 || t == 7 {
+				return true
+			}
+			offset += size
+		}
+	case 28:
+		if len(payload) < 2 {
+			return false
+		}
+		start := payload[1]&0x80 != 0
+		return start && payload[1]&0x1F == 5
+	}
+	return false
+}
+
+// see the AV1 rtp spec section 4.4, N is set on the first packet of a coded video sequence
+func isAV1Keyframe(payload []byte) bool {
+	if len(payload) < 1 {
+		return false
+	}
+	return payload[0]&0x08 != 0
+}
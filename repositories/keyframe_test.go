@@ -0,0 +1,97 @@
+package repositories
+
+import (
+	"github.com/pion/webrtc/v3"
+	"io"
+	"log/slog"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestIsKeyframePacket(t *testing.T) {
+	cases := []struct {
+		name     string
+		mimeType string
+		payload  []byte
+		keyframe bool
+	}{
+		{"vp8 keyframe", webrtc.MimeTypeVP8, []byte{0x10, 0x00}, true},
+		{"vp8 interframe", webrtc.MimeTypeVP8, []byte{0x10, 0x01}, false},
+		{"vp8 not the start of the partition", webrtc.MimeTypeVP8, []byte{0x00, 0x00}, false},
+		{"vp8 not the first partition", webrtc.MimeTypeVP8, []byte{0x11, 0x00}, false},
+		// X set, I set with a 15 bit picture id, then L, then T/K
+		{"vp8 extended keyframe", webrtc.MimeTypeVP8, []byte{0x90, 0xF0, 0x80, 0x01, 0x00, 0x00, 0x00}, true},
+		{"vp8 extended interframe", webrtc.MimeTypeVP8, []byte{0x90, 0xF0, 0x80, 0x01, 0x00, 0x00, 0x01}, false},
+		{"vp8 truncated", webrtc.MimeTypeVP8, []byte{0x90, 0x80}, false},
+		{"vp8 empty", webrtc.MimeTypeVP8, nil, false},
+		{"vp9 keyframe", webrtc.MimeTypeVP9, []byte{0x08}, true},
+		{"vp9 inter predicted", webrtc.MimeTypeVP9, []byte{0x48}, false},
+		{"vp9 not the start of the frame", webrtc.MimeTypeVP9, []byte{0x00}, false},
+		{"h264 idr", webrtc.MimeTypeH264, []byte{0x65}, true},
+		{"h264 sps", webrtc.MimeTypeH264, []byte{0x67}, true},
+		{"h264 non idr", webrtc.MimeTypeH264, []byte{0x41}, false},
+		{"h264 stap-a with sps", webrtc.MimeTypeH264, []byte{0x78, 0x00, 0x02, 0x67, 0x00, 0x00, 0x02, 0x68, 0x00}, true},
+		{"h264 stap-a without idr", webrtc.MimeTypeH264, []byte{0x78, 0x00, 0x02, 0x41, 0x00}, false},
+		{"h264 fu-a start of idr", webrtc.MimeTypeH264, []byte{0x7C, 0x85}, true},
+		{"h264 fu-a middle of idr", webrtc.MimeTypeH264, []byte{0x7C, 0x05}, false},
+		{"av1 new coded video sequence", webrtc.MimeTypeAV1, []byte{0x08}, true},
+		{"av1 interframe", webrtc.MimeTypeAV1, []byte{0x00}, false},
+		{"mime type case", "video/vp8", []byte{0x10, 0x01}, false},
+		{"unknown codec", "video/unknown", []byte{0x00}, true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if keyframe := isKeyframePacket(c.mimeType, c.payload); keyframe != c.keyframe {
+				t.Fatalf("keyframe is %t, want %t", keyframe, c.keyframe)
+			}
+		})
+	}
+}
+
+func newTestTrack(t *testing.T, kind webrtc.RTPCodecType) *Track {
+	t.Helper()
+	publisher := newTestClient(t)
+	return &Track{
+		Kind:             kind,
+		publisher:        publisher,
+		log:              slog.New(slog.NewTextHandler(io.Discard, nil)),
+		lock:             &sync.Mutex{},
+		layers:           map[string]*trackLayer{"": {remote: &webrtc.TrackRemote{}}},
+		downTracks:       map[uint64]*downTrack{},
+		keyframeRequests: map[KeyframeReason]uint64{},
+		forwardedBytes:   forwardedBytes.WithLabelValues(kind.String()),
+		forwardedPackets: forwardedPackets.WithLabelValues(kind.String()),
+		writeFailures:    trackWriteFailures.WithLabelValues(kind.String()),
+	}
+}
+
+func TestRequestKeyframeIsRateLimited(t *testing.T) {
+	track := newTestTrack(t, webrtc.RTPCodecTypeVideo)
+	track.requestKeyframe("", KeyframeReasonNewSubscriber)
+	track.requestKeyframe("", KeyframeReasonSubscriberPLI)
+	// a layer the track doesn't have is ignored
+	track.requestKeyframe("h", KeyframeReasonLayerSwitch)
+
+	sent, throttled := track.KeyframeRequests()
+	if len(sent) != 1 || sent[KeyframeReasonNewSubscriber] != 1 {
+		t.Fatalf("sent %v, want only the first request", sent)
+	}
+	if throttled != 1 {
+		t.Fatalf("%d requests throttled, want 1", throttled)
+	}
+
+	track.layers[""].lastKeyframeAt = time.Now().Add(-keyframeRequestInterval)
+	track.requestKeyframe("", KeyframeReasonPacketLoss)
+	if sent, _ = track.KeyframeRequests(); sent[KeyframeReasonPacketLoss] != 1 {
+		t.Fatalf("sent %v, want a request once the interval passed", sent)
+	}
+}
+
+func TestRequestKeyframeOfAudio(t *testing.T) {
+	track := newTestTrack(t, webrtc.RTPCodecTypeAudio)
+	track.requestKeyframe("", KeyframeReasonNewSubscriber)
+	if sent, throttled := track.KeyframeRequests(); len(sent) != 0 || throttled != 0 {
+		t.Fatalf("sent %v and throttled %d, audio has no keyframes", sent, throttled)
+	}
+}
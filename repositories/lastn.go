@@ -0,0 +1,119 @@
+package repositories
+
+import (
+	"codeberg.org/greatape/goldgorilla/models"
+	"github.com/pion/webrtc/v3"
+	"sort"
+)
+
+// forwardPolicy tells whose tracks a subscriber gets, a nil set means everyone's
+type forwardPolicy struct {
+	video map[uint64]bool
+	audio map[uint64]bool
+}
+
+func (p forwardPolicy) forwards(track *Track) bool {
+	if track.Kind == webrtc.RTPCodecTypeVideo {
+		return p.video == nil || p.video[track.OwnerId]
+	}
+	// audio without levels isn't ranked, it's always forwarded
+	return p.audio == nil || p.audio[track.OwnerId] || !track.audioLevels
+}
+
+// promoteSpeaker moves the peer to the front of the room's speaker order, the room lock must be held
+func (room *Room) promoteSpeaker(peerId uint64) {
+	room.forgetSpeaker(peerId)
+	room.speakerOrder = append([]uint64{peerId}, room.speakerOrder...)
+}
+
+// forgetSpeaker drops the peer from the room's speaker order, the room lock must be held
+func (room *Room) forgetSpeaker(peerId uint64) {
+	for i, id := range room.speakerOrder {
+		if id == peerId {
+			room.speakerOrder = append(room.speakerOrder[:i], room.speakerOrder[i+1:]...)
+			return
+		}
+	}
+}
+
+// speakerRanking lists the room's publishers for lastN, the most recent dominant speakers first and then the ones that haven't spoken yet by id.
+// the room lock and the track lock must be held.
+func (room *Room) speakerRanking() []uint64 {
+	publishers := make(map[uint64]bool)
+	for _, track := range room.Tracks {
+		publishers[track.OwnerId] = true
+	}
+	ranking := make([]uint64, 0, len(publishers))
+	for _, peerId := range room.speakerOrder {
+		if publishers[peerId] {
+			ranking = append(ranking, peerId)
+			delete(publishers, peerId)
+		}
+	}
+	silent := make([]uint64, 0, len(publishers))
+	for peerId := range publishers {
+		silent = append(silent, peerId)
+	}
+	sort.Slice(silent, func(i, j int) bool {
+		return silent[i] < silent[j]
+	})
+	return append(ranking, silent...)
+}
+
+// forwardPolicyFor picks the lastN speakers (plus the pinned peers) whose video the subscriber gets and the topKAudio
+// loudest speakers it hears, the subscriber itself doesn't take a place.
+func (r *RoomRepository) forwardPolicyFor(ranking []uint64, audible audibleSpeakers, subscriber *Peer) forwardPolicy {
+	policy := forwardPolicy{}
+	if r.conf.LastN > 0 {
+		policy.video = topSpeakers(ranking, subscriber.ID, r.conf.LastN)
+		for peerId := range subscriber.pinned {
+			policy.video[peerId] = true
+		}
+	}
+	if r.conf.TopKAudio > 0 {
+		policy.audio = audible.heardBy(subscriber.ID)
+	}
+	return policy
+}
+
+func topSpeakers(ranking []uint64, subscriberId uint64, n uint) map[uint64]bool {
+	top := make(map[uint64]bool, n)
+	for _, peerId := range ranking {
+		if uint(len(top)) == n {
+			break
+		}
+		if peerId != subscriberId {
+			top[peerId] = true
+		}
+	}
+	return top
+}
+
+// SetPeerPins replaces the peers whose video the peer gets whether they're among the room's last speakers or not
+func (r *RoomRepository) SetPeerPins(roomId string, id uint64, pinned []uint64) error {
+	r.Lock()
+	if !r.doesRoomExists(roomId) {
+		r.Unlock()
+		return models.NewError("room doesn't exists", 403, map[string]any{"roomId": roomId})
+	}
+	room := r.Rooms[roomId]
+	r.Unlock()
+	room.Lock()
+	if !r.doesPeerExists(roomId, id) {
+		room.Unlock()
+		return models.NewError("no such a peer with this id in this room", 403, map[string]any{"roomId": roomId, "peerId": id})
+	}
+	peer := room.Peers[id]
+	peer.pinned = make(map[uint64]bool, len(pinned))
+	for _, peerId := range pinned {
+		if peerId != id {
+			peer.pinned[peerId] = true
+		}
+	}
+	room.Unlock()
+	peer.log.Debug("pinned peers set", "pinned", pinned)
+	if r.conf.LastN > 0 {
+		go r.updatePCTracks(roomId)
+	}
+	return nil
+}
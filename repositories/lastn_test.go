@@ -0,0 +1,137 @@
+package repositories
+
+import (
+	"github.com/pion/webrtc/v3"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// speak makes the peer's smoothed level settle on the level (in -dBov)
+func speak(d *speakerDetector, peerId uint64, level uint8) {
+	for i := 0; i < 100; i++ {
+		d.observe(peerId, level)
+	}
+}
+
+// expireHolds makes every place held by the detector as old as the hold time allows and a bit more
+func expireHolds(d *speakerDetector) {
+	for _, held := range []map[uint64]time.Time{d.audible, d.runnerUp} {
+		for peerId := range held {
+			held[peerId] = held[peerId].Add(-speakerAudibleHold - time.Millisecond)
+		}
+	}
+}
+
+func peerSet(ids ...uint64) map[uint64]bool {
+	set := make(map[uint64]bool, len(ids))
+	for _, id := range ids {
+		set[id] = true
+	}
+	return set
+}
+
+func TestUpdateAudiblePicksTheLoudest(t *testing.T) {
+	d := newSpeakerDetector()
+	speak(d, 1, 30)
+	speak(d, 2, 100)
+	speak(d, 3, 40)
+	if !d.updateAudible(peerSet(1, 2, 3), 2) {
+		t.Fatal("the first pick should be a change")
+	}
+	audible := d.audiblePeers()
+	if !reflect.DeepEqual(audible.top, peerSet(1, 3)) || !reflect.DeepEqual(audible.runnerUp, peerSet(2)) {
+		t.Fatalf("got top %v and runner-up %v", audible.top, audible.runnerUp)
+	}
+	if d.updateAudible(peerSet(1, 2, 3), 2) {
+		t.Fatal("nothing changed")
+	}
+}
+
+func TestUpdateAudibleHoldsPlaces(t *testing.T) {
+	d := newSpeakerDetector()
+	speak(d, 1, 30)
+	speak(d, 2, 40)
+	speak(d, 3, 100)
+	d.updateAudible(peerSet(1, 2, 3), 2)
+
+	// 3 gets louder than 2 but 2 keeps its place until the hold time is over
+	speak(d, 3, 10)
+	speak(d, 2, 120)
+	if d.updateAudible(peerSet(1, 2, 3), 2) {
+		t.Fatalf("the pick changed within the hold time: %v", d.audiblePeers().top)
+	}
+	expireHolds(d)
+	speak(d, 1, 30)
+	if !d.updateAudible(peerSet(1, 2, 3), 2) {
+		t.Fatal("the pick should change once the hold time is over")
+	}
+	if top := d.audiblePeers().top; !reflect.DeepEqual(top, peerSet(1, 3)) {
+		t.Fatalf("got %v", top)
+	}
+}
+
+func TestUpdateAudibleFreesPlacesOfLeavers(t *testing.T) {
+	d := newSpeakerDetector()
+	speak(d, 1, 30)
+	speak(d, 2, 40)
+	speak(d, 3, 100)
+	d.updateAudible(peerSet(1, 2, 3), 2)
+	if !d.updateAudible(peerSet(2, 3), 2) {
+		t.Fatal("a publisher left")
+	}
+	if top := d.audiblePeers().top; !reflect.DeepEqual(top, peerSet(2, 3)) {
+		t.Fatalf("got %v, the free place should be taken right away", top)
+	}
+}
+
+func TestAudibleSpeakersHeardBy(t *testing.T) {
+	audible := audibleSpeakers{top: peerSet(1, 2), runnerUp: peerSet(3)}
+	if heard := audible.heardBy(4); !reflect.DeepEqual(heard, peerSet(1, 2)) {
+		t.Fatalf("a listener hears %v", heard)
+	}
+	if heard := audible.heardBy(1); !reflect.DeepEqual(heard, peerSet(2, 3)) {
+		t.Fatalf("a speaker among the loudest hears %v, the runner-up should take its place", heard)
+	}
+}
+
+func TestTopSpeakers(t *testing.T) {
+	ranking := []uint64{5, 3, 1, 4}
+	if top := topSpeakers(ranking, 9, 2); !reflect.DeepEqual(top, peerSet(5, 3)) {
+		t.Fatalf("got %v", top)
+	}
+	if top := topSpeakers(ranking, 3, 2); !reflect.DeepEqual(top, peerSet(5, 1)) {
+		t.Fatalf("got %v, the subscriber shouldn't take a place", top)
+	}
+	if top := topSpeakers(ranking, 9, 10); !reflect.DeepEqual(top, peerSet(5, 3, 1, 4)) {
+		t.Fatalf("got %v", top)
+	}
+}
+
+func TestForwardPolicyFor(t *testing.T) {
+	conf := testConfig()
+	conf.LastN = 1
+	conf.TopKAudio = 1
+	r := &RoomRepository{conf: conf}
+	subscriber := &Peer{ID: 1, pinned: peerSet(4)}
+	policy := r.forwardPolicyFor([]uint64{1, 2, 3, 4}, audibleSpeakers{top: peerSet(1), runnerUp: peerSet(3)}, subscriber)
+	if !reflect.DeepEqual(policy.video, peerSet(2, 4)) {
+		t.Fatalf("video from %v, want the last speaker but the subscriber and the pinned peer", policy.video)
+	}
+	if !reflect.DeepEqual(policy.audio, peerSet(3)) {
+		t.Fatalf("audio from %v, want the runner-up", policy.audio)
+	}
+
+	video := &Track{OwnerId: 3, Kind: webrtc.RTPCodecTypeVideo}
+	ranked := &Track{OwnerId: 2, Kind: webrtc.RTPCodecTypeAudio, audioLevels: true}
+	unranked := &Track{OwnerId: 2, Kind: webrtc.RTPCodecTypeAudio}
+	if policy.forwards(video) || policy.forwards(ranked) {
+		t.Fatal("tracks of peers left out are forwarded")
+	}
+	if !policy.forwards(unranked) {
+		t.Fatal("audio without levels should always be forwarded")
+	}
+	if !(forwardPolicy{}).forwards(ranked) {
+		t.Fatal("without limits everything should be forwarded")
+	}
+}
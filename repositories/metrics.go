@@ -0,0 +1,78 @@
+package repositories
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	forwardedBytes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "goldgorilla_forwarded_bytes_total",
+		Help: "Bytes of RTP forwarded to subscribers.",
+	}, []string{"kind"})
+	forwardedPackets = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "goldgorilla_forwarded_packets_total",
+		Help: "RTP packets forwarded to subscribers.",
+	}, []string{"kind"})
+	trackWriteFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "goldgorilla_track_write_failures_total",
+		Help: "Failed writes to the local tracks of subscribers.",
+	}, []string{"kind"})
+	plisSent = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "goldgorilla_plis_sent_total",
+		Help: "Picture loss indications sent to publishers.",
+	}, []string{"reason"})
+	offerAnswerLatency = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name: "goldgorilla_offer_answer_seconds",
+		Help: "Time between sending an offer to logjam and getting its answer.",
+	})
+	iceRecoveries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "goldgorilla_ice_recoveries_total",
+		Help: "Peers that lost their connection, by whether they got it back within the grace period.",
+	}, []string{"outcome"})
+	rejoinDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name: "goldgorilla_rejoin_seconds",
+		Help: "How long joining or rejoining a room through logjam took, by mode and outcome.",
+	}, []string{"mode", "outcome"})
+)
+
+// RegisterMetrics exposes how many rooms, peers and tracks the repository holds on the registerer, they are counted on every scrape
+func (r *RoomRepository) RegisterMetrics(registerer prometheus.Registerer) error {
+	gauges := []struct {
+		name  string
+		help  string
+		value func() float64
+	}{
+		{"goldgorilla_rooms", "Rooms goldgorilla is in.", func() float64 {
+			rooms, _, _ := r.count()
+			return float64(rooms)
+		}},
+		{"goldgorilla_peers", "Peer connections across all rooms.", func() float64 {
+			_, peers, _ := r.count()
+			return float64(peers)
+		}},
+		{"goldgorilla_tracks", "Tracks forwarded across all rooms.", func() float64 {
+			_, _, tracks := r.count()
+			return float64(tracks)
+		}},
+	}
+	for _, gauge := range gauges {
+		err := registerer.Register(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: gauge.name,
+			Help: gauge.help,
+		}, gauge.value))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *RoomRepository) count() (rooms int, peers int, tracks int) {
+	for _, room := range r.ListRooms() {
+		rooms++
+		peers += room.PeerCount
+		tracks += room.TrackCount
+	}
+	return
+}
@@ -0,0 +1,33 @@
+package repositories
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"testing"
+)
+
+func TestRegisterMetrics(t *testing.T) {
+	repo, _ := newTestRepository(t)
+	if err := repo.CreatePeer(testRoomId, 1, true, false, 7); err != nil {
+		t.Fatal(err)
+	}
+	registry := prometheus.NewRegistry()
+	if err := repo.RegisterMetrics(registry); err != nil {
+		t.Fatal(err)
+	}
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	values := make(map[string]float64)
+	for _, family := range families {
+		values[family.GetName()] = family.GetMetric()[0].GetGauge().GetValue()
+	}
+	if values["goldgorilla_rooms"] != 1 || values["goldgorilla_peers"] != 1 || values["goldgorilla_tracks"] != 0 {
+		t.Fatalf("got %v", values)
+	}
+
+	other, _ := newTestRepository(t)
+	if err := other.RegisterMetrics(registry); err == nil {
+		t.Fatal("a second repository shouldn't be able to register the same gauges")
+	}
+}
@@ -0,0 +1,195 @@
+package repositories
+
+import (
+	"codeberg.org/greatape/goldgorilla/models"
+	"github.com/pion/webrtc/v3"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// maxOfferAttempts is how many times an offer is sent before it's given up on
+const maxOfferAttempts = 3
+
+// negotiator runs a peer's offer/answer exchanges with logjam one at a time: changes made while an offer is in flight
+// are merged into one follow-up offer and unanswered offers are sent again when they time out.
+// pion can't roll a local offer back, so goldgorilla never rolls back: an offer of the peer that collides with ours is
+// refused with 409 and logjam has to roll its own back, and once an offer can't be answered any more the peer's
+// connection is closed, the rest of the room isn't touched.
+type negotiator struct {
+	lock    *sync.Mutex
+	conn    *webrtc.PeerConnection
+	log     *slog.Logger
+	timeout time.Duration
+	// send hands an offer to logjam
+	send func(offer webrtc.SessionDescription) error
+
+	// offer is the offer waiting for its answer, nil when there's none
+	offer       *webrtc.SessionDescription
+	offerSentAt time.Time
+	// attempts counts the offers sent since the last answer
+	attempts uint
+	timer    *time.Timer
+	// pending is set when something changed while an offer was in flight
+	pending bool
+	// iceRestart makes the next offer restart ice
+	iceRestart bool
+}
+
+func newNegotiator(conn *webrtc.PeerConnection, log *slog.Logger, timeout time.Duration, send func(offer webrtc.SessionDescription) error) *negotiator {
+	return &negotiator{
+		lock:    &sync.Mutex{},
+		conn:    conn,
+		log:     log,
+		timeout: timeout,
+		send:    send,
+	}
+}
+
+// Negotiate sends a new offer, or leaves it for when the offer in flight is answered
+func (n *negotiator) Negotiate() error {
+	n.lock.Lock()
+	if n.offer != nil || n.conn.SignalingState() != webrtc.SignalingStateStable {
+		n.pending = true
+		n.lock.Unlock()
+		return nil
+	}
+	n.pending = false
+	n.log.Debug("negotiating", "iceRestart", n.iceRestart)
+	offer, err := n.conn.CreateOffer(&webrtc.OfferOptions{ICERestart: n.iceRestart})
+	if err != nil {
+		n.lock.Unlock()
+		return models.NewError(err.Error(), 500, models.MessageResponse{Message: err.Error()})
+	}
+	if err := n.conn.SetLocalDescription(offer); err != nil {
+		n.lock.Unlock()
+		return models.NewError(err.Error(), 500, models.MessageResponse{Message: err.Error()})
+	}
+	n.offer = &offer
+	n.iceRestart = false
+	n.lock.Unlock()
+	return n.sendOffer(offer)
+}
+
+// RestartICE negotiates new ice credentials for when the peer's network changed, through the offer in flight's follow-up if there's one
+func (n *negotiator) RestartICE() {
+	n.lock.Lock()
+	n.iceRestart = true
+	n.lock.Unlock()
+	n.renegotiate()
+}
+
+// sendOffer sends the offer without holding the lock, logjam may answer before the request returns
+func (n *negotiator) sendOffer(offer webrtc.SessionDescription) error {
+	n.lock.Lock()
+	n.attempts++
+	attempt := n.attempts
+	n.offerSentAt = time.Now()
+	if n.timer != nil {
+		n.timer.Stop()
+	}
+	n.timer = time.AfterFunc(n.timeout, func() {
+		n.onTimeout(offer, attempt)
+	})
+	n.lock.Unlock()
+	// when sending fails the timeout takes care of it like for a lost answer
+	return n.send(offer)
+}
+
+func (n *negotiator) onTimeout(offer webrtc.SessionDescription, attempt uint) {
+	n.lock.Lock()
+	if n.offer == nil || n.offer.SDP != offer.SDP || n.attempts != attempt || n.conn.ConnectionState() == webrtc.PeerConnectionStateClosed {
+		n.lock.Unlock()
+		return
+	}
+	// the offer can't be replaced without an answer, sending it again can't restart ice either
+	if n.attempts >= maxOfferAttempts || n.iceRestart {
+		n.offer = nil
+		n.pending = false
+		n.iceRestart = false
+		n.lock.Unlock()
+		n.log.Error("offer isn't answered, closing the peer connection", "attempts", attempt)
+		if err := n.conn.Close(); err != nil {
+			n.log.Error("can't close peer connection", "err", err)
+		}
+		return
+	}
+	// the changes made since are offered once it's answered
+	n.log.Warn("offer wasn't answered in time, sending it again", "attempt", attempt, "pending", n.pending)
+	n.lock.Unlock()
+	if err := n.sendOffer(offer); err != nil {
+		n.log.Error("can't send offer", "err", err)
+	}
+}
+
+func (n *negotiator) OnAnswer(answer webrtc.SessionDescription) error {
+	n.lock.Lock()
+	if n.offer == nil {
+		n.lock.Unlock()
+		return models.NewError("there's no offer waiting for an answer", 409, nil)
+	}
+	if err := n.conn.SetRemoteDescription(answer); err != nil {
+		n.lock.Unlock()
+		return models.NewError(err.Error(), 500, models.MessageResponse{Message: err.Error()})
+	}
+	offerAnswerLatency.Observe(time.Since(n.offerSentAt).Seconds())
+	n.offer = nil
+	n.attempts = 0
+	// the answer can beat sendOffer to arming the timer
+	if n.timer != nil {
+		n.timer.Stop()
+	}
+	pending := n.pending
+	n.lock.Unlock()
+	if pending {
+		go n.renegotiate()
+	}
+	return nil
+}
+
+// OnOffer answers an offer of the peer, when it collides with goldgorilla's own offer it's refused so the peer rolls back
+func (n *negotiator) OnOffer(offer webrtc.SessionDescription) (*webrtc.SessionDescription, error) {
+	n.lock.Lock()
+	if n.offer != nil {
+		n.lock.Unlock()
+		n.log.Info("refusing offer, it collides with ours")
+		return nil, models.NewError("the offer collides with goldgorilla's offer, answer that one first", 409, nil)
+	}
+	if err := n.conn.SetRemoteDescription(offer); err != nil {
+		n.lock.Unlock()
+		return nil, models.NewError(err.Error(), 500, models.MessageResponse{Message: err.Error()})
+	}
+	answer, err := n.conn.CreateAnswer(nil)
+	if err != nil {
+		n.lock.Unlock()
+		return nil, models.NewError(err.Error(), 500, models.MessageResponse{Message: err.Error()})
+	}
+	if err := n.conn.SetLocalDescription(answer); err != nil {
+		n.lock.Unlock()
+		return nil, models.NewError(err.Error(), 500, models.MessageResponse{Message: err.Error()})
+	}
+	pending := n.pending
+	n.lock.Unlock()
+	if pending {
+		go n.renegotiate()
+	}
+	return &answer, nil
+}
+
+// Stop drops whatever is in flight, it's called once the peer connection is closed
+func (n *negotiator) Stop() {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if n.timer != nil {
+		n.timer.Stop()
+	}
+	n.offer = nil
+	n.pending = false
+	n.iceRestart = false
+}
+
+func (n *negotiator) renegotiate() {
+	if err := n.Negotiate(); err != nil {
+		n.log.Error("can't renegotiate", "err", err)
+	}
+}
@@ -0,0 +1,214 @@
+package repositories
+
+import (
+	"codeberg.org/greatape/goldgorilla/models"
+	"codeberg.org/greatape/goldgorilla/models/dto"
+	"codeberg.org/greatape/goldgorilla/signaling"
+	"log/slog"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+type RejoinState string
+
+const (
+	RejoinStateIdle      RejoinState = "idle"
+	RejoinStateJoining   RejoinState = "joining"
+	RejoinStateJoined    RejoinState = "joined"
+	RejoinStateRejoining RejoinState = "rejoining"
+	RejoinStateGivenUp   RejoinState = "given-up"
+)
+
+type rejoinTask struct {
+	mode          models.RejoinMode
+	state         RejoinState
+	attempts      uint
+	lastErr       error
+	nextAttemptAt time.Time
+	cancel        chan struct{}
+}
+
+// RejoinRepository joins and rejoins rooms through the signaler, each room has its own state machine:
+// joining/rejoining is retried with exponential backoff and jitter until it works (joined), it runs out of attempts (given-up)
+// or the room is reset (idle).
+type RejoinRepository struct {
+	*sync.Mutex
+	conf     *models.ConfigModel
+	signaler signaling.Signaler
+	log      *slog.Logger
+	tasks    map[string]*rejoinTask
+}
+
+func NewRejoinRepository(conf *models.ConfigModel, signaler signaling.Signaler, log *slog.Logger) *RejoinRepository {
+	return &RejoinRepository{
+		Mutex:    &sync.Mutex{},
+		conf:     conf,
+		signaler: signaler,
+		log:      log,
+		tasks:    make(map[string]*rejoinTask),
+	}
+}
+
+// Start joins (or rejoins) the room in the background, whatever was going on for the room before is cancelled
+func (r *RejoinRepository) Start(mode models.RejoinMode) {
+	r.Lock()
+	defer r.Unlock()
+	r.cancel(mode.RoomId)
+	task := &rejoinTask{
+		mode:   mode,
+		state:  RejoinStateIdle,
+		cancel: make(chan struct{}),
+	}
+	r.tasks[mode.RoomId] = task
+	go r.run(task)
+}
+
+// Cancel stops joining the room and forgets about it, the room is idle afterwards
+func (r *RejoinRepository) Cancel(roomId string) {
+	r.Lock()
+	defer r.Unlock()
+	r.cancel(roomId)
+}
+
+func (r *RejoinRepository) CancelAll() {
+	r.Lock()
+	defer r.Unlock()
+	for roomId := range r.tasks {
+		r.cancel(roomId)
+	}
+}
+
+func (r *RejoinRepository) cancel(roomId string) {
+	task, exists := r.tasks[roomId]
+	if !exists {
+		return
+	}
+	close(task.cancel)
+	delete(r.tasks, roomId)
+}
+
+func (r *RejoinRepository) State(roomId string) dto.RejoinStateDTO {
+	r.Lock()
+	defer r.Unlock()
+	task, exists := r.tasks[roomId]
+	if !exists {
+		return dto.RejoinStateDTO{
+			RoomId: roomId,
+			State:  string(RejoinStateIdle),
+		}
+	}
+	return task.toDTO()
+}
+
+func (r *RejoinRepository) List() []dto.RejoinStateDTO {
+	r.Lock()
+	defer r.Unlock()
+	states := make([]dto.RejoinStateDTO, 0, len(r.tasks))
+	for _, task := range r.tasks {
+		states = append(states, task.toDTO())
+	}
+	sort.Slice(states, func(i, j int) bool {
+		return states[i].RoomId < states[j].RoomId
+	})
+	return states
+}
+
+func (r *RejoinRepository) run(task *rejoinTask) {
+	roomId := task.mode.RoomId
+	log := r.log.With("roomId", roomId)
+	state, mode, attempt := RejoinStateRejoining, "rejoin", r.signaler.Rejoin
+	if task.mode.SimplyJoin {
+		state, mode, attempt = RejoinStateJoining, "join", r.signaler.Join
+	}
+	for {
+		r.Lock()
+		if isCancelled(task) {
+			r.Unlock()
+			return
+		}
+		task.state = state
+		task.attempts++
+		task.nextAttemptAt = time.Time{}
+		r.Unlock()
+
+		startedAt := time.Now()
+		err := attempt(roomId)
+		outcome := "ok"
+		if err != nil {
+			outcome = "error"
+		}
+		rejoinDuration.WithLabelValues(mode, outcome).Observe(time.Since(startedAt).Seconds())
+
+		r.Lock()
+		if isCancelled(task) {
+			r.Unlock()
+			return
+		}
+		if err == nil {
+			task.state = RejoinStateJoined
+			task.lastErr = nil
+			r.Unlock()
+			log.Info("room "+mode+"ed", "attempts", task.attempts)
+			return
+		}
+		task.lastErr = err
+		if task.attempts >= r.conf.Retry.JoinAttempts {
+			task.state = RejoinStateGivenUp
+			r.Unlock()
+			log.Error("giving up on room", "mode", mode, "attempts", task.attempts, "err", err)
+			return
+		}
+		delay := r.backoff(task.attempts)
+		task.nextAttemptAt = time.Now().Add(delay)
+		r.Unlock()
+		log.Warn("can't "+mode+" room, retrying", "attempt", task.attempts, "retryIn", delay, "err", err)
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-task.cancel:
+			timer.Stop()
+			return
+		}
+	}
+}
+
+// backoff doubles the delay with every failed attempt up to JoinMaxDelay, the actual delay is picked between half of it and all of it
+// so rooms that failed together don't retry together.
+func (r *RejoinRepository) backoff(attempts uint) time.Duration {
+	delay := r.conf.Retry.JoinDelay
+	for i := uint(1); i < attempts && delay < r.conf.Retry.JoinMaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > r.conf.Retry.JoinMaxDelay {
+		delay = r.conf.Retry.JoinMaxDelay
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+func isCancelled(task *rejoinTask) bool {
+	select {
+	case <-task.cancel:
+		return true
+	default:
+		return false
+	}
+}
+
+func (task *rejoinTask) toDTO() dto.RejoinStateDTO {
+	state := dto.RejoinStateDTO{
+		RoomId:   task.mode.RoomId,
+		State:    string(task.state),
+		Attempts: task.attempts,
+	}
+	if task.lastErr != nil {
+		state.LastError = task.lastErr.Error()
+	}
+	if !task.nextAttemptAt.IsZero() {
+		nextAttemptAt := task.nextAttemptAt
+		state.NextAttemptAt = &nextAttemptAt
+	}
+	return state
+}
@@ -0,0 +1,131 @@
+package repositories
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"codeberg.org/greatape/goldgorilla/models"
+	"codeberg.org/greatape/goldgorilla/signaling"
+	"sync"
+	"testing"
+	"time"
+)
+
+// flakySignaler fails the first joins and rejoins, the rest works
+type flakySignaler struct {
+	*signaling.MemorySignaler
+	lock     sync.Mutex
+	failures int
+	attempts int
+}
+
+func (s *flakySignaler) Join(roomId string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.attempts++
+	if s.attempts <= s.failures {
+		return errors.New("logjam is down")
+	}
+	return nil
+}
+
+func (s *flakySignaler) Rejoin(roomId string) error {
+	return s.Join(roomId)
+}
+
+func newTestRejoins(t *testing.T, failures int) (*RejoinRepository, *flakySignaler) {
+	t.Helper()
+	conf := testConfig()
+	conf.Retry.JoinDelay = time.Millisecond
+	conf.Retry.JoinMaxDelay = 4 * time.Millisecond
+	conf.Retry.JoinAttempts = 4
+	signaler := &flakySignaler{MemorySignaler: signaling.NewMemorySignaler(), failures: failures}
+	rejoins := NewRejoinRepository(conf, signaler, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	t.Cleanup(rejoins.CancelAll)
+	return rejoins, signaler
+}
+
+func waitForRejoinState(t *testing.T, rejoins *RejoinRepository, state RejoinState) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for rejoins.State(testRoomId).State != string(state) {
+		if time.Now().After(deadline) {
+			t.Fatalf("room is %s, want %s", rejoins.State(testRoomId).State, state)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	rejoins, _ := newTestRejoins(t, 0)
+	rejoins.conf.Retry.JoinDelay = 4 * time.Second
+	rejoins.conf.Retry.JoinMaxDelay = 30 * time.Second
+	cases := []struct {
+		attempts uint
+		delay    time.Duration
+	}{
+		{1, 4 * time.Second},
+		{2, 8 * time.Second},
+		{3, 16 * time.Second},
+		{4, 30 * time.Second},
+		{40, 30 * time.Second},
+	}
+	for _, c := range cases {
+		for i := 0; i < 100; i++ {
+			if delay := rejoins.backoff(c.attempts); delay < c.delay/2 || delay > c.delay {
+				t.Fatalf("backoff after %d attempts is %s, want between %s and %s", c.attempts, delay, c.delay/2, c.delay)
+			}
+		}
+	}
+}
+
+func TestRejoinRetriesUntilJoined(t *testing.T) {
+	rejoins, signaler := newTestRejoins(t, 2)
+	rejoins.Start(models.RejoinMode{SimplyJoin: true, RoomId: testRoomId})
+	waitForRejoinState(t, rejoins, RejoinStateJoined)
+	state := rejoins.State(testRoomId)
+	if state.Attempts != 3 || len(state.LastError) > 0 || state.NextAttemptAt != nil {
+		t.Fatalf("got %+v, want joined on the third attempt", state)
+	}
+	signaler.lock.Lock()
+	defer signaler.lock.Unlock()
+	if signaler.attempts != 3 {
+		t.Fatalf("tried %d times, want 3", signaler.attempts)
+	}
+}
+
+func TestRejoinGivesUp(t *testing.T) {
+	rejoins, _ := newTestRejoins(t, 100)
+	rejoins.Start(models.RejoinMode{RoomId: testRoomId})
+	waitForRejoinState(t, rejoins, RejoinStateGivenUp)
+	state := rejoins.State(testRoomId)
+	if state.Attempts != 4 || state.LastError != "logjam is down" {
+		t.Fatalf("got %+v, want given up after 4 attempts with logjam's error", state)
+	}
+}
+
+func TestRejoinCancel(t *testing.T) {
+	rejoins, signaler := newTestRejoins(t, 100)
+	rejoins.conf.Retry.JoinDelay = time.Hour
+	rejoins.conf.Retry.JoinMaxDelay = time.Hour
+	rejoins.Start(models.RejoinMode{RoomId: testRoomId})
+	deadline := time.Now().Add(5 * time.Second)
+	for rejoins.State(testRoomId).NextAttemptAt == nil {
+		if time.Now().After(deadline) {
+			t.Fatal("the first attempt didn't fail")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	rejoins.Cancel(testRoomId)
+	if state := rejoins.State(testRoomId); state.State != string(RejoinStateIdle) || state.Attempts != 0 {
+		t.Fatalf("got %+v, want the room forgotten", state)
+	}
+	if len(rejoins.List()) != 0 {
+		t.Fatalf("still tracking %v", rejoins.List())
+	}
+	signaler.lock.Lock()
+	defer signaler.lock.Unlock()
+	if signaler.attempts != 1 {
+		t.Fatalf("tried %d times, want 1", signaler.attempts)
+	}
+}
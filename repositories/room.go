@@ -1,58 +1,120 @@
 package repositories
 
 import (
-	"bytes"
-	"encoding/json"
 	"errors"
-	"fmt"
 	"github.com/pion/interceptor"
-	"github.com/pion/rtcp"
+	"github.com/pion/interceptor/pkg/cc"
+	"github.com/pion/rtp"
+	"github.com/pion/sdp/v3"
 	"github.com/pion/webrtc/v3"
+	"log/slog"
 	"net"
-	"net/http"
-	"codeberg.org/goldgorilla/logjam/models"
-	"codeberg.org/goldgorilla/logjam/models/dto"
+	"codeberg.org/greatape/goldgorilla/models"
+	"codeberg.org/greatape/goldgorilla/models/dto"
+	"codeberg.org/greatape/goldgorilla/signaling"
+	"codeberg.org/greatape/goldgorilla/store"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
-type Track struct {
-	OwnerId    uint64
-	TrackLocal *webrtc.TrackLocalStaticRTP
-}
+type PeerSource string
+
+const (
+	// PeerSourceLogjam peers are negotiated through logjam
+	PeerSourceLogjam PeerSource = "logjam"
+	// PeerSourceWHIP peers only publish, they are negotiated once over WHIP
+	PeerSourceWHIP PeerSource = "whip"
+	// PeerSourceWHEP peers only watch, they are negotiated once over WHEP and the room's tracks are swapped into the m-lines they offered
+	PeerSourceWHEP PeerSource = "whep"
+)
 
 type Peer struct {
 	ID                     uint64
 	Conn                   *webrtc.PeerConnection
 	CanPublish             bool
 	IsCaller               bool
-	HandshakeLock          *sync.Mutex
+	Source                 PeerSource
 	gotFirstVideoTrack     bool
 	gotFirstAudioTrack     bool
 	triggeredReconnectOnce bool
+	tracks                 map[string]*Track
+	// negotiator runs the offer/answer exchanges with logjam, nil for WHIP/WHEP peers
+	negotiator *negotiator
+	// slots are the m-lines of a WHEP viewer
+	slots []*whepSlot
+	// iceGraceTimer closes the peer connection unless it reconnects first, nil while it's connected
+	iceGraceTimer *time.Timer
+	// speakerChannel carries the dominant speaker changes to logjam peers
+	speakerChannel *webrtc.DataChannel
+	// pinned are the peers whose video is forwarded to this one whatever lastN says
+	pinned    map[uint64]bool
+	estimator cc.BandwidthEstimator
+	log       *slog.Logger
 }
 
 type Room struct {
 	*sync.Mutex
-	Peers     map[uint64]*Peer
-	trackLock *sync.Mutex
-	Tracks    map[string]*Track
-	timer     *time.Ticker
-	ggId      uint64
+	Peers      map[uint64]*Peer
+	trackLock  *sync.Mutex
+	Tracks     map[string]*Track
+	layerTimer *time.Ticker
+	// feedbackTimer paces the REMBs sent to publishers
+	feedbackTimer *time.Ticker
+	speakerTimer  *time.Ticker
+	// done is closed when the room is reset or closed, it ends the loops driven by the tickers
+	done     chan struct{}
+	speakers *speakerDetector
+	// speakerOrder has the peers that were the dominant speaker, the most recent first, it ranks them for lastN
+	speakerOrder []uint64
+	ggId         uint64
+	log          *slog.Logger
+}
+
+// stop stops the room's tickers and the loops they drive, the room lock must be held
+func (room *Room) stop() {
+	room.layerTimer.Stop()
+	room.feedbackTimer.Stop()
+	room.speakerTimer.Stop()
+	select {
+	case <-room.done:
+	default:
+		close(room.done)
+	}
 }
 
 type RoomRepository struct {
-	api   *webrtc.API
-	Rooms map[string]*Room
-	conf  *models.ConfigModel
+	api      *webrtc.API
+	Rooms    map[string]*Room
+	conf     *models.ConfigModel
+	signaler signaling.Signaler
 	*sync.Mutex
+	// pcLock makes sure an estimator from estimatorCH belongs to the peer connection that was just created
+	pcLock      *sync.Mutex
+	estimatorCH chan cc.BandwidthEstimator
+	log         *slog.Logger
+	// iceServers starts as conf.ICEServers and gets swapped when they are reloaded
+	iceServers atomic.Pointer[[]webrtc.ICEServer]
+	// draining is set once goldgorilla is shutting down, no new rooms are created from then on
+	draining atomic.Bool
+	// store keeps the rooms across restarts, nil when it's disabled
+	store      store.Store
+	snapshotCH chan struct{}
+	rejoins    *RejoinRepository
 }
 
-func NewRoomRepository(conf *models.ConfigModel) *RoomRepository {
+// NewRoomRepository creates the repository, roomStore can be nil to not keep the rooms across restarts
+func NewRoomRepository(conf *models.ConfigModel, signaler signaling.Signaler, rejoins *RejoinRepository, roomStore store.Store, log *slog.Logger) *RoomRepository {
 	settingEngine := webrtc.SettingEngine{}
-	if len(conf.CustomICEHostCandidateIP) > 0 {
-		settingEngine.SetNAT1To1IPs([]string{conf.CustomICEHostCandidateIP}, webrtc.ICECandidateTypeHost)
+	if len(conf.NAT1To1IPs) > 0 {
+		settingEngine.SetNAT1To1IPs(conf.NAT1To1IPs, webrtc.ICECandidateTypeHost)
 	}
+	if conf.UDPPortMin > 0 {
+		if err := settingEngine.SetEphemeralUDPPortRange(conf.UDPPortMin, conf.UDPPortMax); err != nil {
+			panic(err)
+		}
+	}
+	settingEngine.SetICETimeouts(conf.Timeouts.ICEDisconnected, conf.Timeouts.ICEFailed, conf.Timeouts.ICEKeepalive)
 	settingEngine.SetNetworkTypes([]webrtc.NetworkType{
 		webrtc.NetworkTypeTCP6,
 		webrtc.NetworkTypeUDP6,
@@ -66,29 +128,67 @@ func NewRoomRepository(conf *models.ConfigModel) *RoomRepository {
 	if err != nil {
 		panic(err)
 	}
-	fmt.Printf("Listening for ICE TCP at %s\n", tcpListener.Addr())
+	log.Info("listening for ice tcp", "addr", tcpListener.Addr().String())
 
 	tcpMux := webrtc.NewICETCPMux(nil, tcpListener, 64)
 	settingEngine.SetICETCPMux(tcpMux)
 
 	m := &webrtc.MediaEngine{}
-	if err := m.RegisterDefaultCodecs(); err != nil {
+	if err := registerCodecs(m, conf.Codecs); err != nil {
+		panic(err)
+	}
+	// needed to receive simulcast, layers are told apart by their rid
+	for _, extension := range []string{sdp.SDESMidURI, sdp.SDESRTPStreamIDURI} {
+		if err := m.RegisterHeaderExtension(webrtc.RTPHeaderExtensionCapability{URI: extension}, webrtc.RTPCodecTypeVideo); err != nil {
+			panic(err)
+		}
+	}
+	// publishers put their audio levels in the packets, the dominant speaker is picked from them. it's only for receiving,
+	// goldgorilla doesn't write it and the packets it forwards lose the publisher's extensions (see downTrack.write)
+	if err := m.RegisterHeaderExtension(webrtc.RTPHeaderExtensionCapability{URI: sdp.AudioLevelURI}, webrtc.RTPCodecTypeAudio, webrtc.RTPTransceiverDirectionRecvonly); err != nil {
 		panic(err)
 	}
 
 	i := &interceptor.Registry{}
-	if err := webrtc.RegisterDefaultInterceptors(m, i); err != nil {
+	if err := registerInterceptors(m, i); err != nil {
+		panic(err)
+	}
+	estimatorCH := make(chan cc.BandwidthEstimator, 1)
+	if err := registerBandwidthEstimator(m, i, estimatorCH); err != nil {
 		panic(err)
 	}
 
 	api := webrtc.NewAPI(webrtc.WithMediaEngine(m), webrtc.WithInterceptorRegistry(i), webrtc.WithSettingEngine(settingEngine))
 
-	return &RoomRepository{
-		api:   api,
-		Mutex: &sync.Mutex{},
-		Rooms: make(map[string]*Room),
-		conf:  conf,
-	}
+	r := &RoomRepository{
+		api:      api,
+		Mutex:    &sync.Mutex{},
+		Rooms:    make(map[string]*Room),
+		conf:     conf,
+		signaler: signaler,
+
+		pcLock:      &sync.Mutex{},
+		estimatorCH: estimatorCH,
+		log:         log,
+		store:       roomStore,
+		snapshotCH:  make(chan struct{}, 1),
+		rejoins:     rejoins,
+	}
+	r.SetICEServers(conf.ICEServers)
+	if roomStore != nil {
+		go r.runSnapshots()
+	}
+	return r
+}
+
+// ICEServers returns the ice servers new peer connections get
+func (r *RoomRepository) ICEServers() []webrtc.ICEServer {
+	return *r.iceServers.Load()
+}
+
+// SetICEServers swaps the ice servers, peer connections that already exist keep the ones they got
+func (r *RoomRepository) SetICEServers(iceServers []webrtc.ICEServer) {
+	r.iceServers.Store(&iceServers)
 }
 
 func (r *RoomRepository) DoesRoomExists(id string) bool {
@@ -119,55 +219,89 @@ func (r *RoomRepository) CreatePeer(roomId string, id uint64, canPublish bool, i
 	r.Lock()
 
 	if !r.doesRoomExists(roomId) {
+		if r.IsDraining() {
+			r.Unlock()
+			return models.NewError("goldgorilla is draining, it doesn't take new rooms", 503, map[string]any{"roomId": roomId})
+		}
 		room := &Room{
-			Mutex:     &sync.Mutex{},
-			Peers:     make(map[uint64]*Peer),
-			trackLock: &sync.Mutex{},
-			Tracks:    make(map[string]*Track),
-			timer:     time.NewTicker(3 * time.Second),
-			ggId:      ggid,
+			Mutex:      &sync.Mutex{},
+			Peers:      make(map[uint64]*Peer),
+			trackLock:  &sync.Mutex{},
+			Tracks:     make(map[string]*Track),
+			layerTimer: time.NewTicker(layerPolicyInterval),
+			ggId:       ggid,
+
+			feedbackTimer: time.NewTicker(publisherFeedbackInterval),
+			speakerTimer:  time.NewTicker(speakerInterval),
+			done:          make(chan struct{}),
+			speakers:      newSpeakerDetector(),
+			log:           r.log.With("roomId", roomId, "ggId", ggid),
 		}
 		r.Rooms[roomId] = room
-		go func() {
-			for range room.timer.C {
-				room.Lock()
-				for _, peer := range room.Peers {
-					for _, receiver := range peer.Conn.GetReceivers() {
-						if receiver.Track() == nil {
-							continue
-						}
-
-						go func(peerConn *webrtc.PeerConnection, recv *webrtc.RTPReceiver) {
-							err := peerConn.WriteRTCP([]rtcp.Packet{
-								&rtcp.PictureLossIndication{
-									MediaSSRC: uint32(recv.Track().SSRC()),
-								},
-							})
-							if err != nil {
-								println(`[E] [rtcp][PLI] `, err.Error())
-							}
-						}(peer.Conn, receiver)
-					}
-
-				}
-				room.Unlock()
-			}
-		}()
+		go r.runLayerPolicy(room)
+		go r.runPublisherFeedback(room)
+		go r.runSpeakerDetection(roomId, room)
 	}
 
 	room := r.Rooms[roomId]
 	r.Unlock()
 
-	peerConn, err := r.api.NewPeerConnection(webrtc.Configuration{
-		ICEServers: r.conf.ICEServers,
-	})
+	peerConn, estimator, err := r.newPeerConnection(roomId, id, isCaller)
 	if err != nil {
-		return models.NewError("can't create peer connection", 500, models.MessageResponse{Message: err.Error()})
+		return err
 	}
 
 	peerConn.OnICECandidate(func(ic *webrtc.ICECandidate) {
 		r.onPeerICECandidate(roomId, id, room.ggId, ic)
 	})
+	speakerChannel, err := peerConn.CreateDataChannel(speakerChannelLabel, nil)
+	if err != nil {
+		_ = peerConn.Close()
+		return models.NewError("can't create speakers data channel", 500, models.MessageResponse{Message: err.Error()})
+	}
+	/*peerConn.OnNegotiationNeeded(func() {
+		println("[PC] negotiating with peer", id)
+		r.offerPeer(peerConn,roomId,id)
+	})*/
+	room.Lock()
+	defer room.Unlock()
+	log := room.log.With("peerId", id)
+	room.Peers[id] = &Peer{
+		ID:         id,
+		Conn:       peerConn,
+		CanPublish: canPublish,
+		IsCaller:   isCaller,
+		Source:     PeerSourceLogjam,
+		tracks:     make(map[string]*Track),
+		negotiator: newNegotiator(peerConn, log, r.conf.Timeouts.Negotiation, r.offerSender(roomId, id)),
+		estimator:  estimator,
+		log:        log,
+
+		speakerChannel: speakerChannel,
+	}
+	r.snapshotChanged()
+	go r.updatePCTracks(roomId)
+	return nil
+}
+
+// newPeerConnection creates a peer connection wired to the room, signaling (ice candidates, negotiation) is up to the caller
+func (r *RoomRepository) newPeerConnection(roomId string, id uint64, isCaller bool) (*webrtc.PeerConnection, cc.BandwidthEstimator, error) {
+	r.pcLock.Lock()
+	peerConn, err := r.api.NewPeerConnection(webrtc.Configuration{
+		ICEServers: r.iceServersFor(id),
+	})
+	if err != nil {
+		select {
+		case <-r.estimatorCH:
+		default:
+		}
+		r.pcLock.Unlock()
+		return nil, nil, models.NewError("can't create peer connection", 500, models.MessageResponse{Message: err.Error()})
+	}
+	// the congestion controller hands over the estimator while the peer connection is being built
+	estimator := <-r.estimatorCH
+	r.pcLock.Unlock()
+
 	peerConn.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
 		r.Lock()
 		if !r.doesRoomExists(roomId) {
@@ -186,65 +320,45 @@ func (r *RoomRepository) CreatePeer(roomId string, id uint64, canPublish bool, i
 				if stillThere && peer.triggeredReconnectOnce {
 					return
 				}
-				go r.onCallerDisconnected(roomId)
+				go r.rejoinRoom(roomId)
 			}
 		}
 	})
 	peerConn.OnTrack(func(remote *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
 		r.onPeerTrack(roomId, id, remote, receiver)
 	})
-	/*peerConn.OnNegotiationNeeded(func() {
-		println("[PC] negotiating with peer", id)
-		r.offerPeer(peerConn,roomId,id)
-	})*/
-	room.Lock()
-	defer room.Unlock()
-	room.Peers[id] = &Peer{
-		ID:            id,
-		Conn:          peerConn,
-		HandshakeLock: &sync.Mutex{},
-		CanPublish:    canPublish,
-		IsCaller:      isCaller,
-	}
-	go r.updatePCTracks(roomId)
-	return nil
+	return peerConn, estimator, nil
 }
 
-func (r *RoomRepository) onCallerDisconnected(roomId string) {
+// rejoinRoom resets the room and has logjam send it again through the rejoin state machine
+func (r *RoomRepository) rejoinRoom(roomId string) {
 	if _, err := r.ResetRoom(roomId); err != nil {
-		println(err.Error())
+		r.log.Error("can't reset room to rejoin it", "roomId", roomId, "err", err)
+		return
+	}
+	if r.IsDraining() {
 		return
 	}
-	*r.conf.StartRejoinCH <- models.RejoinMode{
+	r.rejoins.Start(models.RejoinMode{
 		SimplyJoin: false,
 		RoomId:     roomId,
-	}
+	})
 }
 
 func (r *RoomRepository) onPeerICECandidate(roomId string, id, ggid uint64, ic *webrtc.ICECandidate) {
 	if ic == nil {
 		return
 	}
-	reqModel := dto.AddPeerICECandidateReqModel{
+	err := r.signaler.SendICE(dto.AddPeerICECandidateReqModel{
 		PeerDTO: dto.PeerDTO{
 			RoomId: roomId,
 			ID:     id,
 		},
 		GGID:         ggid,
 		ICECandidate: ic.ToJSON(),
-	}
-	serializedReqBody, err := json.Marshal(reqModel)
-	if err != nil {
-		println(err.Error())
-		return
-	}
-	resp, err := http.Post(r.conf.LogjamBaseUrl+"/ice", "application/json", bytes.NewReader(serializedReqBody))
+	})
 	if err != nil {
-		println(err.Error())
-		return
-	}
-	if resp.StatusCode > 204 {
-		println("POST /ice", resp.StatusCode)
+		r.log.Error("can't send ice candidate", "roomId", roomId, "peerId", id, "ggId", ggid, "err", err)
 		return
 	}
 }
@@ -253,21 +367,39 @@ func (r *RoomRepository) onPeerConnectionStateChange(room *Room, peer *Peer, new
 	if peer == nil {
 		return
 	}
-	println("[PC] con_stat", newState.String(), peer.ID)
+	peer.log.Info("peer connection state changed", "state", newState.String())
 	switch newState {
-	case webrtc.PeerConnectionStateDisconnected:
-		fallthrough
-	case webrtc.PeerConnectionStateFailed:
-		if err := peer.Conn.Close(); err != nil {
-			println(err.Error())
+	case webrtc.PeerConnectionStateDisconnected, webrtc.PeerConnectionStateFailed:
+		r.recoverICE(peer)
+	case webrtc.PeerConnectionStateConnected:
+		if peer.iceGraceTimer != nil {
+			peer.iceGraceTimer.Stop()
+			peer.iceGraceTimer = nil
+			iceRecoveries.WithLabelValues("recovered").Inc()
+			peer.log.Info("peer reconnected")
 		}
 	case webrtc.PeerConnectionStateClosed:
+		if peer.iceGraceTimer != nil {
+			peer.iceGraceTimer.Stop()
+		}
+		if peer.negotiator != nil {
+			peer.negotiator.Stop()
+		}
 		delete(room.Peers, peer.ID)
+		room.speakers.remove(peer.ID)
+		room.forgetSpeaker(peer.ID)
+		r.snapshotChanged()
+		room.trackLock.Lock()
+		for _, publisher := range room.Peers {
+			for _, track := range publisher.tracks {
+				track.removeSubscriber(peer.ID)
+			}
+		}
+		room.trackLock.Unlock()
 	}
 }
 
 func (r *RoomRepository) onPeerTrack(roomId string, id uint64, remote *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
-	fmt.Println("got a track!", remote.ID(), remote.StreamID(), remote.Kind().String())
 	r.Lock()
 	if !r.doesRoomExists(roomId) {
 		r.Unlock()
@@ -276,20 +408,33 @@ func (r *RoomRepository) onPeerTrack(roomId string, id uint64, remote *webrtc.Tr
 	room := r.Rooms[roomId]
 	r.Unlock()
 
-	trackLocal, err := webrtc.NewTrackLocalStaticRTP(remote.Codec().RTPCodecCapability, remote.ID(), remote.StreamID())
-	if err != nil {
-		panic(err)
+	firstVideo := false
+	firstAudio := false
+	room.Lock()
+	peer, exists := room.Peers[id]
+	if !exists {
+		room.Unlock()
+		return
 	}
+	log := peer.log.With("trackId", remote.ID(), "rid", remote.RID())
+	log.Info("got a track", "streamId", remote.StreamID(), "kind", remote.Kind().String())
 	room.trackLock.Lock()
-	room.Tracks[remote.ID()] = &Track{
-		OwnerId:    id,
-		TrackLocal: trackLocal,
+	// simulcast layers of a track arrive as separate remote tracks sharing the same id
+	track, isNewTrack := peer.tracks[remote.ID()], false
+	if track == nil {
+		track = newTrack(id, remote, peer.Conn, peer.log.With("trackId", remote.ID()))
+		track.audioLevels = remote.Kind() == webrtc.RTPCodecTypeAudio && audioLevelExtensionId(receiver) != 0
+		isNewTrack = true
+		peer.tracks[remote.ID()] = track
+		// tracks of listen-only peers are kept aside and only get into room.Tracks once publishing is allowed
+		if peer.CanPublish {
+			room.Tracks[remote.ID()] = track
+		} else {
+			log.Info("peer is not allowed to publish, holding back track")
+		}
 	}
+	track.addLayer(remote)
 	room.trackLock.Unlock()
-	firstVideo := false
-	firstAudio := false
-	room.Lock()
-	peer := room.Peers[id]
 	room.Unlock()
 	if remote.Kind() == webrtc.RTPCodecTypeVideo && !peer.gotFirstVideoTrack {
 		peer.gotFirstVideoTrack = true
@@ -300,33 +445,52 @@ func (r *RoomRepository) onPeerTrack(roomId string, id uint64, remote *webrtc.Tr
 		firstAudio = true
 	}
 
-	defer func(trackId string) {
+	defer func(trackId string, rid string) {
+		if track.removeLayer(rid) > 0 {
+			return
+		}
 		room.trackLock.Lock()
-		delete(room.Tracks, trackId)
+		if room.Tracks[trackId] == track {
+			delete(room.Tracks, trackId)
+		}
+		if peer.tracks[trackId] == track {
+			delete(peer.tracks, trackId)
+		}
 		room.trackLock.Unlock()
 		r.updatePCTracks(roomId)
-	}(remote.ID())
-	go r.updatePCTracks(roomId)
+	}(remote.ID(), remote.RID())
+	if isNewTrack {
+		go r.updatePCTracks(roomId)
+	}
+	var audioLevelId uint8
+	if remote.Kind() == webrtc.RTPCodecTypeAudio {
+		audioLevelId = audioLevelExtensionId(receiver)
+	}
 	buffer := make([]byte, 1500)
 	for {
 		n, _, err := remote.Read(buffer)
 		if err != nil {
-			println(err.Error())
+			log.Info("track ended", "err", err)
 			break
 		}
-		if _, err = trackLocal.Write(buffer[:n]); err != nil {
-			println(err.Error())
-			break
+		// every packet gets its own copy, subscribers keep them around for retransmissions
+		packet := &rtp.Packet{}
+		if err = packet.Unmarshal(append([]byte(nil), buffer[:n]...)); err != nil {
+			log.Warn("can't parse rtp packet", "err", err)
+			continue
 		}
+		if audioLevelId != 0 {
+			room.observeAudioLevel(id, audioLevelId, packet)
+		}
+		track.forward(remote.RID(), packet, n)
 	}
 	if (firstVideo || firstAudio) && peer.IsCaller && !peer.triggeredReconnectOnce {
-		go r.onCallerDisconnected(roomId)
+		go r.rejoinRoom(roomId)
 		peer.triggeredReconnectOnce = true
 	}
 }
 
 func (r *RoomRepository) updatePCTracks(roomId string) {
-	println("[] updatePCTracks start")
 	r.Lock()
 	if !r.doesRoomExists(roomId) {
 		r.Unlock()
@@ -334,10 +498,22 @@ func (r *RoomRepository) updatePCTracks(roomId string) {
 	}
 	room := r.Rooms[roomId]
 	r.Unlock()
+	room.log.Debug("updating peer connection tracks")
 	room.Lock()
 	defer room.Unlock()
+	room.trackLock.Lock()
+	ranking := room.speakerRanking()
+	room.trackLock.Unlock()
+	audible := room.speakers.audiblePeers()
 	for _, peer := range room.Peers {
-		if peer.Conn == nil {
+		if peer.Conn == nil || peer.Source == PeerSourceWHIP {
+			continue
+		}
+		policy := r.forwardPolicyFor(ranking, audible, peer)
+		if peer.Source == PeerSourceWHEP {
+			room.trackLock.Lock()
+			r.updateWHEPSlots(room, peer, policy, ranking)
+			room.trackLock.Unlock()
 			continue
 		}
 		alreadySentTracks := map[string]*webrtc.RTPSender{}
@@ -361,45 +537,49 @@ func (r *RoomRepository) updatePCTracks(roomId string) {
 		for id, track := range room.Tracks {
 			_, alreadySend := alreadySentTracks[id]
 			_, alreadyReceived := receivingPeerTracks[id]
-			if track.OwnerId != peer.ID && (!alreadySend && !alreadyReceived) {
+			if track.OwnerId != peer.ID && (!alreadySend && !alreadyReceived) && policy.forwards(track) {
 				renegotiate = true
 				if peer.Conn.ConnectionState() == webrtc.PeerConnectionStateClosed {
 					break
 				}
-				println("[PC] add track", track.TrackLocal.ID(), "to", peer.ID)
-				_, err := peer.Conn.AddTrack(track.TrackLocal)
+				peer.log.Debug("adding track", "trackId", track.ID)
+				trackLocal, err := track.localFor(peer.ID)
 				if err != nil {
-					println(err.Error())
+					peer.log.Error("can't create local track", "trackId", track.ID, "err", err)
 					break
 				}
+				rtpSender, err := peer.Conn.AddTrack(trackLocal)
+				if err != nil {
+					peer.log.Error("can't add track", "trackId", track.ID, "err", err)
+					break
+				}
+				track.setSender(peer.ID, rtpSender)
 			}
 		}
 		for trackId, rtpSender := range alreadySentTracks {
-			if _, exists := room.Tracks[trackId]; !exists {
+			track, exists := room.Tracks[trackId]
+			if !exists || !policy.forwards(track) {
 				renegotiate = true
 				if peer.Conn.ConnectionState() == webrtc.PeerConnectionStateClosed {
 					break
 				}
-				println("[PC] remove track", trackId, "from", peer.ID)
+				peer.log.Debug("removing track", "trackId", trackId)
 				err := peer.Conn.RemoveTrack(rtpSender)
 				if err != nil {
-					println(err.Error())
+					peer.log.Error("can't remove track", "trackId", trackId, "err", err)
 					break
 				}
+				if exists {
+					// its down track starts over (and waits for a keyframe) if the owner gets back in the ranking
+					track.removeSubscriber(peer.ID)
+				}
 			}
 		}
 		room.trackLock.Unlock()
 		if renegotiate {
-			go func(p *Peer, rid string) {
-				err := r.offerPeer(p, rid)
-				if err != nil {
-					println(`[E]`, err.Error())
-					return
-				}
-			}(peer, roomId)
+			go peer.negotiator.renegotiate()
 		}
 	}
-	println("[] updatePCTracks end")
 }
 
 func (r *RoomRepository) AddPeerIceCandidate(roomId string, id uint64, ic webrtc.ICECandidateInit) error {
@@ -441,12 +621,10 @@ func (r *RoomRepository) SetPeerAnswer(roomId string, id uint64, answer webrtc.S
 	}
 	peer := room.Peers[id]
 	room.Unlock()
-	err := peer.Conn.SetRemoteDescription(answer)
-	if err != nil {
-		return models.NewError(err.Error(), 500, models.MessageResponse{Message: err.Error()})
+	if peer.negotiator == nil {
+		return models.NewError("peer isn't negotiated through logjam", 403, map[string]any{"roomId": roomId, "peerId": id})
 	}
-	peer.HandshakeLock.Unlock()
-	return nil
+	return peer.negotiator.OnAnswer(answer)
 }
 func (r *RoomRepository) SetPeerOffer(roomId string, id uint64, offer webrtc.SessionDescription) (sdpAnswer *webrtc.SessionDescription, err error) {
 	r.Lock()
@@ -465,43 +643,87 @@ func (r *RoomRepository) SetPeerOffer(roomId string, id uint64, offer webrtc.Ses
 	peer := room.Peers[id]
 	room.Unlock()
 
-	if !peer.IsCaller {
+	if !peer.IsCaller || peer.negotiator == nil {
 		return nil, models.NewError("only caller can offer", 403, nil)
 	}
-	peer.HandshakeLock.Lock()
-	defer peer.HandshakeLock.Unlock()
-	err = peer.Conn.SetRemoteDescription(offer)
-	if err != nil {
-		return nil, models.NewError(err.Error(), 500, models.MessageResponse{Message: err.Error()})
+	return peer.negotiator.OnOffer(offer)
+}
+
+func (r *RoomRepository) AllowPublish(roomId string, id uint64) error {
+	return r.setPeerPublish(roomId, id, true)
+}
+
+func (r *RoomRepository) DisallowPublish(roomId string, id uint64) error {
+	return r.setPeerPublish(roomId, id, false)
+}
+
+func (r *RoomRepository) setPeerPublish(roomId string, id uint64, canPublish bool) error {
+	r.Lock()
+	if !r.doesRoomExists(roomId) {
+		r.Unlock()
+		return models.NewError("room doesn't exists", 403, map[string]any{"roomId": roomId})
 	}
-	answer, err := peer.Conn.CreateAnswer(nil)
-	if err != nil {
-		return nil, models.NewError(err.Error(), 500, models.MessageResponse{Message: err.Error()})
+	room := r.Rooms[roomId]
+	r.Unlock()
+	room.Lock()
+
+	if !r.doesPeerExists(roomId, id) {
+		room.Unlock()
+		return models.NewError("no such a peer with this id in this room", 403, map[string]any{"roomId": roomId, "peerId": id})
 	}
-	err = peer.Conn.SetLocalDescription(answer)
-	if err != nil {
-		return nil, models.NewError(err.Error(), 500, models.MessageResponse{Message: err.Error()})
+	peer := room.Peers[id]
+	if peer.CanPublish == canPublish {
+		room.Unlock()
+		return nil
+	}
+	peer.CanPublish = canPublish
+	r.snapshotChanged()
+	room.trackLock.Lock()
+	for trackId, track := range peer.tracks {
+		if canPublish {
+			room.Tracks[trackId] = track
+		} else {
+			delete(room.Tracks, trackId)
+		}
 	}
+	room.trackLock.Unlock()
+	room.Unlock()
 
-	return &answer, nil
+	go r.updatePCTracks(roomId)
+	return nil
 }
 
-func (r *RoomRepository) AllowPublish(roomId string, id uint64) error {
+// SetPeerLayer picks the simulcast layer (rid) a peer receives of a track, an empty trackId applies it to every track it receives
+// and an empty rid means the best layer available.
+func (r *RoomRepository) SetPeerLayer(roomId string, id uint64, trackId string, rid string) error {
 	r.Lock()
 	if !r.doesRoomExists(roomId) {
 		r.Unlock()
 		return models.NewError("room doesn't exists", 403, map[string]any{"roomId": roomId})
 	}
-	r.Unlock()
 	room := r.Rooms[roomId]
+	r.Unlock()
 	room.Lock()
 	defer room.Unlock()
 
 	if !r.doesPeerExists(roomId, id) {
 		return models.NewError("no such a peer with this id in this room", 403, map[string]any{"roomId": roomId, "peerId": id})
 	}
-
-	room.Peers[id].CanPublish = true
+	room.trackLock.Lock()
+	defer room.trackLock.Unlock()
+	if len(trackId) > 0 {
+		track, exists := room.Tracks[trackId]
+		if !exists {
+			return models.NewError("no such a track in this room", 404, map[string]any{"roomId": roomId, "trackId": trackId})
+		}
+		track.SetSubscriberLayer(id, rid)
+		return nil
+	}
+	for _, track := range room.Tracks {
+		if track.Kind == webrtc.RTPCodecTypeVideo {
+			track.SetSubscriberLayer(id, rid)
+		}
+	}
 	return nil
 }
 
@@ -521,10 +743,24 @@ func (r *RoomRepository) ClosePeer(roomId string, id uint64) error {
 		return models.NewError("no such a peer with this id in this room", 403, map[string]any{"roomId": roomId, "peerId": id})
 	}
 	room.Unlock()
+	r.signaler.ForgetPeer(roomId, id)
 	return peer.Conn.Close()
 }
 
+// StartRoom joins the room through logjam in the background, retrying with backoff, the rejoin repository tracks how it goes
+func (r *RoomRepository) StartRoom(roomId string) error {
+	if r.IsDraining() {
+		return models.NewError("goldgorilla is draining, it doesn't take new rooms", 503, map[string]any{"roomId": roomId})
+	}
+	r.rejoins.Start(models.RejoinMode{
+		SimplyJoin: true,
+		RoomId:     roomId,
+	})
+	return nil
+}
+
 func (r *RoomRepository) ResetRoom(roomId string) (uint64, error) {
+	r.rejoins.Cancel(roomId)
 	r.Lock()
 	defer r.Unlock()
 	if !r.doesRoomExists(roomId) {
@@ -533,7 +769,7 @@ func (r *RoomRepository) ResetRoom(roomId string) (uint64, error) {
 	room := r.Rooms[roomId]
 	room.Lock()
 	ggid := room.ggId
-	room.timer.Stop()
+	room.stop()
 	for _, peer := range room.Peers {
 		go func(conn *webrtc.PeerConnection) {
 			_ = conn.Close()
@@ -541,46 +777,27 @@ func (r *RoomRepository) ResetRoom(roomId string) (uint64, error) {
 	}
 	room.Unlock()
 	delete(r.Rooms, roomId)
+	r.signaler.ForgetRoom(roomId)
+	r.snapshotChanged()
 	return ggid, nil
 }
 
-func (r *RoomRepository) offerPeer(peer *Peer, roomId string) error {
-	peer.HandshakeLock.Lock()
-	println("[PC] negotiating with peer", peer.ID)
-	offer, err := peer.Conn.CreateOffer(nil)
-	if err != nil {
-		return err
-	}
-	err = peer.Conn.SetLocalDescription(offer)
-	if err != nil {
-		return err
-	}
-	ggid := r.GetRoomGGID(roomId)
-	if ggid == nil {
-		println("[PC] ok not negotiating with peer", peer.ID, "(room is deleted)")
-		peer.HandshakeLock.Unlock()
-		return errors.New("room doesnt have ggid")
-	}
-	reqModel := dto.SetSDPReqModel{
-		GGID: *ggid,
-		PeerDTO: dto.PeerDTO{
-			RoomId: roomId,
-			ID:     peer.ID,
-		},
-		SDP: offer,
-	}
-	bodyJson, err := json.Marshal(reqModel)
-	if err != nil {
-		return err
-	}
-	res, err := http.Post(r.conf.LogjamBaseUrl+"/offer", "application/json", bytes.NewReader(bodyJson))
-	if err != nil {
-		return err
-	}
-	if res.StatusCode > 204 {
-		return errors.New("POST {logjambaseurl}/offer : " + res.Status)
+// offerSender sends the peer's offers to logjam with the room's current ggid
+func (r *RoomRepository) offerSender(roomId string, id uint64) func(offer webrtc.SessionDescription) error {
+	return func(offer webrtc.SessionDescription) error {
+		ggid := r.GetRoomGGID(roomId)
+		if ggid == nil {
+			return errors.New("room doesnt have ggid")
+		}
+		return r.signaler.SendOffer(dto.SetSDPReqModel{
+			GGID: *ggid,
+			PeerDTO: dto.PeerDTO{
+				RoomId: roomId,
+				ID:     id,
+			},
+			SDP: offer,
+		})
 	}
-	return nil
 }
 
 func (r *RoomRepository) GetRoomGGID(roomId string) *uint64 {
@@ -0,0 +1,209 @@
+package repositories
+
+import (
+	"errors"
+	"github.com/pion/webrtc/v3"
+	"io"
+	"log/slog"
+	"codeberg.org/greatape/goldgorilla/models"
+	"codeberg.org/greatape/goldgorilla/models/dto"
+	"codeberg.org/greatape/goldgorilla/signaling"
+	"testing"
+	"time"
+)
+
+const testRoomId = "room"
+
+func newTestRepository(t *testing.T) (*RoomRepository, *signaling.MemorySignaler) {
+	t.Helper()
+	return newTestRepositoryWith(t, testConfig())
+}
+
+func testConfig() *models.ConfigModel {
+	conf := models.DefaultConfig()
+	conf.ICETCPMUXListenPort = 0
+	return conf
+}
+
+func newTestRepositoryWith(t *testing.T, conf *models.ConfigModel) (*RoomRepository, *signaling.MemorySignaler) {
+	t.Helper()
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+	signaler := signaling.NewMemorySignaler()
+	repo := NewRoomRepository(conf, signaler, NewRejoinRepository(conf, signaler, log), nil, log)
+	t.Cleanup(repo.CloseRooms)
+	return repo, signaler
+}
+
+func newTestClient(t *testing.T) *webrtc.PeerConnection {
+	t.Helper()
+	client, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = client.Close()
+	})
+	return client
+}
+
+func TestPeerAnswersOffer(t *testing.T) {
+	repo, signaler := newTestRepository(t)
+	offers := make(chan dto.SetSDPReqModel, 1)
+	signaler.OnMessage = func(msg signaling.MemoryMessage) {
+		if msg.Type == signaling.MessageTypeOffer {
+			offers <- msg.Payload.(dto.SetSDPReqModel)
+		}
+	}
+	if err := repo.CreatePeer(testRoomId, 1, true, false, 7); err != nil {
+		t.Fatal(err)
+	}
+	peer := testPeer(t, repo, 1)
+	if err := peer.negotiator.Negotiate(); err != nil {
+		t.Fatal(err)
+	}
+
+	var offer dto.SetSDPReqModel
+	select {
+	case offer = <-offers:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no offer was sent")
+	}
+	if offer.GGID != 7 || offer.RoomId != testRoomId || offer.ID != 1 {
+		t.Fatalf("offer sent for the wrong peer: %+v", offer.PeerDTO)
+	}
+
+	client := newTestClient(t)
+	if err := client.SetRemoteDescription(offer.SDP); err != nil {
+		t.Fatal(err)
+	}
+	answer, err := client.CreateAnswer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.SetLocalDescription(answer); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.SetPeerAnswer(testRoomId, 1, answer); err != nil {
+		t.Fatal(err)
+	}
+	if state := peer.Conn.SignalingState(); state != webrtc.SignalingStateStable {
+		t.Fatalf("signaling state is %s after the answer", state)
+	}
+
+	var bigErr models.BigError
+	err = repo.SetPeerAnswer(testRoomId, 1, answer)
+	if !errors.As(err, &bigErr) || bigErr.ErrCode() != 409 {
+		t.Fatalf("a second answer should be refused with 409, got %v", err)
+	}
+}
+
+func TestPeerOfferIsAnswered(t *testing.T) {
+	repo, _ := newTestRepository(t)
+	// only the caller may offer
+	if err := repo.CreatePeer(testRoomId, 1, true, true, 7); err != nil {
+		t.Fatal(err)
+	}
+
+	client := newTestClient(t)
+	if _, err := client.AddTransceiverFromKind(webrtc.RTPCodecTypeAudio); err != nil {
+		t.Fatal(err)
+	}
+	offer, err := client.CreateOffer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.SetLocalDescription(offer); err != nil {
+		t.Fatal(err)
+	}
+	answer, err := repo.SetPeerOffer(testRoomId, 1, offer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.SetRemoteDescription(*answer); err != nil {
+		t.Fatal(err)
+	}
+	if state := client.SignalingState(); state != webrtc.SignalingStateStable {
+		t.Fatalf("signaling state is %s after the answer", state)
+	}
+}
+
+func TestPeerOfferOfUnknownRoom(t *testing.T) {
+	repo, _ := newTestRepository(t)
+	var bigErr models.BigError
+	_, err := repo.SetPeerOffer(testRoomId, 1, webrtc.SessionDescription{Type: webrtc.SDPTypeOffer})
+	if !errors.As(err, &bigErr) || bigErr.ErrCode() != 403 {
+		t.Fatalf("an offer for a room that doesn't exist should be refused with 403, got %v", err)
+	}
+}
+
+func testPeer(t *testing.T, repo *RoomRepository, id uint64) *Peer {
+	t.Helper()
+	repo.Lock()
+	defer repo.Unlock()
+	room := repo.Rooms[testRoomId]
+	room.Lock()
+	defer room.Unlock()
+	return room.Peers[id]
+}
+
+func waitForPeerToLeave(t *testing.T, repo *RoomRepository, id uint64) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for testPeer(t, repo, id) != nil {
+		if time.Now().After(deadline) {
+			t.Fatalf("peer %d is still in the room", id)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func countOffers(signaler *signaling.MemorySignaler, id uint64) int {
+	offers := 0
+	for _, msg := range signaler.Messages() {
+		if msg.Type == signaling.MessageTypeOffer && msg.Payload.(dto.SetSDPReqModel).ID == id {
+			offers++
+		}
+	}
+	return offers
+}
+
+func TestUnansweredOfferClosesOnlyThePeer(t *testing.T) {
+	conf := testConfig()
+	conf.Timeouts.Negotiation = 50 * time.Millisecond
+	repo, signaler := newTestRepositoryWith(t, conf)
+	for _, id := range []uint64{1, 2} {
+		if err := repo.CreatePeer(testRoomId, id, true, false, 7); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := testPeer(t, repo, 1).negotiator.Negotiate(); err != nil {
+		t.Fatal(err)
+	}
+
+	waitForPeerToLeave(t, repo, 1)
+	if offers := countOffers(signaler, 1); offers != maxOfferAttempts {
+		t.Fatalf("the offer was sent %d times, want %d", offers, maxOfferAttempts)
+	}
+	if testPeer(t, repo, 2) == nil {
+		t.Fatal("the other peer was closed too")
+	}
+}
+
+func TestUnansweredOfferHoldingUpICERestart(t *testing.T) {
+	conf := testConfig()
+	conf.Timeouts.Negotiation = 50 * time.Millisecond
+	repo, signaler := newTestRepositoryWith(t, conf)
+	if err := repo.CreatePeer(testRoomId, 1, true, false, 7); err != nil {
+		t.Fatal(err)
+	}
+	negotiator := testPeer(t, repo, 1).negotiator
+	if err := negotiator.Negotiate(); err != nil {
+		t.Fatal(err)
+	}
+	negotiator.RestartICE()
+
+	waitForPeerToLeave(t, repo, 1)
+	if offers := countOffers(signaler, 1); offers != 1 {
+		t.Fatalf("the stale offer was sent %d times, want it given up on after the first", offers)
+	}
+}
@@ -0,0 +1,98 @@
+package repositories
+
+import (
+	"codeberg.org/greatape/goldgorilla/models"
+	"sort"
+	"time"
+)
+
+// snapshotMinInterval keeps a busy node from rewriting the snapshot on every single change
+const snapshotMinInterval = 1 * time.Second
+
+// snapshotChanged schedules a snapshot, it never blocks so it can be called with the room locks held
+func (r *RoomRepository) snapshotChanged() {
+	if r.store == nil {
+		return
+	}
+	select {
+	case r.snapshotCH <- struct{}{}:
+	default:
+	}
+}
+
+func (r *RoomRepository) runSnapshots() {
+	for range r.snapshotCH {
+		r.saveSnapshot()
+		time.Sleep(snapshotMinInterval)
+	}
+}
+
+func (r *RoomRepository) saveSnapshot() {
+	snapshot := r.snapshot()
+	if err := r.store.Save(snapshot); err != nil {
+		r.log.Error("can't save rooms snapshot", "err", err)
+		return
+	}
+	r.log.Debug("rooms snapshot saved", "rooms", len(snapshot.Rooms))
+}
+
+func (r *RoomRepository) snapshot() models.RoomsSnapshot {
+	r.Lock()
+	defer r.Unlock()
+	snapshot := models.RoomsSnapshot{
+		SavedAt: time.Now(),
+		Rooms:   make([]models.RoomSnapshot, 0, len(r.Rooms)),
+	}
+	for roomId, room := range r.Rooms {
+		room.Lock()
+		roomSnapshot := models.RoomSnapshot{
+			RoomId: roomId,
+			GGID:   room.ggId,
+			Peers:  make([]models.PeerSnapshot, 0, len(room.Peers)),
+		}
+		for _, peer := range room.Peers {
+			// WHIP/WHEP peers can't be brought back through logjam
+			if peer.Source != PeerSourceLogjam {
+				continue
+			}
+			roomSnapshot.Peers = append(roomSnapshot.Peers, models.PeerSnapshot{
+				ID:         peer.ID,
+				CanPublish: peer.CanPublish,
+				IsCaller:   peer.IsCaller,
+			})
+		}
+		room.Unlock()
+		sort.Slice(roomSnapshot.Peers, func(i, j int) bool {
+			return roomSnapshot.Peers[i].ID < roomSnapshot.Peers[j].ID
+		})
+		snapshot.Rooms = append(snapshot.Rooms, roomSnapshot)
+	}
+	sort.Slice(snapshot.Rooms, func(i, j int) bool {
+		return snapshot.Rooms[i].RoomId < snapshot.Rooms[j].RoomId
+	})
+	return snapshot
+}
+
+// RestoreRooms rejoins every room of the last snapshot, so calls that were on this node before
+// a restart come back without waiting for logjam to notice.
+func (r *RoomRepository) RestoreRooms() error {
+	if r.store == nil {
+		return nil
+	}
+	snapshot, err := r.store.Load()
+	if err != nil {
+		return err
+	}
+	if len(snapshot.Rooms) == 0 {
+		return nil
+	}
+	r.log.Info("restoring rooms", "rooms", len(snapshot.Rooms), "savedAt", snapshot.SavedAt)
+	for _, room := range snapshot.Rooms {
+		r.log.Info("rejoining restored room", "roomId", room.RoomId, "ggId", room.GGID, "peers", len(room.Peers))
+		r.rejoins.Start(models.RejoinMode{
+			SimplyJoin: false,
+			RoomId:     room.RoomId,
+		})
+	}
+	return nil
+}
@@ -0,0 +1,319 @@
+package repositories
+
+import (
+	"codeberg.org/greatape/goldgorilla/models/dto"
+	"encoding/json"
+	"github.com/pion/rtp"
+	"github.com/pion/sdp/v3"
+	"github.com/pion/webrtc/v3"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	speakerInterval = 300 * time.Millisecond
+	// speakerSmoothing is the weight of every new packet's level in a peer's moving average, audio packets come every 20ms or so
+	speakerSmoothing = 0.1
+	// speakerMaxLevel is the quietest average level (in -dBov, 127 is silence) that still counts as speaking
+	speakerMaxLevel = 65
+	// speakerSwitchMargin is how much louder (in dB) someone has to be to take over from the current speaker
+	speakerSwitchMargin = 6
+	// speakerStaleAfter drops peers that stopped sending levels, e.g. muted ones
+	speakerStaleAfter = 1 * time.Second
+	// speakerAudibleHold is how long a peer keeps its topKAudio place after it stopped being among the loudest
+	speakerAudibleHold = 2 * time.Second
+
+	speakerChannelLabel = "goldgorilla-speakers"
+)
+
+type speakerLevel struct {
+	// loudness is the smoothed level turned around, 127 is the loudest and 0 silence
+	loudness  float64
+	updatedAt time.Time
+}
+
+// speakerDetector picks a room's dominant speaker from the audio levels its publishers put in their packets,
+// the current speaker is kept until it goes quiet or someone else is clearly louder so it doesn't flap.
+type speakerDetector struct {
+	lock       *sync.Mutex
+	levels     map[uint64]*speakerLevel
+	current    uint64
+	hasCurrent bool
+	// audible has the topKAudio peers and runnerUp the next loudest, with when they were last among the loudest
+	audible  map[uint64]time.Time
+	runnerUp map[uint64]time.Time
+}
+
+func newSpeakerDetector() *speakerDetector {
+	return &speakerDetector{
+		lock:     &sync.Mutex{},
+		levels:   make(map[uint64]*speakerLevel),
+		audible:  make(map[uint64]time.Time),
+		runnerUp: make(map[uint64]time.Time),
+	}
+}
+
+func (d *speakerDetector) observe(peerId uint64, level uint8) {
+	loudness := float64(127 - level&0x7f)
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	l, exists := d.levels[peerId]
+	if !exists {
+		l = &speakerLevel{}
+		d.levels[peerId] = l
+	}
+	l.loudness += speakerSmoothing * (loudness - l.loudness)
+	l.updatedAt = time.Now()
+}
+
+func (d *speakerDetector) remove(peerId uint64) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	delete(d.levels, peerId)
+	delete(d.audible, peerId)
+	delete(d.runnerUp, peerId)
+}
+
+// loudness is the peer's smoothed loudness, 0 when it stopped sending levels, the lock must be held
+func (d *speakerDetector) loudness(peerId uint64, now time.Time) float64 {
+	l, exists := d.levels[peerId]
+	if !exists || now.Sub(l.updatedAt) > speakerStaleAfter {
+		return 0
+	}
+	return l.loudness
+}
+
+// audibleSpeakers are the topKAudio peers subscribers hear, runnerUp takes the place of a subscriber that is among them
+// since it doesn't hear itself
+type audibleSpeakers struct {
+	top      map[uint64]bool
+	runnerUp map[uint64]bool
+}
+
+// heardBy returns the peers the subscriber hears
+func (a audibleSpeakers) heardBy(subscriberId uint64) map[uint64]bool {
+	if !a.top[subscriberId] {
+		return a.top
+	}
+	peers := make(map[uint64]bool, len(a.top))
+	for peerId := range a.top {
+		if peerId != subscriberId {
+			peers[peerId] = true
+		}
+	}
+	for peerId := range a.runnerUp {
+		peers[peerId] = true
+	}
+	return peers
+}
+
+// updateAudible picks the k loudest of the publishers and the runner-up, it returns whether the pick changed.
+// a peer keeps its place until it hasn't been among the loudest for speakerAudibleHold so the audio forwarded doesn't flap.
+func (d *speakerDetector) updateAudible(publishers map[uint64]bool, k uint) bool {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	now := time.Now()
+	ranking := make([]uint64, 0, len(publishers))
+	loudness := make(map[uint64]float64, len(publishers))
+	for peerId := range publishers {
+		ranking = append(ranking, peerId)
+		loudness[peerId] = d.loudness(peerId, now)
+	}
+	sort.Slice(ranking, func(i, j int) bool {
+		if loudness[ranking[i]] != loudness[ranking[j]] {
+			return loudness[ranking[i]] > loudness[ranking[j]]
+		}
+		_, iAudible := d.audible[ranking[i]]
+		_, jAudible := d.audible[ranking[j]]
+		if iAudible != jAudible {
+			return iAudible
+		}
+		return ranking[i] < ranking[j]
+	})
+	changed := holdLoudest(d.audible, ranking, k, now)
+	others := make([]uint64, 0, len(ranking))
+	for _, peerId := range ranking {
+		if _, audible := d.audible[peerId]; !audible {
+			others = append(others, peerId)
+		}
+	}
+	if holdLoudest(d.runnerUp, others, 1, now) {
+		changed = true
+	}
+	return changed
+}
+
+// holdLoudest keeps the k places of held filled from the ranking, loudest first, and returns whether they changed.
+// held has when each peer was last among the k loudest, free places go to the next loudest right away.
+func holdLoudest(held map[uint64]time.Time, ranking []uint64, k uint, now time.Time) bool {
+	ranked := make(map[uint64]bool, len(ranking))
+	for _, peerId := range ranking {
+		ranked[peerId] = true
+	}
+	changed := false
+	for peerId, loudAt := range held {
+		if !ranked[peerId] || now.Sub(loudAt) > speakerAudibleHold {
+			delete(held, peerId)
+			changed = true
+		}
+	}
+	for i, peerId := range ranking {
+		if _, exists := held[peerId]; exists {
+			if uint(i) < k {
+				held[peerId] = now
+			}
+			continue
+		}
+		if uint(len(held)) < k {
+			held[peerId] = now
+			changed = true
+		}
+	}
+	return changed
+}
+
+// audiblePeers returns the peers updateAudible picked
+func (d *speakerDetector) audiblePeers() audibleSpeakers {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return audibleSpeakers{
+		top:      heldPeers(d.audible),
+		runnerUp: heldPeers(d.runnerUp),
+	}
+}
+
+func heldPeers(held map[uint64]time.Time) map[uint64]bool {
+	peers := make(map[uint64]bool, len(held))
+	for peerId := range held {
+		peers[peerId] = true
+	}
+	return peers
+}
+
+// dominant returns the dominant speaker among the eligible peers and whether it changed, the level is in -dBov
+func (d *speakerDetector) dominant(eligible map[uint64]bool) (uint64, uint8, bool) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	now := time.Now()
+	speaking := func(peerId uint64) (float64, bool) {
+		l, exists := d.levels[peerId]
+		if !exists || !eligible[peerId] || now.Sub(l.updatedAt) > speakerStaleAfter || l.loudness < 127-speakerMaxLevel {
+			return 0, false
+		}
+		return l.loudness, true
+	}
+	var best uint64
+	var bestLoudness float64
+	found := false
+	for peerId := range d.levels {
+		if loudness, ok := speaking(peerId); ok && (!found || loudness > bestLoudness) {
+			best, bestLoudness, found = peerId, loudness, true
+		}
+	}
+	if !found || (d.hasCurrent && best == d.current) {
+		return 0, 0, false
+	}
+	if d.hasCurrent {
+		if currentLoudness, ok := speaking(d.current); ok && bestLoudness < currentLoudness+speakerSwitchMargin {
+			return 0, 0, false
+		}
+	}
+	d.current, d.hasCurrent = best, true
+	return best, 127 - uint8(bestLoudness), true
+}
+
+// audioLevelExtensionId returns the id the publisher negotiated for the audio level header extension, 0 when it didn't
+func audioLevelExtensionId(receiver *webrtc.RTPReceiver) uint8 {
+	for _, extension := range receiver.GetParameters().HeaderExtensions {
+		if extension.URI == sdp.AudioLevelURI {
+			return uint8(extension.ID)
+		}
+	}
+	return 0
+}
+
+func (room *Room) observeAudioLevel(peerId uint64, extensionId uint8, packet *rtp.Packet) {
+	payload := packet.GetExtension(extensionId)
+	if payload == nil {
+		return
+	}
+	var level rtp.AudioLevelExtension
+	if err := level.Unmarshal(payload); err != nil {
+		return
+	}
+	room.speakers.observe(peerId, level.Level)
+}
+
+func (r *RoomRepository) runSpeakerDetection(roomId string, room *Room) {
+	for {
+		select {
+		case <-room.done:
+			return
+		case <-room.speakerTimer.C:
+		}
+		room.Lock()
+		eligible := make(map[uint64]bool, len(room.Peers))
+		for peerId, peer := range room.Peers {
+			eligible[peerId] = peer.CanPublish
+		}
+		// publishers without audio levels can't be ranked, their audio is always forwarded
+		audioPublishers := make(map[uint64]bool)
+		room.trackLock.Lock()
+		for _, track := range room.Tracks {
+			if track.Kind == webrtc.RTPCodecTypeAudio && track.audioLevels {
+				audioPublishers[track.OwnerId] = true
+			}
+		}
+		room.trackLock.Unlock()
+		room.Unlock()
+		if r.conf.TopKAudio > 0 && room.speakers.updateAudible(audioPublishers, r.conf.TopKAudio) {
+			room.log.Debug("audible speakers changed", "peers", room.speakers.audiblePeers())
+			go r.updatePCTracks(roomId)
+		}
+		peerId, level, changed := room.speakers.dominant(eligible)
+		if !changed {
+			continue
+		}
+		room.log.Debug("dominant speaker changed", "peerId", peerId, "level", level)
+		if r.conf.LastN > 0 {
+			room.Lock()
+			room.promoteSpeaker(peerId)
+			room.Unlock()
+			go r.updatePCTracks(roomId)
+		}
+		event := dto.SpeakerChangedReqModel{
+			PeerDTO: dto.PeerDTO{
+				RoomId: roomId,
+				ID:     peerId,
+			},
+			GGID:  room.ggId,
+			Level: level,
+		}
+		go func() {
+			if err := r.signaler.SendSpeakerChanged(event); err != nil {
+				room.log.Error("can't send speaker change", "peerId", event.ID, "err", err)
+			}
+		}()
+		r.broadcastSpeaker(room, event)
+	}
+}
+
+// broadcastSpeaker tells every peer with an open speakers data channel who the dominant speaker is
+func (r *RoomRepository) broadcastSpeaker(room *Room, event dto.SpeakerChangedReqModel) {
+	message, err := json.Marshal(event)
+	if err != nil {
+		room.log.Error("can't encode speaker change", "err", err)
+		return
+	}
+	room.Lock()
+	defer room.Unlock()
+	for _, peer := range room.Peers {
+		if peer.speakerChannel == nil || peer.speakerChannel.ReadyState() != webrtc.DataChannelStateOpen {
+			continue
+		}
+		if err := peer.speakerChannel.SendText(string(message)); err != nil {
+			peer.log.Warn("can't send speaker change over data channel", "err", err)
+		}
+	}
+}
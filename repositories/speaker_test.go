@@ -0,0 +1,86 @@
+package repositories
+
+import (
+	"testing"
+	"time"
+)
+
+func expectDominant(t *testing.T, d *speakerDetector, eligible map[uint64]bool, want uint64, wantLevel uint8) {
+	t.Helper()
+	peerId, level, changed := d.dominant(eligible)
+	if !changed || peerId != want {
+		t.Fatalf("dominant is %d (changed %t), want %d", peerId, changed, want)
+	}
+	// the smoothed level gets close to what was spoken but not all the way
+	if level < wantLevel || level > wantLevel+1 {
+		t.Fatalf("level is %d, want %d", level, wantLevel)
+	}
+}
+
+func expectNoChange(t *testing.T, d *speakerDetector, eligible map[uint64]bool) {
+	t.Helper()
+	if peerId, _, changed := d.dominant(eligible); changed {
+		t.Fatalf("dominant changed to %d", peerId)
+	}
+}
+
+func TestDominantPicksTheLoudestSpeaker(t *testing.T) {
+	d := newSpeakerDetector()
+	expectNoChange(t, d, peerSet(1))
+	speak(d, 1, 40)
+	speak(d, 2, 20)
+	// too quiet to be speaking
+	speak(d, 3, 100)
+	expectDominant(t, d, peerSet(1, 2, 3), 2, 20)
+	expectNoChange(t, d, peerSet(1, 2, 3))
+}
+
+func TestDominantSkipsPeersThatArentEligible(t *testing.T) {
+	d := newSpeakerDetector()
+	speak(d, 1, 40)
+	speak(d, 2, 20)
+	expectDominant(t, d, peerSet(1), 1, 40)
+
+	// the speaker stopped publishing, the next one takes over however quiet it is
+	speak(d, 3, 60)
+	expectDominant(t, d, peerSet(3), 3, 60)
+}
+
+func TestDominantSwitchMargin(t *testing.T) {
+	d := newSpeakerDetector()
+	speak(d, 1, 40)
+	expectDominant(t, d, peerSet(1, 2), 1, 40)
+
+	speak(d, 2, 40-speakerSwitchMargin+1)
+	expectNoChange(t, d, peerSet(1, 2))
+	speak(d, 2, 40-speakerSwitchMargin-1)
+	expectDominant(t, d, peerSet(1, 2), 2, 40-speakerSwitchMargin-1)
+}
+
+func TestDominantWhenTheSpeakerGoesQuiet(t *testing.T) {
+	d := newSpeakerDetector()
+	speak(d, 1, 20)
+	speak(d, 2, 30)
+	expectDominant(t, d, peerSet(1, 2), 1, 20)
+
+	// muted, its levels stopped coming
+	d.levels[1].updatedAt = time.Now().Add(-speakerStaleAfter - time.Millisecond)
+	expectDominant(t, d, peerSet(1, 2), 2, 30)
+
+	speak(d, 1, 20)
+	expectDominant(t, d, peerSet(1, 2), 1, 20)
+	speak(d, 1, 100)
+	// too quiet to be speaking, the others take over without the margin
+	expectDominant(t, d, peerSet(1, 2), 2, 30)
+}
+
+func TestDominantAfterRemove(t *testing.T) {
+	d := newSpeakerDetector()
+	speak(d, 1, 20)
+	d.updateAudible(peerSet(1), 1)
+	d.remove(1)
+	expectNoChange(t, d, peerSet(1))
+	if len(d.levels) != 0 || len(d.audible) != 0 || len(d.runnerUp) != 0 {
+		t.Fatalf("peer 1 is still tracked: %v %v %v", d.levels, d.audible, d.runnerUp)
+	}
+}
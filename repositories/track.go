@@ -0,0 +1,495 @@
+package repositories
+
+import (
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+	"github.com/prometheus/client_golang/prometheus"
+	"log/slog"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Track is a track published in a room, it may have several simulcast layers (one per rid, "" when it's not simulcast)
+// and every subscriber gets its own local track so it can be sent the layer that suits it.
+type Track struct {
+	OwnerId  uint64
+	ID       string
+	StreamID string
+	Kind     webrtc.RTPCodecType
+	Codec    webrtc.RTPCodecCapability
+	// audioLevels is set when the publisher puts audio levels in the packets, only then the track is ranked for topKAudio
+	audioLevels bool
+	publisher   *webrtc.PeerConnection
+	log         *slog.Logger
+
+	lock       *sync.Mutex
+	layers     map[string]*trackLayer
+	downTracks map[uint64]*downTrack
+
+	keyframeRequests          map[KeyframeReason]uint64
+	keyframeRequestsThrottled uint64
+	retransmitted             uint64
+	retransmitMisses          uint64
+
+	forwardedBytes   prometheus.Counter
+	forwardedPackets prometheus.Counter
+	writeFailures    prometheus.Counter
+}
+
+type layerBitrate struct {
+	rid     string
+	bitrate uint64
+}
+
+type trackLayer struct {
+	rid    string
+	remote *webrtc.TrackRemote
+
+	windowStart    time.Time
+	windowBytes    uint64
+	bitrate        uint64
+	lastKeyframeAt time.Time
+	lastSeq        uint16
+	gotFirstPacket bool
+}
+
+// downTrack is what a single subscriber receives of a Track
+type downTrack struct {
+	subscriberId uint64
+	local        *webrtc.TrackLocalStaticRTP
+	sender       *webrtc.RTPSender
+
+	// targetLayer is the rid the subscriber asked for, when it's empty the layer picked by the bandwidth policy (autoLayer) is used
+	targetLayer  string
+	autoLayer    string
+	currentLayer string
+	started      bool
+	// resync makes the subscriber wait for a keyframe before getting packets again, e.g. after being paused
+	resync    bool
+	paused    bool
+	seqOffset uint16
+	tsOffset  uint32
+	// layerStartSeq is the first sequence number sent from the current layer
+	layerStartSeq uint16
+	lastSeq       uint16
+	lastTs        uint32
+	lastWriteAt   time.Time
+	// sent holds the last packets written, indexed by sequence number, to answer NACKs (nil for audio)
+	sent *[retransmitBufferSize]*rtp.Packet
+
+	// latest REMB and fraction lost (out of 256) the subscriber reported
+	remb         uint64
+	fractionLost uint8
+	feedbackAt   time.Time
+}
+
+func newTrack(ownerId uint64, remote *webrtc.TrackRemote, publisher *webrtc.PeerConnection, log *slog.Logger) *Track {
+	return &Track{
+		OwnerId:    ownerId,
+		ID:         remote.ID(),
+		StreamID:   remote.StreamID(),
+		Kind:       remote.Kind(),
+		Codec:      remote.Codec().RTPCodecCapability,
+		publisher:  publisher,
+		log:        log,
+		lock:       &sync.Mutex{},
+		layers:     make(map[string]*trackLayer),
+		downTracks: make(map[uint64]*downTrack),
+
+		keyframeRequests: make(map[KeyframeReason]uint64),
+
+		forwardedBytes:   forwardedBytes.WithLabelValues(remote.Kind().String()),
+		forwardedPackets: forwardedPackets.WithLabelValues(remote.Kind().String()),
+		writeFailures:    trackWriteFailures.WithLabelValues(remote.Kind().String()),
+	}
+}
+
+func (t *Track) addLayer(remote *webrtc.TrackRemote) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.layers[remote.RID()] = &trackLayer{
+		rid:         remote.RID(),
+		remote:      remote,
+		windowStart: time.Now(),
+	}
+}
+
+// removeLayer returns how many layers are left
+func (t *Track) removeLayer(rid string) int {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	delete(t.layers, rid)
+	return len(t.layers)
+}
+
+func (t *Track) IsSimulcast() bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return len(t.layers) > 1
+}
+
+// Layers returns the rids of the track ordered by their bitrate, lowest first
+func (t *Track) Layers() []string {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.sortedLayers()
+}
+
+func (t *Track) sortedLayers() []string {
+	rids := make([]string, 0, len(t.layers))
+	for rid := range t.layers {
+		rids = append(rids, rid)
+	}
+	sort.Slice(rids, func(i, j int) bool {
+		if t.layers[rids[i]].bitrate == t.layers[rids[j]].bitrate {
+			return rids[i] < rids[j]
+		}
+		return t.layers[rids[i]].bitrate < t.layers[rids[j]].bitrate
+	})
+	return rids
+}
+
+func (t *Track) layerBitrates() []layerBitrate {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	rids := t.sortedLayers()
+	bitrates := make([]layerBitrate, len(rids))
+	for i, rid := range rids {
+		bitrates[i] = layerBitrate{
+			rid:     rid,
+			bitrate: t.layers[rid].bitrate,
+		}
+	}
+	return bitrates
+}
+
+func (t *Track) hasSubscriber(subscriberId uint64) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	_, exists := t.downTracks[subscriberId]
+	return exists
+}
+
+// Subscribers returns the ids of the peers that get this track
+func (t *Track) Subscribers() []uint64 {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	ids := make([]uint64, 0, len(t.downTracks))
+	for id := range t.downTracks {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		return ids[i] < ids[j]
+	})
+	return ids
+}
+
+// localFor returns the local track to add to the subscriber's peer connection, it's created on first use
+func (t *Track) localFor(subscriberId uint64) (*webrtc.TrackLocalStaticRTP, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if dt, exists := t.downTracks[subscriberId]; exists {
+		return dt.local, nil
+	}
+	local, err := webrtc.NewTrackLocalStaticRTP(t.Codec, t.ID, t.StreamID)
+	if err != nil {
+		return nil, err
+	}
+	dt := &downTrack{
+		subscriberId: subscriberId,
+		local:        local,
+	}
+	if t.Kind == webrtc.RTPCodecTypeVideo {
+		dt.sent = &[retransmitBufferSize]*rtp.Packet{}
+	}
+	t.downTracks[subscriberId] = dt
+	return local, nil
+}
+
+func (t *Track) setSender(subscriberId uint64, sender *webrtc.RTPSender) {
+	if t.attachSender(subscriberId, sender) {
+		go t.readSenderRTCP(subscriberId, sender, senderSSRC(sender))
+	}
+}
+
+// attachSender records the sender of a subscriber's down track without reading its feedback, whoever reads it hands it to handleSenderRTCP
+func (t *Track) attachSender(subscriberId uint64, sender *webrtc.RTPSender) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	dt, exists := t.downTracks[subscriberId]
+	if exists {
+		dt.sender = sender
+	}
+	return exists
+}
+
+func senderSSRC(sender *webrtc.RTPSender) uint32 {
+	if encodings := sender.GetParameters().Encodings; len(encodings) > 0 {
+		return uint32(encodings[0].SSRC)
+	}
+	return 0
+}
+
+// readSenderRTCP handles the feedback a subscriber sends about this track until the sender is stopped
+func (t *Track) readSenderRTCP(subscriberId uint64, sender *webrtc.RTPSender, ssrc uint32) {
+	for {
+		packets, _, err := sender.ReadRTCP()
+		if err != nil {
+			return
+		}
+		t.handleSenderRTCP(subscriberId, ssrc, packets)
+	}
+}
+
+func (t *Track) handleSenderRTCP(subscriberId uint64, ssrc uint32, packets []rtcp.Packet) {
+	for _, packet := range packets {
+		switch p := packet.(type) {
+		case *rtcp.PictureLossIndication:
+			t.requestSubscriberKeyframe(subscriberId, KeyframeReasonSubscriberPLI)
+		case *rtcp.FullIntraRequest:
+			t.requestSubscriberKeyframe(subscriberId, KeyframeReasonSubscriberFIR)
+		case *rtcp.TransportLayerNack:
+			t.retransmit(subscriberId, p.Nacks)
+		case *rtcp.ReceiverEstimatedMaximumBitrate:
+			t.recordREMB(subscriberId, uint64(p.Bitrate))
+		case *rtcp.ReceiverReport:
+			// receiver reports are handed to every sender they have a report for, only ours counts
+			for _, report := range p.Reports {
+				if report.SSRC == ssrc {
+					t.recordFractionLost(subscriberId, report.FractionLost)
+				}
+			}
+		}
+	}
+}
+
+func (t *Track) removeSubscriber(subscriberId uint64) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	delete(t.downTracks, subscriberId)
+}
+
+// streamPosition is where a down track's stream stopped, another track sent on the same sender carries on from there
+type streamPosition struct {
+	started     bool
+	lastSeq     uint16
+	lastTs      uint32
+	lastWriteAt time.Time
+}
+
+// detachSubscriber removes the subscriber like removeSubscriber and returns where its stream stopped
+func (t *Track) detachSubscriber(subscriberId uint64) streamPosition {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	dt, exists := t.downTracks[subscriberId]
+	if !exists {
+		return streamPosition{}
+	}
+	delete(t.downTracks, subscriberId)
+	return streamPosition{
+		started:     dt.started,
+		lastSeq:     dt.lastSeq,
+		lastTs:      dt.lastTs,
+		lastWriteAt: dt.lastWriteAt,
+	}
+}
+
+// resumeSubscriber makes the subscriber's down track continue the sequence numbers and timestamps of another stream,
+// it starts on this track's next keyframe
+func (t *Track) resumeSubscriber(subscriberId uint64, position streamPosition) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	dt, exists := t.downTracks[subscriberId]
+	if !exists || !position.started {
+		return
+	}
+	dt.started = true
+	dt.resync = true
+	dt.lastSeq = position.lastSeq
+	dt.lastTs = position.lastTs
+	dt.lastWriteAt = position.lastWriteAt
+}
+
+// SetSubscriberLayer picks the simulcast layer a subscriber gets, the switch happens on the next keyframe of that layer
+func (t *Track) SetSubscriberLayer(subscriberId uint64, rid string) {
+	t.lock.Lock()
+	dt, exists := t.downTracks[subscriberId]
+	if !exists {
+		t.lock.Unlock()
+		return
+	}
+	dt.targetLayer = rid
+	target := t.resolveTarget(dt)
+	needsKeyframe := target != dt.currentLayer
+	t.lock.Unlock()
+	if needsKeyframe {
+		t.requestKeyframe(target, KeyframeReasonLayerSwitch)
+	}
+}
+
+// setAutoLayer is how the bandwidth policy picks a layer, it's ignored while the subscriber has asked for a layer itself
+func (t *Track) setAutoLayer(subscriberId uint64, rid string) {
+	t.lock.Lock()
+	dt, exists := t.downTracks[subscriberId]
+	if !exists || dt.autoLayer == rid {
+		t.lock.Unlock()
+		return
+	}
+	dt.autoLayer = rid
+	needsKeyframe := len(dt.targetLayer) == 0 && rid != dt.currentLayer
+	t.lock.Unlock()
+	if needsKeyframe {
+		t.requestKeyframe(rid, KeyframeReasonLayerSwitch)
+	}
+}
+
+// setSubscriberPaused stops/resumes sending the track to a subscriber, it returns whether anything changed
+func (t *Track) setSubscriberPaused(subscriberId uint64, paused bool) bool {
+	t.lock.Lock()
+	dt, exists := t.downTracks[subscriberId]
+	if !exists || dt.paused == paused {
+		t.lock.Unlock()
+		return false
+	}
+	dt.paused = paused
+	if !paused {
+		dt.resync = true
+	}
+	target := t.resolveTarget(dt)
+	t.lock.Unlock()
+	if !paused {
+		t.requestKeyframe(target, KeyframeReasonResume)
+	}
+	return true
+}
+
+// resolveTarget falls back to the best layer when the one asked for isn't published (anymore), must be called with t.lock held
+func (t *Track) resolveTarget(dt *downTrack) string {
+	if _, exists := t.layers[dt.targetLayer]; exists {
+		return dt.targetLayer
+	}
+	if _, exists := t.layers[dt.autoLayer]; exists && len(dt.targetLayer) == 0 {
+		return dt.autoLayer
+	}
+	rids := t.sortedLayers()
+	if len(rids) == 0 {
+		return dt.targetLayer
+	}
+	return rids[len(rids)-1]
+}
+
+// forward sends a packet received on one layer to every subscriber that is (or is switching) on that layer
+func (t *Track) forward(rid string, packet *rtp.Packet, size int) {
+	keyframeChecked := false
+	isKeyframe := false
+	var keyframeReason KeyframeReason
+	now := time.Now()
+
+	t.lock.Lock()
+	layer, exists := t.layers[rid]
+	if !exists {
+		t.lock.Unlock()
+		return
+	}
+	layer.windowBytes += uint64(size)
+	if elapsed := now.Sub(layer.windowStart); elapsed >= time.Second {
+		layer.bitrate = layer.windowBytes * 8 * uint64(time.Second) / uint64(elapsed)
+		layer.windowBytes = 0
+		layer.windowStart = now
+	}
+	if layer.gotFirstPacket {
+		gap := int16(packet.SequenceNumber - layer.lastSeq)
+		if gap > keyframeLossThreshold {
+			keyframeReason = KeyframeReasonPacketLoss
+		}
+		if gap > 0 {
+			layer.lastSeq = packet.SequenceNumber
+		}
+	} else {
+		layer.lastSeq = packet.SequenceNumber
+		layer.gotFirstPacket = true
+	}
+	for _, dt := range t.downTracks {
+		if dt.paused {
+			continue
+		}
+		target := t.resolveTarget(dt)
+		if dt.currentLayer != rid || !dt.started || dt.resync {
+			if target != rid {
+				continue
+			}
+			if !keyframeChecked {
+				isKeyframe = t.Kind == webrtc.RTPCodecTypeAudio || isKeyframePacket(t.Codec.MimeType, packet.Payload)
+				keyframeChecked = true
+			}
+			if !isKeyframe {
+				if len(keyframeReason) == 0 {
+					keyframeReason = dt.waitingReason()
+				}
+				continue
+			}
+			dt.switchTo(rid, packet, t.Codec.ClockRate, now)
+		}
+		if err := dt.write(packet, now); err != nil {
+			t.writeFailures.Inc()
+			t.log.Error("can't write to subscriber", "subscriberId", dt.subscriberId, "err", err)
+			continue
+		}
+		t.forwardedBytes.Add(float64(size))
+		t.forwardedPackets.Inc()
+	}
+	t.lock.Unlock()
+
+	if len(keyframeReason) > 0 {
+		t.requestKeyframe(rid, keyframeReason)
+	}
+}
+
+// waitingReason tells why a subscriber is waiting for a keyframe
+func (dt *downTrack) waitingReason() KeyframeReason {
+	if !dt.started {
+		return KeyframeReasonNewSubscriber
+	}
+	if dt.resync {
+		return KeyframeReasonResume
+	}
+	return KeyframeReasonLayerSwitch
+}
+
+// switchTo makes the subscriber continue on another layer, sequence numbers and timestamps continue from what it got so far
+func (dt *downTrack) switchTo(rid string, packet *rtp.Packet, clockRate uint32, now time.Time) {
+	if dt.started {
+		tsGap := uint32(now.Sub(dt.lastWriteAt).Seconds() * float64(clockRate))
+		if tsGap == 0 {
+			tsGap = 1
+		}
+		dt.seqOffset = dt.lastSeq + 1 - packet.SequenceNumber
+		dt.tsOffset = dt.lastTs + tsGap - packet.Timestamp
+	}
+	dt.currentLayer = rid
+	dt.started = true
+	dt.resync = false
+	dt.layerStartSeq = packet.SequenceNumber + dt.seqOffset
+	dt.lastSeq = dt.layerStartSeq - 1
+	dt.lastTs = packet.Timestamp + dt.tsOffset
+}
+
+func (dt *downTrack) write(packet *rtp.Packet, now time.Time) error {
+	outgoing := *packet
+	// the extension ids are the ones negotiated with the publisher, the subscriber's may mean something else
+	outgoing.Header.Extension = false
+	outgoing.Header.Extensions = nil
+	outgoing.SequenceNumber = packet.SequenceNumber + dt.seqOffset
+	outgoing.Timestamp = packet.Timestamp + dt.tsOffset
+	if int16(outgoing.SequenceNumber-dt.lastSeq) > 0 {
+		dt.lastSeq = outgoing.SequenceNumber
+		dt.lastTs = outgoing.Timestamp
+		dt.lastWriteAt = now
+	}
+	if dt.sent != nil {
+		dt.sent[outgoing.SequenceNumber%retransmitBufferSize] = &outgoing
+	}
+	return dt.local.WriteRTP(&outgoing)
+}
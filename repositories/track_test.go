@@ -0,0 +1,136 @@
+package repositories
+
+import (
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+	"testing"
+	"time"
+)
+
+// lastSent returns what the down track wrote for an outgoing sequence number
+func lastSent(t *testing.T, dt *downTrack, seq uint16) *rtp.Packet {
+	t.Helper()
+	packet := dt.sent[seq%retransmitBufferSize]
+	if packet == nil || packet.SequenceNumber != seq {
+		t.Fatalf("%d wasn't sent", seq)
+	}
+	return packet
+}
+
+func TestWriteStripsExtensions(t *testing.T) {
+	dt := newTestDownTrack(t)
+	packet := &rtp.Packet{Header: rtp.Header{SequenceNumber: 10, Timestamp: 500}}
+	if err := packet.Header.SetExtension(1, []byte{0x7F}); err != nil {
+		t.Fatal(err)
+	}
+	dt.switchTo("", packet, 90000, time.Now())
+	if err := dt.write(packet, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	sent := lastSent(t, dt, 10)
+	if sent.Extension || len(sent.Extensions) > 0 {
+		t.Fatalf("sent with the publisher's extensions %v", sent.Extensions)
+	}
+	if sent.Timestamp != 500 {
+		t.Fatalf("the first layer got its timestamp rewritten to %d", sent.Timestamp)
+	}
+	if !packet.Extension {
+		t.Fatal("the publisher's packet was changed")
+	}
+}
+
+func TestWriteOfLatePacket(t *testing.T) {
+	dt := newTestDownTrack(t)
+	sendFrom(t, dt, "", 100, 5, map[uint16]bool{102: true})
+	if err := dt.write(&rtp.Packet{Header: rtp.Header{SequenceNumber: 102, Timestamp: 7000}}, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	lastSent(t, dt, 102)
+	if dt.lastSeq != 104 {
+		t.Fatalf("last sequence number went back to %d", dt.lastSeq)
+	}
+}
+
+func TestSwitchToContinuesTheSequence(t *testing.T) {
+	dt := newTestDownTrack(t)
+	sendFrom(t, dt, "l", 100, 3, nil)
+	lastTs := dt.lastTs
+
+	switchedAt := dt.lastWriteAt.Add(100 * time.Millisecond)
+	packet := &rtp.Packet{Header: rtp.Header{SequenceNumber: 9000, Timestamp: 123456}}
+	dt.switchTo("h", packet, 90000, switchedAt)
+	if err := dt.write(packet, switchedAt); err != nil {
+		t.Fatal(err)
+	}
+	sent := lastSent(t, dt, 103)
+	if dt.currentLayer != "h" || dt.layerStartSeq != 103 {
+		t.Fatalf("on layer %q from %d, want layer h from 103", dt.currentLayer, dt.layerStartSeq)
+	}
+	// the timestamp moves on by the time since the last packet
+	if gap := sent.Timestamp - lastTs; gap < 8999 || gap > 9001 {
+		t.Fatalf("timestamp moved on by %d, want about 9000", gap)
+	}
+
+	next := &rtp.Packet{Header: rtp.Header{SequenceNumber: 9001, Timestamp: 126456}}
+	if err := dt.write(next, switchedAt); err != nil {
+		t.Fatal(err)
+	}
+	if after := lastSent(t, dt, 104); after.Timestamp-sent.Timestamp != 3000 {
+		t.Fatalf("timestamps of the layer are %d apart, want 3000", after.Timestamp-sent.Timestamp)
+	}
+}
+
+func TestSwitchToInTheSameInstant(t *testing.T) {
+	dt := newTestDownTrack(t)
+	now := time.Now()
+	first := &rtp.Packet{Header: rtp.Header{SequenceNumber: 65535, Timestamp: 1000}}
+	dt.switchTo("l", first, 90000, now)
+	if err := dt.write(first, now); err != nil {
+		t.Fatal(err)
+	}
+	second := &rtp.Packet{Header: rtp.Header{SequenceNumber: 40, Timestamp: 1000}}
+	dt.switchTo("h", second, 90000, now)
+	if err := dt.write(second, now); err != nil {
+		t.Fatal(err)
+	}
+	// the sequence wraps around and the timestamp still moves on
+	if sent := lastSent(t, dt, 0); sent.Timestamp != 1001 {
+		t.Fatalf("timestamp is %d, want 1001", sent.Timestamp)
+	}
+}
+
+func TestForwardWaitsForAKeyframeOfTheTargetLayer(t *testing.T) {
+	track := newTestTrack(t, webrtc.RTPCodecTypeVideo)
+	track.Codec = webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8, ClockRate: 90000}
+	track.layers = map[string]*trackLayer{
+		"l": {remote: &webrtc.TrackRemote{}},
+		"h": {remote: &webrtc.TrackRemote{}},
+	}
+	dt := newTestDownTrack(t)
+	track.downTracks[1] = dt
+	interframe := []byte{0x10, 0x01}
+	keyframe := []byte{0x10, 0x00}
+
+	dt.targetLayer = "l"
+	track.forward("l", &rtp.Packet{Header: rtp.Header{SequenceNumber: 10}, Payload: interframe}, 100)
+	if dt.started {
+		t.Fatal("started without a keyframe")
+	}
+	track.forward("l", &rtp.Packet{Header: rtp.Header{SequenceNumber: 11}, Payload: keyframe}, 100)
+	track.forward("l", &rtp.Packet{Header: rtp.Header{SequenceNumber: 12}, Payload: interframe}, 100)
+	if !dt.started || dt.currentLayer != "l" || dt.lastSeq != 12 {
+		t.Fatalf("on layer %q up to %d, want layer l up to 12", dt.currentLayer, dt.lastSeq)
+	}
+
+	dt.targetLayer = "h"
+	track.forward("h", &rtp.Packet{Header: rtp.Header{SequenceNumber: 500}, Payload: interframe}, 100)
+	track.forward("l", &rtp.Packet{Header: rtp.Header{SequenceNumber: 13}, Payload: interframe}, 100)
+	if dt.currentLayer != "l" || dt.lastSeq != 13 {
+		t.Fatalf("on layer %q up to %d, want to stay on l until h has a keyframe", dt.currentLayer, dt.lastSeq)
+	}
+	track.forward("h", &rtp.Packet{Header: rtp.Header{SequenceNumber: 501}, Payload: keyframe}, 100)
+	track.forward("l", &rtp.Packet{Header: rtp.Header{SequenceNumber: 14}, Payload: interframe}, 100)
+	if dt.currentLayer != "h" || dt.lastSeq != 14 {
+		t.Fatalf("on layer %q up to %d, want layer h up to 14", dt.currentLayer, dt.lastSeq)
+	}
+}
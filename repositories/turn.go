@@ -0,0 +1,38 @@
+package repositories
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"github.com/pion/webrtc/v3"
+	"strconv"
+	"time"
+)
+
+// iceServersFor returns the ice servers for a new peer connection, with turn credentials of its own when TURN REST is configured
+func (r *RoomRepository) iceServersFor(peerId uint64) []webrtc.ICEServer {
+	iceServers := r.ICEServers()
+	if len(r.conf.TURNREST.Secret) == 0 {
+		return iceServers
+	}
+	username, credential := turnRESTCredentials(r.conf.TURNREST.Secret, peerId, time.Now().Add(r.conf.TURNREST.TTL))
+	return append(append([]webrtc.ICEServer(nil), iceServers...), webrtc.ICEServer{
+		URLs:           r.conf.TURNREST.URIs,
+		Username:       username,
+		Credential:     credential,
+		CredentialType: webrtc.ICECredentialTypePassword,
+	})
+}
+
+// turnRESTCredentials follows the TURN REST api scheme: username is expiry:peerId, credential is base64(hmac-sha1(secret, username))
+func turnRESTCredentials(secret string, peerId uint64, expiresAt time.Time) (string, string) {
+	username := strconv.FormatInt(expiresAt.Unix(), 10) + ":" + strconv.FormatUint(peerId, 10)
+	return username, TURNRESTCredential(secret, username)
+}
+
+// TURNRESTCredential is the credential that goes with a TURN REST username
+func TURNRESTCredential(secret string, username string) string {
+	mac := hmac.New(sha1.New, []byte(secret))
+	mac.Write([]byte(username))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
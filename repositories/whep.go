@@ -0,0 +1,205 @@
+package repositories
+
+import (
+	"codeberg.org/greatape/goldgorilla/models"
+	"fmt"
+	"github.com/pion/webrtc/v3"
+	"sort"
+	"sync/atomic"
+)
+
+// whepSlot is one of the audio/video m-lines a WHEP viewer offered. WHEP can't renegotiate, so the room's tracks are swapped
+// in and out of the slots as publishers come and go, a slot without a track holds a placeholder that never sends anything.
+type whepSlot struct {
+	kind        webrtc.RTPCodecType
+	sender      *webrtc.RTPSender
+	placeholder *webrtc.TrackLocalStaticRTP
+	track       atomic.Pointer[Track]
+	// position is where the slot's last track stopped, the next one continues its sequence numbers and timestamps
+	position streamPosition
+}
+
+// CreateWHEPPeer adds a watch-only peer negotiated over WHEP to an existing room and returns its id and goldgorilla's answer,
+// the viewer gets as many of the room's tracks as it offered m-lines for, the most recent speakers first, and they follow
+// the room's publishers from then on.
+func (r *RoomRepository) CreateWHEPPeer(roomId string, offer webrtc.SessionDescription) (uint64, *webrtc.SessionDescription, error) {
+	room, id, err := r.reserveExternalPeerId(roomId)
+	if err != nil {
+		return 0, nil, err
+	}
+	peerConn, estimator, err := r.newPeerConnection(roomId, id, false)
+	if err != nil {
+		return 0, nil, err
+	}
+	room.Lock()
+	room.Peers[id] = &Peer{
+		ID:         id,
+		Conn:       peerConn,
+		CanPublish: false,
+		Source:     PeerSourceWHEP,
+		tracks:     make(map[string]*Track),
+		estimator:  estimator,
+		log:        room.log.With("peerId", id),
+	}
+	room.Unlock()
+
+	answer, err := r.answerExternalOffer(room.log.With("peerId", id), peerConn, offer, func() error {
+		if err := r.createWHEPSlots(room, id, peerConn); err != nil {
+			return err
+		}
+		r.updatePCTracks(roomId)
+		return nil
+	})
+	if err != nil {
+		r.dropExternalPeer(room, id)
+		return 0, nil, err
+	}
+	room.log.Info("whep peer joined", "peerId", id)
+	return id, answer, nil
+}
+
+// createWHEPSlots puts a placeholder on every audio/video m-line the viewer offered, so they are all answered sendonly
+func (r *RoomRepository) createWHEPSlots(room *Room, id uint64, peerConn *webrtc.PeerConnection) error {
+	var slots []*whepSlot
+	for _, transceiver := range peerConn.GetTransceivers() {
+		kind := transceiver.Kind()
+		if transceiver.Sender() != nil || (kind != webrtc.RTPCodecTypeAudio && kind != webrtc.RTPCodecTypeVideo) {
+			continue
+		}
+		slot, err := newWHEPSlot(peerConn, kind, len(slots))
+		if err != nil {
+			return models.NewError(err.Error(), 422, models.MessageResponse{Message: err.Error()})
+		}
+		go slot.readRTCP(id)
+		slots = append(slots, slot)
+	}
+	room.Lock()
+	defer room.Unlock()
+	if peer, exists := room.Peers[id]; exists {
+		peer.slots = slots
+	}
+	return nil
+}
+
+func newWHEPSlot(peerConn *webrtc.PeerConnection, kind webrtc.RTPCodecType, index int) (*whepSlot, error) {
+	trackId := fmt.Sprintf("slot-%d", index)
+	// the codec doesn't matter yet, the placeholder is replaced with one of the codecs the viewer accepted once the sender knows them
+	mimeType := webrtc.MimeTypeOpus
+	if kind == webrtc.RTPCodecTypeVideo {
+		mimeType = webrtc.MimeTypeVP8
+	}
+	placeholder, err := webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{MimeType: mimeType}, trackId, "goldgorilla")
+	if err != nil {
+		return nil, err
+	}
+	sender, err := peerConn.AddTrack(placeholder)
+	if err != nil {
+		return nil, err
+	}
+	codecs := sender.GetParameters().Codecs
+	if len(codecs) == 0 {
+		return nil, fmt.Errorf("the offer accepts none of goldgorilla's %s codecs", kind)
+	}
+	placeholder, err = webrtc.NewTrackLocalStaticRTP(codecs[0].RTPCodecCapability, trackId, "goldgorilla")
+	if err != nil {
+		return nil, err
+	}
+	if err := sender.ReplaceTrack(placeholder); err != nil {
+		return nil, err
+	}
+	return &whepSlot{
+		kind:        kind,
+		sender:      sender,
+		placeholder: placeholder,
+	}, nil
+}
+
+// readRTCP hands the viewer's feedback to whichever track the slot has at the moment, until the sender is stopped
+func (slot *whepSlot) readRTCP(subscriberId uint64) {
+	ssrc := senderSSRC(slot.sender)
+	for {
+		packets, _, err := slot.sender.ReadRTCP()
+		if err != nil {
+			return
+		}
+		if track := slot.track.Load(); track != nil {
+			track.handleSenderRTCP(subscriberId, ssrc, packets)
+		}
+	}
+}
+
+// updateWHEPSlots swaps the tracks the viewer should get into its slots, when there are more tracks than slots the ones of the
+// best ranked publishers win. the room lock and the track lock must be held.
+func (r *RoomRepository) updateWHEPSlots(room *Room, peer *Peer, policy forwardPolicy, ranking []uint64) {
+	wanted := make(map[string]*Track)
+	for trackId, track := range room.Tracks {
+		if track.OwnerId != peer.ID && policy.forwards(track) {
+			wanted[trackId] = track
+		}
+	}
+	free := make([]*whepSlot, 0, len(peer.slots))
+	for _, slot := range peer.slots {
+		current := slot.track.Load()
+		if current != nil && wanted[current.ID] == current {
+			delete(wanted, current.ID)
+			continue
+		}
+		if current != nil {
+			peer.log.Debug("taking track out of whep slot", "trackId", current.ID)
+			slot.track.Store(nil)
+			slot.position = current.detachSubscriber(peer.ID)
+			if err := slot.sender.ReplaceTrack(slot.placeholder); err != nil {
+				peer.log.Error("can't empty whep slot", "err", err)
+			}
+		}
+		free = append(free, slot)
+	}
+	for _, track := range rankTracks(wanted, ranking) {
+		for i, slot := range free {
+			if slot.kind != track.Kind {
+				continue
+			}
+			if err := fillWHEPSlot(peer, slot, track); err != nil {
+				peer.log.Error("can't put track in whep slot", "trackId", track.ID, "err", err)
+				break
+			}
+			free = append(free[:i], free[i+1:]...)
+			break
+		}
+	}
+}
+
+func fillWHEPSlot(peer *Peer, slot *whepSlot, track *Track) error {
+	trackLocal, err := track.localFor(peer.ID)
+	if err != nil {
+		return err
+	}
+	if err := slot.sender.ReplaceTrack(trackLocal); err != nil {
+		track.removeSubscriber(peer.ID)
+		return err
+	}
+	track.attachSender(peer.ID, slot.sender)
+	track.resumeSubscriber(peer.ID, slot.position)
+	slot.track.Store(track)
+	peer.log.Debug("put track in whep slot", "trackId", track.ID)
+	return nil
+}
+
+// rankTracks orders the tracks by their owner's place in the speaker ranking
+func rankTracks(tracks map[string]*Track, ranking []uint64) []*Track {
+	places := make(map[uint64]int, len(ranking))
+	for place, peerId := range ranking {
+		places[peerId] = place
+	}
+	ranked := make([]*Track, 0, len(tracks))
+	for _, track := range tracks {
+		ranked = append(ranked, track)
+	}
+	sort.Slice(ranked, func(i, j int) bool {
+		if places[ranked[i].OwnerId] != places[ranked[j].OwnerId] {
+			return places[ranked[i].OwnerId] < places[ranked[j].OwnerId]
+		}
+		return ranked[i].ID < ranked[j].ID
+	})
+	return ranked
+}
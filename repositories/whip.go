@@ -0,0 +1,36 @@
+package repositories
+
+import (
+	"github.com/pion/webrtc/v3"
+)
+
+// CreateWHIPPeer adds a publishing peer negotiated over WHIP to an existing room and returns its id and goldgorilla's answer.
+func (r *RoomRepository) CreateWHIPPeer(roomId string, offer webrtc.SessionDescription) (uint64, *webrtc.SessionDescription, error) {
+	room, id, err := r.reserveExternalPeerId(roomId)
+	if err != nil {
+		return 0, nil, err
+	}
+	peerConn, estimator, err := r.newPeerConnection(roomId, id, false)
+	if err != nil {
+		return 0, nil, err
+	}
+	room.Lock()
+	room.Peers[id] = &Peer{
+		ID:         id,
+		Conn:       peerConn,
+		CanPublish: true,
+		Source:     PeerSourceWHIP,
+		tracks:     make(map[string]*Track),
+		estimator:  estimator,
+		log:        room.log.With("peerId", id),
+	}
+	room.Unlock()
+
+	answer, err := r.answerExternalOffer(room.log.With("peerId", id), peerConn, offer, nil)
+	if err != nil {
+		r.dropExternalPeer(room, id)
+		return 0, nil, err
+	}
+	room.log.Info("whip peer joined", "peerId", id)
+	return id, answer, nil
+}
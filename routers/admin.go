@@ -0,0 +1,17 @@
+package routers
+
+import (
+	"codeberg.org/greatape/goldgorilla/controllers"
+	"github.com/gin-gonic/gin"
+)
+
+func registerAdminRoutes(rg *gin.RouterGroup, ctrl *controllers.AdminController) {
+	rg.Use(ctrl.Authenticate)
+
+	rg.GET("/rooms", ctrl.ListRooms)
+	rg.GET("/rooms/:roomId/peers", ctrl.ListPeers)
+	rg.GET("/rooms/:roomId/tracks", ctrl.ListTracks)
+	rg.GET("/rejoins", ctrl.ListRejoins)
+	rg.GET("/rejoins/:roomId", ctrl.GetRejoin)
+	rg.GET("/ice-servers", ctrl.ListICEServers)
+}
@@ -0,0 +1,49 @@
+package routers
+
+import (
+	"context"
+	"github.com/gin-gonic/gin"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// requestLogger logs every request to the same sink as the rest of goldgorilla instead of gin's own logger
+func requestLogger(log *slog.Logger) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		startedAt := time.Now()
+		path := ctx.Request.URL.Path
+		ctx.Next()
+
+		status := ctx.Writer.Status()
+		level := slog.LevelInfo
+		if status >= http.StatusInternalServerError {
+			level = slog.LevelError
+		} else if status >= http.StatusBadRequest {
+			level = slog.LevelWarn
+		}
+		attrs := []any{
+			"method", ctx.Request.Method,
+			"path", path,
+			"status", status,
+			"latency", time.Since(startedAt),
+			"clientIp", ctx.ClientIP(),
+		}
+		if errs := ctx.Errors.ByType(gin.ErrorTypePrivate).String(); len(errs) > 0 {
+			attrs = append(attrs, "err", errs)
+		}
+		log.Log(ctx.Request.Context(), level, "request", attrs...)
+	}
+}
+
+// logWriter turns what gin writes (e.g. recovered panics) into log records
+type logWriter struct {
+	log   *slog.Logger
+	level slog.Level
+}
+
+func (w *logWriter) Write(p []byte) (int, error) {
+	w.log.Log(context.Background(), w.level, strings.TrimSpace(string(p)))
+	return len(p), nil
+}
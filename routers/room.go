@@ -2,13 +2,18 @@ package routers
 
 import (
 	"github.com/gin-gonic/gin"
-	"codeberg.org/goldgorilla/logjam/controllers"
+	"codeberg.org/greatape/goldgorilla/controllers"
 )
 
 func registerRoomRoutes(rg *gin.RouterGroup, ctrl *controllers.RoomController) {
+	rg.Use(ctrl.RequireClientCertificate, ctrl.Authenticate)
 
 	rg.POST("/peer", ctrl.CreatePeer)
 	rg.DELETE("/peer", ctrl.ClosePeer)
+	rg.POST("/peer/publish", ctrl.AllowPublish)
+	rg.DELETE("/peer/publish", ctrl.DisallowPublish)
+	rg.POST("/peer/layer", ctrl.SetLayer)
+	rg.POST("/peer/pins", ctrl.SetPins)
 
 	rg.POST("/ice", ctrl.AddICECandidate)
 	rg.POST("/answer", ctrl.Answer)
@@ -1,25 +1,59 @@
 package routers
 
 import (
+	"context"
+	"crypto/tls"
 	"github.com/gin-gonic/gin"
-	"codeberg.org/goldgorilla/logjam/controllers"
+	"codeberg.org/greatape/goldgorilla/controllers"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"log/slog"
+	"net/http"
 )
 
 type Router struct {
 	router *gin.Engine
+	server *http.Server
+	log    *slog.Logger
 }
 
-func (r *Router) RegisterRoutes(rCtrl *controllers.RoomController) error {
+func NewRouter(log *slog.Logger) *Router {
+	return &Router{
+		log: log,
+	}
+}
+
+func (r *Router) RegisterRoutes(rCtrl *controllers.RoomController, whipCtrl *controllers.WHIPController, whepCtrl *controllers.WHEPController, adminCtrl *controllers.AdminController) error {
 	gin.SetMode(gin.ReleaseMode)
-	r.router = gin.Default()
-	r.router.Use(gin.Recovery())
+	r.router = gin.New()
+	r.router.Use(requestLogger(r.log), gin.RecoveryWithWriter(&logWriter{log: r.log, level: slog.LevelError}))
 	registerRoomRoutes(r.router.Group("/room"), rCtrl)
+	registerWHIPRoutes(r.router.Group("/whip"), whipCtrl)
+	registerWHEPRoutes(r.router.Group("/whep"), whepCtrl)
+	registerAdminRoutes(r.router.Group("/admin"), adminCtrl)
 	r.router.GET("/healthcheck", rCtrl.HealthCheck)
+	r.router.GET("/metrics", gin.WrapH(promhttp.Handler()))
+	r.server = &http.Server{
+		Handler:  r.router,
+		ErrorLog: slog.NewLogLogger(r.log.Handler(), slog.LevelWarn),
+	}
 
 	return nil
 }
 
-func (r *Router) Serve(addr string) error {
-	println("serving on ", addr)
-	return r.router.Run(addr)
+// Serve serves the api, over https when tlsConfig isn't nil
+func (r *Router) Serve(addr string, tlsConfig *tls.Config) error {
+	r.server.Addr = addr
+	r.server.TLSConfig = tlsConfig
+	if tlsConfig != nil {
+		r.log.Info("serving https", "addr", addr, "mutualTLS", tlsConfig.ClientCAs != nil)
+		// the certificate comes from tlsConfig
+		return r.server.ListenAndServeTLS("", "")
+	}
+	r.log.Info("serving", "addr", addr)
+	return r.server.ListenAndServe()
+}
+
+// Shutdown stops taking connections and waits for the running requests until ctx is done, Serve returns http.ErrServerClosed
+func (r *Router) Shutdown(ctx context.Context) error {
+	return r.server.Shutdown(ctx)
 }
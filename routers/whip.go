@@ -0,0 +1,24 @@
+package routers
+
+import (
+	"github.com/gin-gonic/gin"
+	"codeberg.org/greatape/goldgorilla/controllers"
+)
+
+func registerWHIPRoutes(rg *gin.RouterGroup, ctrl *controllers.WHIPController) {
+	rg.Use(ctrl.Authenticate)
+
+	rg.POST("/:roomId", ctrl.Publish)
+	rg.PATCH("/:roomId/:peerId", ctrl.Patch)
+	rg.DELETE("/:roomId/:peerId", ctrl.Delete)
+
+}
+
+func registerWHEPRoutes(rg *gin.RouterGroup, ctrl *controllers.WHEPController) {
+	rg.Use(ctrl.Authenticate)
+
+	rg.POST("/:roomId", ctrl.Watch)
+	rg.PATCH("/:roomId/:peerId", ctrl.Patch)
+	rg.DELETE("/:roomId/:peerId", ctrl.Delete)
+
+}
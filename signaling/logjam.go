@@ -0,0 +1,115 @@
+package signaling
+
+import (
+	"bytes"
+	"codeberg.org/greatape/goldgorilla/models/dto"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// LogjamSignaler talks to logjam over its REST api.
+type LogjamSignaler struct {
+	baseUrl string
+	client  *http.Client
+	// secret signs every request when it's not empty
+	secret string
+}
+
+// NewLogjamSignaler creates a signaler for the given logjam base url, tlsConfig is used for https when it isn't nil.
+func NewLogjamSignaler(baseUrl string, timeout time.Duration, secret string, tlsConfig *tls.Config) *LogjamSignaler {
+	client := &http.Client{
+		Timeout: timeout,
+	}
+	if tlsConfig != nil {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = tlsConfig
+		client.Transport = transport
+	}
+	return &LogjamSignaler{
+		baseUrl: baseUrl,
+		secret:  secret,
+		client:  client,
+	}
+}
+
+func (s *LogjamSignaler) SendOffer(req dto.SetSDPReqModel) error {
+	_, err := s.post("/offer", req)
+	return err
+}
+
+func (s *LogjamSignaler) SendAnswer(req dto.SetSDPReqModel) error {
+	_, err := s.post("/answer", req)
+	return err
+}
+
+func (s *LogjamSignaler) SendICE(req dto.AddPeerICECandidateReqModel) error {
+	_, err := s.post("/ice", req)
+	return err
+}
+
+func (s *LogjamSignaler) SendSpeakerChanged(req dto.SpeakerChangedReqModel) error {
+	_, err := s.post("/speaker", req)
+	return err
+}
+
+func (s *LogjamSignaler) Join(roomId string) error {
+	resBody, err := s.post("/join", map[string]any{"roomId": roomId})
+	if err != nil {
+		return err
+	}
+	if len(resBody) > 2 {
+		respData := make(map[string]any)
+		if err := json.Unmarshal(resBody, &respData); err != nil {
+			return fmt.Errorf("%w: POST /join: %s", ErrBadResponse, err.Error())
+		}
+	}
+	return nil
+}
+
+func (s *LogjamSignaler) Rejoin(roomId string) error {
+	_, err := s.post("/rejoin", map[string]any{"roomId": roomId})
+	return err
+}
+
+func (s *LogjamSignaler) Leave(roomId string) error {
+	_, err := s.post("/leave", map[string]any{"roomId": roomId})
+	return err
+}
+
+// ForgetRoom does nothing, nothing is queued: every message is posted right away.
+func (s *LogjamSignaler) ForgetRoom(roomId string) {}
+
+// ForgetPeer does nothing, nothing is queued: every message is posted right away.
+func (s *LogjamSignaler) ForgetPeer(roomId string, peerId uint64) {}
+
+func (s *LogjamSignaler) post(path string, reqModel any) ([]byte, error) {
+	buffer, err := json.Marshal(reqModel)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodPost, s.baseUrl+path, bytes.NewReader(buffer))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if len(s.secret) > 0 {
+		SignRequest(req, buffer, s.secret)
+	}
+	res, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	resBody, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode > 204 {
+		return resBody, fmt.Errorf("POST {logjambaseurl}%s : %s %s", path, res.Status, string(resBody))
+	}
+	return resBody, nil
+}
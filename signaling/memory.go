@@ -0,0 +1,97 @@
+package signaling
+
+import (
+	"codeberg.org/greatape/goldgorilla/models/dto"
+	"sync"
+)
+
+var _ Signaler = (*MemorySignaler)(nil)
+
+type MemoryMessage struct {
+	Type    string
+	RoomId  string
+	Payload any
+}
+
+// MemorySignaler keeps everything sent through it in memory instead of talking to a signaling server,
+// it's meant for tests and for embedding goldgorilla.
+type MemorySignaler struct {
+	lock     *sync.Mutex
+	messages []MemoryMessage
+	// Err, when set, is returned by every call (the message is still recorded)
+	Err error
+	// OnMessage, when set, is called with every message after it got recorded
+	OnMessage func(msg MemoryMessage)
+}
+
+func NewMemorySignaler() *MemorySignaler {
+	return &MemorySignaler{
+		lock: &sync.Mutex{},
+	}
+}
+
+func (s *MemorySignaler) SendOffer(req dto.SetSDPReqModel) error {
+	return s.record(MessageTypeOffer, req.RoomId, req)
+}
+
+func (s *MemorySignaler) SendAnswer(req dto.SetSDPReqModel) error {
+	return s.record(MessageTypeAnswer, req.RoomId, req)
+}
+
+func (s *MemorySignaler) SendICE(req dto.AddPeerICECandidateReqModel) error {
+	return s.record(MessageTypeICE, req.RoomId, req)
+}
+
+func (s *MemorySignaler) SendSpeakerChanged(req dto.SpeakerChangedReqModel) error {
+	return s.record(MessageTypeSpeaker, req.RoomId, req)
+}
+
+func (s *MemorySignaler) Join(roomId string) error {
+	return s.record(MessageTypeJoin, roomId, nil)
+}
+
+func (s *MemorySignaler) Rejoin(roomId string) error {
+	return s.record(MessageTypeRejoin, roomId, nil)
+}
+
+func (s *MemorySignaler) Leave(roomId string) error {
+	return s.record(MessageTypeLeave, roomId, nil)
+}
+
+// ForgetRoom does nothing, messages are recorded as sent right away.
+func (s *MemorySignaler) ForgetRoom(roomId string) {}
+
+// ForgetPeer does nothing, messages are recorded as sent right away.
+func (s *MemorySignaler) ForgetPeer(roomId string, peerId uint64) {}
+
+// Messages returns a copy of everything sent so far, oldest first.
+func (s *MemorySignaler) Messages() []MemoryMessage {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	messages := make([]MemoryMessage, len(s.messages))
+	copy(messages, s.messages)
+	return messages
+}
+
+func (s *MemorySignaler) Reset() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.messages = nil
+}
+
+func (s *MemorySignaler) record(msgType string, roomId string, payload any) error {
+	msg := MemoryMessage{
+		Type:    msgType,
+		RoomId:  roomId,
+		Payload: payload,
+	}
+	s.lock.Lock()
+	s.messages = append(s.messages, msg)
+	onMessage := s.OnMessage
+	err := s.Err
+	s.lock.Unlock()
+	if onMessage != nil {
+		onMessage(msg)
+	}
+	return err
+}
@@ -0,0 +1,58 @@
+package signaling
+
+import (
+	"codeberg.org/greatape/goldgorilla/models/dto"
+	"encoding/json"
+	"errors"
+)
+
+// message types, the same names are used for what goldgorilla sends and for what the signaling server sends to goldgorilla
+const (
+	MessageTypeOffer   = "offer"
+	MessageTypeAnswer  = "answer"
+	MessageTypeICE     = "ice"
+	MessageTypeJoin    = "join"
+	MessageTypeRejoin  = "rejoin"
+	MessageTypeLeave   = "leave"
+	MessageTypeSpeaker = "speaker"
+
+	MessageTypeCreatePeer      = "peer.create"
+	MessageTypeClosePeer       = "peer.close"
+	MessageTypeAllowPublish    = "peer.publish.allow"
+	MessageTypeDisallowPublish = "peer.publish.disallow"
+	MessageTypeSetLayer        = "peer.layer"
+	MessageTypeSetPins         = "peer.pins"
+	MessageTypeStartRoom       = "room.start"
+	MessageTypeResetRoom       = "room.reset"
+)
+
+// ErrBadResponse is returned when the signaling server answered with something goldgorilla can't understand.
+var ErrBadResponse = errors.New("bad response from signaling server")
+
+// Signaler is how goldgorilla talks back to the signaling server that drives it (logjam by default).
+type Signaler interface {
+	// SendOffer sends an offer created by goldgorilla for a peer.
+	SendOffer(req dto.SetSDPReqModel) error
+	// SendAnswer sends goldgorilla's answer to an offer of a peer.
+	SendAnswer(req dto.SetSDPReqModel) error
+	// SendICE sends a local ice candidate of a peer.
+	SendICE(req dto.AddPeerICECandidateReqModel) error
+	// SendSpeakerChanged tells the signaling server who the dominant speaker of a room is now.
+	SendSpeakerChanged(req dto.SpeakerChangedReqModel) error
+	// Join asks the signaling server to let goldgorilla join a room.
+	Join(roomId string) error
+	// Rejoin asks the signaling server to renegotiate a room with goldgorilla from scratch.
+	Rejoin(roomId string) error
+	// Leave tells the signaling server goldgorilla is leaving a room (it's draining), so the room can move to another node.
+	Leave(roomId string) error
+	// ForgetRoom drops what's still queued for a room that was reset, so it isn't replayed to the signaling server.
+	ForgetRoom(roomId string)
+	// ForgetPeer drops what's still queued for a closed peer.
+	ForgetPeer(roomId string, peerId uint64)
+}
+
+// InboundHandler handles messages the signaling server pushes to goldgorilla over a persistent link,
+// whatever it returns is sent back to the signaling server with the acknowledgement.
+type InboundHandler interface {
+	HandleSignal(msgType string, payload json.RawMessage) (any, error)
+}
@@ -0,0 +1,104 @@
+package signaling
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// requests between logjam and goldgorilla are signed with a shared secret in both directions:
+// SignatureHeader is hex(hmac-sha256(secret, timestamp \n method \n uri \n hex(sha256(body)))), uri being the path and the query,
+// and TimestampHeader is the unix time it was signed at. requests older (or newer) than the allowed skew are rejected so
+// they can't be replayed later, and a ReplayCache rejects the ones sent again within the skew.
+const (
+	SignatureHeader = "X-Goldgorilla-Signature"
+	TimestampHeader = "X-Goldgorilla-Timestamp"
+)
+
+var (
+	ErrMissingSignature = errors.New("request isn't signed")
+	ErrExpiredSignature = errors.New("request signature timestamp is out of the allowed window")
+	ErrBadSignature     = errors.New("request signature doesn't match")
+	ErrReplayedRequest  = errors.New("request was already received")
+)
+
+func computeSignature(secret string, timestamp string, method string, uri string, body []byte) string {
+	bodyHash := sha256.Sum256(body)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "\n" + method + "\n" + uri + "\n" + hex.EncodeToString(bodyHash[:])))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// SignRequest sets the signature headers of a request, body must be what the request is going to send
+func SignRequest(req *http.Request, body []byte, secret string) {
+	signHeader(req.Header, req.Method, req.URL.RequestURI(), body, secret)
+}
+
+func signHeader(header http.Header, method string, uri string, body []byte, secret string) {
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	header.Set(TimestampHeader, timestamp)
+	header.Set(SignatureHeader, computeSignature(secret, timestamp, method, uri, body))
+}
+
+// VerifyRequest checks the signature headers of a request against its method, path, query and body
+func VerifyRequest(req *http.Request, body []byte, secret string, maxSkew time.Duration) error {
+	timestamp := req.Header.Get(TimestampHeader)
+	signature := req.Header.Get(SignatureHeader)
+	if len(timestamp) == 0 || len(signature) == 0 {
+		return ErrMissingSignature
+	}
+	signedAt, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return ErrBadSignature
+	}
+	if skew := time.Since(time.Unix(signedAt, 0)); skew > maxSkew || skew < -maxSkew {
+		return ErrExpiredSignature
+	}
+	expected := computeSignature(secret, timestamp, req.Method, req.URL.RequestURI(), body)
+	if !hmac.Equal([]byte(expected), []byte(signature)) {
+		return ErrBadSignature
+	}
+	return nil
+}
+
+// ReplayCache remembers the signatures it has seen until they can't pass VerifyRequest anymore
+type ReplayCache struct {
+	lock      *sync.Mutex
+	seen      map[string]time.Time
+	nextPrune time.Time
+}
+
+func NewReplayCache() *ReplayCache {
+	return &ReplayCache{
+		lock: &sync.Mutex{},
+		seen: make(map[string]time.Time),
+	}
+}
+
+// Check records the request's signature and returns ErrReplayedRequest when it was already recorded,
+// maxSkew must be the one the request was verified with.
+func (c *ReplayCache) Check(req *http.Request, maxSkew time.Duration) error {
+	signature := req.Header.Get(SignatureHeader)
+	now := time.Now()
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if now.After(c.nextPrune) {
+		for seen, expiresAt := range c.seen {
+			if now.After(expiresAt) {
+				delete(c.seen, seen)
+			}
+		}
+		c.nextPrune = now.Add(maxSkew)
+	}
+	if _, exists := c.seen[signature]; exists {
+		return ErrReplayedRequest
+	}
+	// the timestamp can be up to maxSkew in the future, so the signature stays valid for twice that
+	c.seen[signature] = now.Add(2 * maxSkew)
+	return nil
+}
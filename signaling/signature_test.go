@@ -0,0 +1,120 @@
+package signaling
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testSecret = "secret"
+
+func signedRequest(t *testing.T, target string, body string) *http.Request {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodPost, target, strings.NewReader(body))
+	SignRequest(req, []byte(body), testSecret)
+	return req
+}
+
+func TestVerifyRequest(t *testing.T) {
+	req := signedRequest(t, "/room/offer?x=1", "{}")
+	if err := VerifyRequest(req, []byte("{}"), testSecret, time.Minute); err != nil {
+		t.Fatalf("a signed request should verify: %v", err)
+	}
+}
+
+func TestVerifyRequestRejectsTampering(t *testing.T) {
+	tests := []struct {
+		name   string
+		tamper func(req *http.Request) []byte
+	}{
+		{"body", func(req *http.Request) []byte {
+			return []byte(`{"id":2}`)
+		}},
+		{"path", func(req *http.Request) []byte {
+			req.URL.Path = "/room/answer"
+			return []byte("{}")
+		}},
+		{"query", func(req *http.Request) []byte {
+			req.URL.RawQuery = "x=2"
+			return []byte("{}")
+		}},
+		{"method", func(req *http.Request) []byte {
+			req.Method = http.MethodPut
+			return []byte("{}")
+		}},
+		{"timestamp", func(req *http.Request) []byte {
+			req.Header.Set(TimestampHeader, strconv.FormatInt(time.Now().Unix()-1, 10))
+			return []byte("{}")
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := signedRequest(t, "/room/offer?x=1", "{}")
+			body := test.tamper(req)
+			if err := VerifyRequest(req, body, testSecret, time.Minute); !errors.Is(err, ErrBadSignature) {
+				t.Fatalf("got %v, want %v", err, ErrBadSignature)
+			}
+		})
+	}
+}
+
+func TestVerifyRequestRejectsWrongSecret(t *testing.T) {
+	req := signedRequest(t, "/room/offer", "{}")
+	if err := VerifyRequest(req, []byte("{}"), "other", time.Minute); !errors.Is(err, ErrBadSignature) {
+		t.Fatalf("got %v, want %v", err, ErrBadSignature)
+	}
+}
+
+func TestVerifyRequestRejectsUnsigned(t *testing.T) {
+	req := httptest.NewRequest(http.MethodPost, "/room/offer", nil)
+	if err := VerifyRequest(req, nil, testSecret, time.Minute); !errors.Is(err, ErrMissingSignature) {
+		t.Fatalf("got %v, want %v", err, ErrMissingSignature)
+	}
+}
+
+func TestVerifyRequestRejectsOldAndFutureTimestamps(t *testing.T) {
+	for _, offset := range []time.Duration{-2 * time.Minute, 2 * time.Minute} {
+		req := httptest.NewRequest(http.MethodPost, "/room/offer", nil)
+		timestamp := strconv.FormatInt(time.Now().Add(offset).Unix(), 10)
+		req.Header.Set(TimestampHeader, timestamp)
+		req.Header.Set(SignatureHeader, computeSignature(testSecret, timestamp, req.Method, req.URL.RequestURI(), nil))
+		if err := VerifyRequest(req, nil, testSecret, time.Minute); !errors.Is(err, ErrExpiredSignature) {
+			t.Fatalf("signed %s from now: got %v, want %v", offset, err, ErrExpiredSignature)
+		}
+	}
+}
+
+func TestReplayCache(t *testing.T) {
+	cache := NewReplayCache()
+	req := signedRequest(t, "/room/offer", "{}")
+	if err := cache.Check(req, time.Minute); err != nil {
+		t.Fatalf("the first request should pass: %v", err)
+	}
+	if err := cache.Check(req, time.Minute); !errors.Is(err, ErrReplayedRequest) {
+		t.Fatalf("got %v, want %v", err, ErrReplayedRequest)
+	}
+	other := signedRequest(t, "/room/answer", "{}")
+	if err := cache.Check(other, time.Minute); err != nil {
+		t.Fatalf("another request should pass: %v", err)
+	}
+}
+
+func TestReplayCacheForgetsExpiredSignatures(t *testing.T) {
+	cache := NewReplayCache()
+	req := signedRequest(t, "/room/offer", "{}")
+	if err := cache.Check(req, time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(5 * time.Millisecond)
+	// it's pruned on the next check once it can't pass VerifyRequest anymore
+	if err := cache.Check(signedRequest(t, "/room/answer", "{}"), time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if _, exists := cache.seen[req.Header.Get(SignatureHeader)]; exists {
+		t.Fatal("an expired signature is still remembered")
+	}
+}
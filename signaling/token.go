@@ -0,0 +1,53 @@
+package signaling
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// WHIP publishers and WHEP viewers come in with a bearer token logjam hands out, it's bound to a room and to whip or whep
+// and signed with the shared secret: expiresAt (unix time) "." hex(hmac-sha256(secret, "stream" \n kind \n roomId \n expiresAt))
+var (
+	ErrMissingToken = errors.New("missing bearer token")
+	ErrBadToken     = errors.New("bearer token isn't valid for this room")
+	ErrExpiredToken = errors.New("bearer token has expired")
+)
+
+// StreamToken creates a token that lets its bearer publish (kind "whip") or watch (kind "whep") the room until expiresAt
+func StreamToken(secret string, kind string, roomId string, expiresAt time.Time) string {
+	expires := strconv.FormatInt(expiresAt.Unix(), 10)
+	return expires + "." + computeTokenSignature(secret, kind, roomId, expires)
+}
+
+func computeTokenSignature(secret string, kind string, roomId string, expires string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte("stream\n" + kind + "\n" + roomId + "\n" + expires))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func VerifyStreamToken(token string, secret string, kind string, roomId string) error {
+	if len(token) == 0 {
+		return ErrMissingToken
+	}
+	expires, signature, found := strings.Cut(token, ".")
+	if !found {
+		return ErrBadToken
+	}
+	expiresAt, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil {
+		return ErrBadToken
+	}
+	expected := computeTokenSignature(secret, kind, roomId, expires)
+	if !hmac.Equal([]byte(expected), []byte(signature)) {
+		return ErrBadToken
+	}
+	if time.Now().After(time.Unix(expiresAt, 0)) {
+		return ErrExpiredToken
+	}
+	return nil
+}
@@ -0,0 +1,44 @@
+package signaling
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestVerifyStreamToken(t *testing.T) {
+	token := StreamToken(testSecret, "whip", "room", time.Now().Add(time.Minute))
+	if err := VerifyStreamToken(token, testSecret, "whip", "room"); err != nil {
+		t.Fatalf("a fresh token should verify: %v", err)
+	}
+}
+
+func TestVerifyStreamTokenRejects(t *testing.T) {
+	token := StreamToken(testSecret, "whip", "room", time.Now().Add(time.Minute))
+	expires, signature, _ := strings.Cut(token, ".")
+	tests := []struct {
+		name   string
+		token  string
+		secret string
+		kind   string
+		roomId string
+		want   error
+	}{
+		{"missing", "", testSecret, "whip", "room", ErrMissingToken},
+		{"no signature", expires, testSecret, "whip", "room", ErrBadToken},
+		{"bad expiry", "soon." + signature, testSecret, "whip", "room", ErrBadToken},
+		{"extended expiry", expires + "0." + signature, testSecret, "whip", "room", ErrBadToken},
+		{"other kind", token, testSecret, "whep", "room", ErrBadToken},
+		{"other room", token, testSecret, "whip", "other", ErrBadToken},
+		{"other secret", token, "other", "whip", "room", ErrBadToken},
+		{"expired", StreamToken(testSecret, "whip", "room", time.Now().Add(-time.Second)), testSecret, "whip", "room", ErrExpiredToken},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := VerifyStreamToken(test.token, test.secret, test.kind, test.roomId); !errors.Is(err, test.want) {
+				t.Fatalf("got %v, want %v", err, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,486 @@
+package signaling
+
+import (
+	"codeberg.org/greatape/goldgorilla/models/dto"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"golang.org/x/net/websocket"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	messageTypeAck  = "ack"
+	messageTypePing = "ping"
+	messageTypePong = "pong"
+
+	// wsMaxPendingEvents caps the offers, answers, ice candidates and speaker changes waiting for logjam, they're sent
+	// without waiting for the ack. the joins, rejoins and leaves callers wait for are capped on their own so events
+	// piling up while logjam is unreachable can't keep them out.
+	wsMaxPendingEvents   = 1024
+	wsMaxPendingControl  = 64
+	wsMaxInboundMessages = 1024
+	wsAckTimeout         = 8 * time.Second
+	wsPingInterval       = 15 * time.Second
+	wsMinReconnectDelay  = 1 * time.Second
+	wsMaxReconnectDelay  = 30 * time.Second
+)
+
+var (
+	ErrSignalerClosed = errors.New("signaler is closed")
+	ErrTooManyPending = errors.New("too many messages waiting for logjam")
+	ErrAckTimeout     = errors.New("logjam didn't ack in time")
+)
+
+// WSMessage is the envelope of everything sent over the websocket link in both directions.
+// every message except acks and pings carries a Seq, the other side acks it with Ack set to that Seq.
+// Session identifies the sender's sequence, it changes when the sender restarts and its Seq starts over.
+type WSMessage struct {
+	Seq     uint64          `json:"seq,omitempty"`
+	Session string          `json:"session,omitempty"`
+	Ack     uint64          `json:"ack,omitempty"`
+	Type    string          `json:"type"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+	Error   string          `json:"error,omitempty"`
+}
+
+type wsOutgoing struct {
+	msg WSMessage
+	// roomId and peerId (nil for room wide messages) let the messages of a reset room or a closed peer be dropped
+	roomId     string
+	peerId     *uint64
+	waitForAck bool
+	done       chan error
+}
+
+// WebSocketSignaler keeps one persistent websocket to logjam and uses it for signaling in both directions.
+// outgoing messages are delivered in order and kept until logjam acks them, so they survive reconnects.
+type WebSocketSignaler struct {
+	url     string
+	origin  string
+	handler InboundHandler
+	log     *slog.Logger
+	// secret signs the websocket handshake when it's not empty
+	secret    string
+	tlsConfig *tls.Config
+
+	lock *sync.Mutex
+	cond *sync.Cond
+	conn *websocket.Conn
+	// session tells logjam goldgorilla restarted and nextSeq started over
+	session string
+	nextSeq uint64
+	pending []*wsOutgoing
+	written int
+	// pendingEvents and pendingControl count the messages in pending that are and aren't waited for
+	pendingEvents  int
+	pendingControl int
+	// lastInSeq is the last Seq handled from inSession, inSessionChecked is false until the current connection's first message
+	lastInSeq        uint64
+	inSession        string
+	inSessionChecked bool
+	// inbound queues logjam's messages for handleInbound, the reader never blocks on it so acks keep flowing
+	inbound      []WSMessage
+	inboundReady *sync.Cond
+	closed       bool
+}
+
+// NewWebSocketSignaler creates a signaler for the given logjam base url, http(s) is swapped with ws(s).
+// tlsConfig is used for wss when it isn't nil.
+func NewWebSocketSignaler(logjamBaseUrl string, secret string, tlsConfig *tls.Config, log *slog.Logger) *WebSocketSignaler {
+	url := logjamBaseUrl + "/ws"
+	if strings.HasPrefix(url, "https://") {
+		url = "wss://" + strings.TrimPrefix(url, "https://")
+	} else if strings.HasPrefix(url, "http://") {
+		url = "ws://" + strings.TrimPrefix(url, "http://")
+	}
+	lock := &sync.Mutex{}
+	session := make([]byte, 8)
+	_, _ = rand.Read(session)
+	return &WebSocketSignaler{
+		url:          url,
+		origin:       logjamBaseUrl,
+		log:          log.With("url", url),
+		secret:       secret,
+		tlsConfig:    tlsConfig,
+		session:      hex.EncodeToString(session),
+		lock:         lock,
+		cond:         sync.NewCond(lock),
+		inboundReady: sync.NewCond(lock),
+	}
+}
+
+// SetHandler sets who handles what logjam sends to goldgorilla, it must be called before Run.
+func (s *WebSocketSignaler) SetHandler(handler InboundHandler) {
+	s.handler = handler
+}
+
+// Run keeps the websocket connected until Close is called, it blocks.
+func (s *WebSocketSignaler) Run() {
+	go s.handleInbound()
+	delay := wsMinReconnectDelay
+	for !s.isClosed() {
+		conn, err := s.dial()
+		if err != nil {
+			s.log.Warn("can't connect to signaling websocket", "err", err, "retryIn", delay)
+			time.Sleep(delay)
+			delay *= 2
+			if delay > wsMaxReconnectDelay {
+				delay = wsMaxReconnectDelay
+			}
+			continue
+		}
+		s.log.Info("signaling websocket connected")
+		delay = wsMinReconnectDelay
+		s.serve(conn)
+		s.log.Warn("signaling websocket disconnected")
+	}
+}
+
+func (s *WebSocketSignaler) dial() (*websocket.Conn, error) {
+	config, err := websocket.NewConfig(s.url, s.origin)
+	if err != nil {
+		return nil, err
+	}
+	config.TlsConfig = s.tlsConfig
+	if len(s.secret) > 0 {
+		signHeader(config.Header, http.MethodGet, config.Location.RequestURI(), nil, s.secret)
+	}
+	return websocket.DialConfig(config)
+}
+
+func (s *WebSocketSignaler) Close() {
+	s.lock.Lock()
+	s.closed = true
+	conn := s.conn
+	for _, o := range s.pending {
+		o.done <- ErrSignalerClosed
+	}
+	s.pending = nil
+	s.written = 0
+	s.pendingEvents = 0
+	s.pendingControl = 0
+	s.cond.Broadcast()
+	s.inboundReady.Broadcast()
+	s.lock.Unlock()
+	if conn != nil {
+		_ = conn.Close()
+	}
+}
+
+func (s *WebSocketSignaler) SendOffer(req dto.SetSDPReqModel) error {
+	return s.send(MessageTypeOffer, req.RoomId, &req.ID, req, false)
+}
+
+func (s *WebSocketSignaler) SendAnswer(req dto.SetSDPReqModel) error {
+	return s.send(MessageTypeAnswer, req.RoomId, &req.ID, req, false)
+}
+
+func (s *WebSocketSignaler) SendICE(req dto.AddPeerICECandidateReqModel) error {
+	return s.send(MessageTypeICE, req.RoomId, &req.ID, req, false)
+}
+
+func (s *WebSocketSignaler) SendSpeakerChanged(req dto.SpeakerChangedReqModel) error {
+	return s.send(MessageTypeSpeaker, req.RoomId, nil, req, false)
+}
+
+func (s *WebSocketSignaler) Join(roomId string) error {
+	return s.send(MessageTypeJoin, roomId, nil, map[string]any{"roomId": roomId}, true)
+}
+
+func (s *WebSocketSignaler) Rejoin(roomId string) error {
+	return s.send(MessageTypeRejoin, roomId, nil, map[string]any{"roomId": roomId}, true)
+}
+
+func (s *WebSocketSignaler) Leave(roomId string) error {
+	return s.send(MessageTypeLeave, roomId, nil, map[string]any{"roomId": roomId}, true)
+}
+
+// ForgetRoom drops the room's events that logjam hasn't acked, joins, rejoins and leaves are left to their callers
+func (s *WebSocketSignaler) ForgetRoom(roomId string) {
+	s.dropEvents(func(o *wsOutgoing) bool {
+		return o.roomId == roomId
+	})
+}
+
+// ForgetPeer drops the peer's events that logjam hasn't acked
+func (s *WebSocketSignaler) ForgetPeer(roomId string, peerId uint64) {
+	s.dropEvents(func(o *wsOutgoing) bool {
+		return o.roomId == roomId && o.peerId != nil && *o.peerId == peerId
+	})
+}
+
+func (s *WebSocketSignaler) dropEvents(matches func(o *wsOutgoing) bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	kept := s.pending[:0]
+	for i, o := range s.pending {
+		if o.waitForAck || !matches(o) {
+			kept = append(kept, o)
+			continue
+		}
+		if i < s.written {
+			s.written--
+		}
+		s.pendingEvents--
+	}
+	for i := len(kept); i < len(s.pending); i++ {
+		s.pending[i] = nil
+	}
+	s.pending = kept
+}
+
+func (s *WebSocketSignaler) isClosed() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.closed
+}
+
+// send queues a message, when waitForAck is set it also waits for logjam to ack it and returns logjam's error if any.
+func (s *WebSocketSignaler) send(msgType string, roomId string, peerId *uint64, payload any, waitForAck bool) error {
+	serializedPayload, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	s.lock.Lock()
+	if s.closed {
+		s.lock.Unlock()
+		return ErrSignalerClosed
+	}
+	if (waitForAck && s.pendingControl >= wsMaxPendingControl) || (!waitForAck && s.pendingEvents >= wsMaxPendingEvents) {
+		s.lock.Unlock()
+		return fmt.Errorf("%w, dropping %s", ErrTooManyPending, msgType)
+	}
+	s.nextSeq++
+	o := &wsOutgoing{
+		msg: WSMessage{
+			Seq:     s.nextSeq,
+			Session: s.session,
+			Type:    msgType,
+			Payload: serializedPayload,
+		},
+		roomId:     roomId,
+		peerId:     peerId,
+		waitForAck: waitForAck,
+		done:       make(chan error, 1),
+	}
+	s.pending = append(s.pending, o)
+	s.countPending(o, 1)
+	s.cond.Broadcast()
+	s.lock.Unlock()
+
+	if !waitForAck {
+		return nil
+	}
+	select {
+	case err := <-o.done:
+		return err
+	case <-time.After(wsAckTimeout):
+		s.lock.Lock()
+		s.removePending(o.msg.Seq)
+		s.lock.Unlock()
+		return fmt.Errorf("%s: %w", msgType, ErrAckTimeout)
+	}
+}
+
+// countPending must be called with s.lock held.
+func (s *WebSocketSignaler) countPending(o *wsOutgoing, delta int) {
+	if o.waitForAck {
+		s.pendingControl += delta
+	} else {
+		s.pendingEvents += delta
+	}
+}
+
+// removePending must be called with s.lock held.
+func (s *WebSocketSignaler) removePending(seq uint64) *wsOutgoing {
+	for i, o := range s.pending {
+		if o.msg.Seq != seq {
+			continue
+		}
+		s.pending = append(s.pending[:i], s.pending[i+1:]...)
+		if i < s.written {
+			s.written--
+		}
+		s.countPending(o, -1)
+		return o
+	}
+	return nil
+}
+
+func (s *WebSocketSignaler) serve(conn *websocket.Conn) {
+	s.lock.Lock()
+	s.conn = conn
+	// everything not acked yet gets resent on the new connection, in order
+	s.written = 0
+	s.inSessionChecked = false
+	s.cond.Broadcast()
+	s.lock.Unlock()
+
+	stopPing := make(chan struct{})
+	go s.writeLoop(conn)
+	go s.pingLoop(conn, stopPing)
+	for {
+		var msg WSMessage
+		if err := websocket.JSON.Receive(conn, &msg); err != nil {
+			s.log.Warn("can't read from signaling websocket", "err", err)
+			break
+		}
+		s.onMessage(conn, msg)
+	}
+	close(stopPing)
+
+	s.lock.Lock()
+	if s.conn == conn {
+		s.conn = nil
+	}
+	s.cond.Broadcast()
+	s.lock.Unlock()
+	_ = conn.Close()
+}
+
+func (s *WebSocketSignaler) writeLoop(conn *websocket.Conn) {
+	for {
+		s.lock.Lock()
+		for s.conn == conn && s.written >= len(s.pending) {
+			s.cond.Wait()
+		}
+		if s.conn != conn {
+			s.lock.Unlock()
+			return
+		}
+		msg := s.pending[s.written].msg
+		s.written++
+		s.lock.Unlock()
+		if err := websocket.JSON.Send(conn, msg); err != nil {
+			s.log.Warn("can't write to signaling websocket", "err", err, "seq", msg.Seq, "type", msg.Type)
+			_ = conn.Close()
+			return
+		}
+	}
+}
+
+func (s *WebSocketSignaler) pingLoop(conn *websocket.Conn, stop chan struct{}) {
+	ticker := time.NewTicker(wsPingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if err := websocket.JSON.Send(conn, WSMessage{Type: messageTypePing}); err != nil {
+				s.log.Warn("can't ping signaling websocket", "err", err)
+				_ = conn.Close()
+				return
+			}
+		}
+	}
+}
+
+func (s *WebSocketSignaler) onMessage(conn *websocket.Conn, msg WSMessage) {
+	switch msg.Type {
+	case messageTypeAck:
+		s.lock.Lock()
+		o := s.removePending(msg.Ack)
+		s.lock.Unlock()
+		if o == nil {
+			return
+		}
+		if len(msg.Error) > 0 {
+			o.done <- errors.New(o.msg.Type + ": " + msg.Error)
+		} else {
+			o.done <- nil
+		}
+	case messageTypePing:
+		_ = websocket.JSON.Send(conn, WSMessage{Type: messageTypePong})
+	case messageTypePong:
+	default:
+		s.lock.Lock()
+		if !s.inSessionChecked {
+			// a new connection continues the previous sequence only when logjam says it's the same session,
+			// otherwise logjam may have restarted and its Seq started over
+			if len(msg.Session) == 0 || msg.Session != s.inSession {
+				s.lastInSeq = 0
+			}
+			s.inSession = msg.Session
+			s.inSessionChecked = true
+		}
+		duplicate := msg.Seq != 0 && msg.Seq <= s.lastInSeq
+		busy := !duplicate && len(s.inbound) >= wsMaxInboundMessages
+		if !duplicate && !busy {
+			if msg.Seq != 0 {
+				s.lastInSeq = msg.Seq
+			}
+			s.inbound = append(s.inbound, msg)
+			s.inboundReady.Signal()
+		}
+		s.lock.Unlock()
+		if duplicate {
+			// already handled, the ack must have been lost
+			_ = websocket.JSON.Send(conn, WSMessage{Type: messageTypeAck, Ack: msg.Seq})
+		} else if busy {
+			_ = websocket.JSON.Send(conn, WSMessage{Type: messageTypeAck, Ack: msg.Seq, Error: "goldgorilla is too busy, try again later"})
+		}
+	}
+}
+
+// nextInbound waits for the next message of logjam, it returns false once the signaler is closed.
+func (s *WebSocketSignaler) nextInbound() (WSMessage, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for len(s.inbound) == 0 && !s.closed {
+		s.inboundReady.Wait()
+	}
+	if s.closed {
+		return WSMessage{}, false
+	}
+	msg := s.inbound[0]
+	s.inbound = s.inbound[1:]
+	return msg, true
+}
+
+// handleInbound handles what logjam sends one message at a time, so they are applied in the order they were sent.
+func (s *WebSocketSignaler) handleInbound() {
+	for {
+		msg, ok := s.nextInbound()
+		if !ok {
+			return
+		}
+		ack := WSMessage{
+			Type: messageTypeAck,
+			Ack:  msg.Seq,
+		}
+		if s.handler == nil {
+			ack.Error = "goldgorilla has no handler for " + msg.Type
+		} else {
+			result, err := s.handler.HandleSignal(msg.Type, msg.Payload)
+			if err != nil {
+				ack.Error = err.Error()
+			} else if result != nil {
+				ack.Payload, err = json.Marshal(result)
+				if err != nil {
+					ack.Error = err.Error()
+				}
+			}
+		}
+		if msg.Seq == 0 {
+			continue
+		}
+		s.lock.Lock()
+		conn := s.conn
+		s.lock.Unlock()
+		if conn == nil {
+			continue
+		}
+		if err := websocket.JSON.Send(conn, ack); err != nil {
+			s.log.Warn("can't ack signaling message", "err", err, "ack", ack.Ack)
+		}
+	}
+}
@@ -0,0 +1,233 @@
+package signaling
+
+import (
+	"codeberg.org/greatape/goldgorilla/models/dto"
+	"encoding/json"
+	"errors"
+	"golang.org/x/net/websocket"
+	"io"
+	"log/slog"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+type recordingHandler struct {
+	handled chan WSMessage
+}
+
+func (h *recordingHandler) HandleSignal(msgType string, payload json.RawMessage) (any, error) {
+	h.handled <- WSMessage{Type: msgType, Payload: payload}
+	return nil, nil
+}
+
+// newTestLogjam starts a websocket server standing in for logjam, every connection goldgorilla makes is handed to the test
+func newTestLogjam(t *testing.T) (*WebSocketSignaler, *recordingHandler, chan *websocket.Conn) {
+	t.Helper()
+	conns := make(chan *websocket.Conn, 4)
+	done := make(chan struct{})
+	server := httptest.NewServer(websocket.Handler(func(conn *websocket.Conn) {
+		conns <- conn
+		<-done
+	}))
+	signaler := NewWebSocketSignaler(server.URL, "", nil, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	handler := &recordingHandler{handled: make(chan WSMessage, 16)}
+	signaler.SetHandler(handler)
+	t.Cleanup(func() {
+		signaler.Close()
+		close(done)
+		server.Close()
+	})
+	return signaler, handler, conns
+}
+
+func nextConn(t *testing.T, conns chan *websocket.Conn) *websocket.Conn {
+	t.Helper()
+	select {
+	case conn := <-conns:
+		return conn
+	case <-time.After(5 * time.Second):
+		t.Fatal("goldgorilla didn't connect")
+		return nil
+	}
+}
+
+func receive(t *testing.T, conn *websocket.Conn) WSMessage {
+	t.Helper()
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var msg WSMessage
+	if err := websocket.JSON.Receive(conn, &msg); err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
+
+func sendTo(t *testing.T, conn *websocket.Conn, msg WSMessage) {
+	t.Helper()
+	if err := websocket.JSON.Send(conn, msg); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func expectHandled(t *testing.T, handler *recordingHandler, msgType string) {
+	t.Helper()
+	select {
+	case msg := <-handler.handled:
+		if msg.Type != msgType {
+			t.Fatalf("handled %s, want %s", msg.Type, msgType)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("%s wasn't handled", msgType)
+	}
+}
+
+func expectNothingHandled(t *testing.T, handler *recordingHandler) {
+	t.Helper()
+	select {
+	case msg := <-handler.handled:
+		t.Fatalf("%s was handled again", msg.Type)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestWebSocketAcksAndDedupesInbound(t *testing.T) {
+	signaler, handler, conns := newTestLogjam(t)
+	go signaler.Run()
+	conn := nextConn(t, conns)
+
+	sendTo(t, conn, WSMessage{Seq: 1, Session: "a", Type: MessageTypeStartRoom})
+	if ack := receive(t, conn); ack.Type != messageTypeAck || ack.Ack != 1 || len(ack.Error) > 0 {
+		t.Fatalf("got %+v, want an ack of 1", ack)
+	}
+	expectHandled(t, handler, MessageTypeStartRoom)
+
+	// the ack got lost and logjam sends it again
+	sendTo(t, conn, WSMessage{Seq: 1, Session: "a", Type: MessageTypeStartRoom})
+	if ack := receive(t, conn); ack.Type != messageTypeAck || ack.Ack != 1 {
+		t.Fatalf("got %+v, want the duplicate acked", ack)
+	}
+	expectNothingHandled(t, handler)
+
+	sendTo(t, conn, WSMessage{Seq: 2, Session: "a", Type: MessageTypeResetRoom})
+	if ack := receive(t, conn); ack.Ack != 2 {
+		t.Fatalf("got %+v, want an ack of 2", ack)
+	}
+	expectHandled(t, handler, MessageTypeResetRoom)
+}
+
+func TestWebSocketDedupesAcrossReconnectsOfTheSameSession(t *testing.T) {
+	signaler, handler, conns := newTestLogjam(t)
+	go signaler.Run()
+
+	conn := nextConn(t, conns)
+	sendTo(t, conn, WSMessage{Seq: 1, Session: "a", Type: MessageTypeStartRoom})
+	receive(t, conn)
+	expectHandled(t, handler, MessageTypeStartRoom)
+	_ = conn.Close()
+
+	conn = nextConn(t, conns)
+	sendTo(t, conn, WSMessage{Seq: 1, Session: "a", Type: MessageTypeStartRoom})
+	receive(t, conn)
+	expectNothingHandled(t, handler)
+	_ = conn.Close()
+
+	// logjam restarted, its sequence starts over
+	conn = nextConn(t, conns)
+	sendTo(t, conn, WSMessage{Seq: 1, Session: "b", Type: MessageTypeStartRoom})
+	receive(t, conn)
+	expectHandled(t, handler, MessageTypeStartRoom)
+}
+
+func TestWebSocketResendsWhatWasntAcked(t *testing.T) {
+	signaler, _, conns := newTestLogjam(t)
+	go signaler.Run()
+	joined := make(chan error, 1)
+	go func() {
+		joined <- signaler.Join("room")
+	}()
+
+	conn := nextConn(t, conns)
+	first := receive(t, conn)
+	if first.Type != MessageTypeJoin || first.Seq == 0 {
+		t.Fatalf("got %+v, want a join", first)
+	}
+	_ = conn.Close()
+
+	conn = nextConn(t, conns)
+	again := receive(t, conn)
+	if again.Type != MessageTypeJoin || again.Seq != first.Seq || again.Session != first.Session {
+		t.Fatalf("got %+v, want the join resent as %+v", again, first)
+	}
+	sendTo(t, conn, WSMessage{Type: messageTypeAck, Ack: again.Seq, Error: "no such room"})
+	select {
+	case err := <-joined:
+		if err == nil || !strings.Contains(err.Error(), "no such room") {
+			t.Fatalf("Join returned %v, want logjam's error", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Join didn't return after the ack")
+	}
+}
+
+func TestWebSocketForgetsResetRoomsAndClosedPeers(t *testing.T) {
+	signaler, _, conns := newTestLogjam(t)
+	sdp := func(roomId string, id uint64) dto.SetSDPReqModel {
+		return dto.SetSDPReqModel{PeerDTO: dto.PeerDTO{RoomId: roomId, ID: id}}
+	}
+	_ = signaler.SendOffer(sdp("reset", 1))
+	_ = signaler.SendOffer(sdp("kept", 1))
+	_ = signaler.SendOffer(sdp("kept", 2))
+	_ = signaler.SendSpeakerChanged(dto.SpeakerChangedReqModel{PeerDTO: dto.PeerDTO{RoomId: "reset"}})
+	signaler.ForgetRoom("reset")
+	signaler.ForgetPeer("kept", 2)
+
+	go signaler.Run()
+	conn := nextConn(t, conns)
+	msg := receive(t, conn)
+	var peer dto.PeerDTO
+	if err := json.Unmarshal(msg.Payload, &peer); err != nil {
+		t.Fatal(err)
+	}
+	if msg.Type != MessageTypeOffer || peer.RoomId != "kept" || peer.ID != 1 {
+		t.Fatalf("got %s for %+v, want only the offer of peer 1 of the kept room", msg.Type, peer)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if err := websocket.JSON.Receive(conn, &msg); err == nil {
+		t.Fatalf("got %+v, it should have been forgotten", msg)
+	}
+}
+
+func TestWebSocketEventsDontCrowdOutJoins(t *testing.T) {
+	signaler, _, _ := newTestLogjam(t)
+	for i := 0; i < wsMaxPendingEvents; i++ {
+		if err := signaler.SendICE(dto.AddPeerICECandidateReqModel{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := signaler.SendICE(dto.AddPeerICECandidateReqModel{}); !errors.Is(err, ErrTooManyPending) {
+		t.Fatalf("got %v, want the event dropped", err)
+	}
+
+	joined := make(chan error, 1)
+	go func() {
+		joined <- signaler.Join("room")
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		signaler.lock.Lock()
+		queued := signaler.pendingControl
+		signaler.lock.Unlock()
+		if queued == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the join wasn't queued")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	signaler.Close()
+	if err := <-joined; !errors.Is(err, ErrSignalerClosed) {
+		t.Fatalf("Join returned %v, want it to have waited for logjam", err)
+	}
+}
@@ -0,0 +1,64 @@
+package store
+
+import (
+	"codeberg.org/greatape/goldgorilla/models"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+)
+
+// Store keeps the rooms snapshot across restarts
+type Store interface {
+	Save(snapshot models.RoomsSnapshot) error
+	// Load returns an empty snapshot when nothing was saved yet
+	Load() (models.RoomsSnapshot, error)
+}
+
+// FileStore keeps the snapshot in a json file, it's replaced atomically so a crash never leaves half a snapshot behind
+type FileStore struct {
+	path string
+}
+
+func NewFileStore(path string) *FileStore {
+	return &FileStore{
+		path: path,
+	}
+}
+
+func (s *FileStore) Save(snapshot models.RoomsSnapshot) error {
+	data, err := json.MarshalIndent(snapshot, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path)
+}
+
+func (s *FileStore) Load() (models.RoomsSnapshot, error) {
+	var snapshot models.RoomsSnapshot
+	data, err := os.ReadFile(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return snapshot, nil
+	}
+	if err != nil {
+		return snapshot, err
+	}
+	err = json.Unmarshal(data, &snapshot)
+	return snapshot, err
+}
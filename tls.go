@@ -0,0 +1,59 @@
+package main
+
+import (
+	"codeberg.org/greatape/goldgorilla/certs"
+	"codeberg.org/greatape/goldgorilla/models"
+	"crypto/tls"
+	"crypto/x509"
+	"log/slog"
+)
+
+// newTLSConfigs builds the tls config the api is served with and the one logjam is reached with,
+// each is nil when the config doesn't ask for it. certificates are watched for changes when certReloadInterval is set.
+func newTLSConfigs(conf *models.ConfigModel, log *slog.Logger) (*tls.Config, *tls.Config, error) {
+	var serverTLS, logjamTLS *tls.Config
+	if len(conf.TLS.CertFile) > 0 {
+		keyPair, err := loadKeyPair(conf, conf.TLS.CertFile, conf.TLS.KeyFile, log)
+		if err != nil {
+			return nil, nil, err
+		}
+		var clientCAs *x509.CertPool
+		if len(conf.TLS.ClientCAFile) > 0 {
+			clientCAs, err = certs.LoadCAPool(conf.TLS.ClientCAFile)
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+		serverTLS = certs.ServerConfig(keyPair, clientCAs)
+	}
+	if len(conf.LogjamTLS.CertFile) > 0 || len(conf.LogjamTLS.CAFile) > 0 {
+		var keyPair *certs.KeyPair
+		var rootCAs *x509.CertPool
+		var err error
+		if len(conf.LogjamTLS.CertFile) > 0 {
+			keyPair, err = loadKeyPair(conf, conf.LogjamTLS.CertFile, conf.LogjamTLS.KeyFile, log)
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+		if len(conf.LogjamTLS.CAFile) > 0 {
+			rootCAs, err = certs.LoadCAPool(conf.LogjamTLS.CAFile)
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+		logjamTLS = certs.ClientConfig(keyPair, rootCAs)
+	}
+	return serverTLS, logjamTLS, nil
+}
+
+func loadKeyPair(conf *models.ConfigModel, certFile string, keyFile string, log *slog.Logger) (*certs.KeyPair, error) {
+	keyPair, err := certs.NewKeyPair(certFile, keyFile, log)
+	if err != nil {
+		return nil, err
+	}
+	if conf.CertReloadInterval > 0 {
+		go keyPair.Watch(conf.CertReloadInterval)
+	}
+	return keyPair, nil
+}
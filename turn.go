@@ -0,0 +1,108 @@
+package main
+
+import (
+	"codeberg.org/greatape/goldgorilla/models"
+	"codeberg.org/greatape/goldgorilla/repositories"
+	"github.com/pion/turn/v2"
+	"github.com/pion/webrtc/v3"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// addEmbeddedTURN points every peer at the embedded turn server, through TURN REST credentials when a secret is set
+func addEmbeddedTURN(conf *models.ConfigModel) {
+	if !conf.EmbeddedTURN.Enabled {
+		return
+	}
+	_, udpPort, err := net.SplitHostPort(conf.EmbeddedTURN.UDPListenAddr)
+	if err != nil {
+		return
+	}
+	udpAddr := net.JoinHostPort(conf.EmbeddedTURN.PublicIP, udpPort)
+	stunURLs := []string{"stun:" + udpAddr}
+	turnURLs := []string{"turn:" + udpAddr + "?transport=udp"}
+	if _, tcpPort, err := net.SplitHostPort(conf.EmbeddedTURN.TCPListenAddr); err == nil {
+		turnURLs = append(turnURLs, "turn:"+net.JoinHostPort(conf.EmbeddedTURN.PublicIP, tcpPort)+"?transport=tcp")
+	}
+	if len(conf.TURNREST.Secret) > 0 {
+		conf.TURNREST.URIs = append(conf.TURNREST.URIs, turnURLs...)
+		conf.ICEServers = append(conf.ICEServers, webrtc.ICEServer{
+			URLs: stunURLs,
+		})
+		return
+	}
+	conf.ICEServers = append(conf.ICEServers, webrtc.ICEServer{
+		URLs:           append(stunURLs, turnURLs...),
+		Username:       conf.EmbeddedTURN.Username,
+		Credential:     conf.EmbeddedTURN.Password,
+		CredentialType: webrtc.ICECredentialTypePassword,
+	})
+}
+
+func startEmbeddedTURN(conf *models.ConfigModel, log *slog.Logger) (*turn.Server, error) {
+	relayAddressGenerator := &turn.RelayAddressGeneratorPortRange{
+		RelayAddress: net.ParseIP(conf.EmbeddedTURN.PublicIP),
+		Address:      conf.EmbeddedTURN.RelayBindAddr,
+		MinPort:      conf.EmbeddedTURN.RelayPortMin,
+		MaxPort:      conf.EmbeddedTURN.RelayPortMax,
+	}
+	udpListener, err := net.ListenPacket("udp4", conf.EmbeddedTURN.UDPListenAddr)
+	if err != nil {
+		return nil, err
+	}
+	serverConf := turn.ServerConfig{
+		Realm:       conf.EmbeddedTURN.Realm,
+		AuthHandler: embeddedTURNAuthHandler(conf, log),
+		PacketConnConfigs: []turn.PacketConnConfig{
+			{
+				PacketConn:            udpListener,
+				RelayAddressGenerator: relayAddressGenerator,
+			},
+		},
+	}
+	if len(conf.EmbeddedTURN.TCPListenAddr) > 0 {
+		tcpListener, err := net.Listen("tcp4", conf.EmbeddedTURN.TCPListenAddr)
+		if err != nil {
+			_ = udpListener.Close()
+			return nil, err
+		}
+		serverConf.ListenerConfigs = []turn.ListenerConfig{
+			{
+				Listener:              tcpListener,
+				RelayAddressGenerator: relayAddressGenerator,
+			},
+		}
+	}
+	server, err := turn.NewServer(serverConf)
+	if err != nil {
+		return nil, err
+	}
+	log.Info("embedded turn server started", "udp", conf.EmbeddedTURN.UDPListenAddr, "tcp", conf.EmbeddedTURN.TCPListenAddr, "publicIP", conf.EmbeddedTURN.PublicIP)
+	return server, nil
+}
+
+// embeddedTURNAuthHandler accepts unexpired TURN REST usernames (expiry:peerId) when a secret is set, the configured user otherwise
+func embeddedTURNAuthHandler(conf *models.ConfigModel, log *slog.Logger) turn.AuthHandler {
+	secret := conf.TURNREST.Secret
+	username := conf.EmbeddedTURN.Username
+	key := turn.GenerateAuthKey(username, conf.EmbeddedTURN.Realm, conf.EmbeddedTURN.Password)
+	return func(user string, realm string, srcAddr net.Addr) ([]byte, bool) {
+		if len(secret) == 0 {
+			if user != username {
+				log.Warn("embedded turn rejected unknown user", "username", user, "addr", srcAddr.String())
+				return nil, false
+			}
+			return key, true
+		}
+		expiry, _, _ := strings.Cut(user, ":")
+		expiresAt, err := strconv.ParseInt(expiry, 10, 64)
+		if err != nil || time.Now().Unix() > expiresAt {
+			log.Warn("embedded turn rejected invalid or expired credentials", "username", user, "addr", srcAddr.String())
+			return nil, false
+		}
+		return turn.GenerateAuthKey(user, realm, repositories.TURNRESTCredential(secret, user)), true
+	}
+}